@@ -1,32 +1,76 @@
 package fasttpl
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // ----------------------------- Fast accessors -------------------------------
 
 type accessor interface{ get(*renderCtx) (any, bool) }
 
-type step interface{ next(in any) (any, bool) }
+type step interface {
+	next(ctx *renderCtx, in any) (any, bool)
+}
 
 type localStep struct{ name string }
 
-func (s localStep) next(in any) (any, bool) { return in, true }
+func (s localStep) next(_ *renderCtx, in any) (any, bool) { return in, true }
 
 type rootStep struct{}
 
-func (s rootStep) next(in any) (any, bool) { return in, true }
+func (s rootStep) next(_ *renderCtx, in any) (any, bool) { return in, true }
 
 type fieldStep struct {
 	name string
-	// Pre-computed reflection info for common types
+	// Pre-computed reflection info, shared by every copy of the step and
+	// published atomically so PrecomputeFieldAccess can run during renders
+	pre *atomic.Pointer[precomputed]
+}
+
+func newFieldStep(name string) fieldStep {
+	return fieldStep{name: name, pre: new(atomic.Pointer[precomputed])}
+}
+
+// precomputed is the reflection info cached for a fieldStep.
+type precomputed struct {
 	structType reflect.Type
 	fieldIndex []int
+	// Map type the step looks keys up in, skipping the kind switch
+	mapType reflect.Type
+	// Zero-argument method, used when no field matches
+	methodType  reflect.Type
+	methodIndex int
+}
+
+func (s fieldStep) cached() *precomputed {
+	if s.pre == nil {
+		return nil
+	}
+	return s.pre.Load()
 }
 
-func (s fieldStep) next(in any) (any, bool) {
+func (s fieldStep) next(ctx *renderCtx, in any) (any, bool) {
+	if pc := s.cached(); pc != nil && pc.mapType != nil {
+		if m, ok := in.(map[string]any); ok && pc.mapType == mapStringAnyType {
+			v, ok := m[s.name]
+			return v, ok
+		}
+		if in != nil && reflect.TypeOf(in) == pc.mapType {
+			rv := reflect.ValueOf(in)
+			if v, ok := mapLookup(rv, s.name, false); ok {
+				return v, true
+			}
+			return s.method(ctx, rv)
+		}
+	}
+	if m, ok := in.(*sync.Map); ok && m != nil {
+		return syncMapLoad(m, s.name)
+	}
 	rv := reflect.ValueOf(in)
 	if !rv.IsValid() {
 		return nil, false
@@ -37,85 +81,318 @@ func (s fieldStep) next(in any) (any, bool) {
 		if rv.IsNil() {
 			return nil, false
 		}
-		return s.next(rv.Elem().Interface())
-	case reflect.Struct:
-		// Use cached field lookup
-		typ := rv.Type()
-		if s.structType == typ && s.fieldIndex != nil {
-			// Fast path: use cached field index
-			fv := rv.FieldByIndex(s.fieldIndex)
-			if fv.IsValid() {
-				return fv.Interface(), true
+		if elem := rv.Elem(); elem.Kind() == reflect.Struct {
+			if v, ok := s.field(ctx, elem); ok {
+				return v, true
 			}
-			return nil, false
+			// The pointer's method set covers both receiver kinds
+			return s.method(ctx, rv)
 		}
-
-		// Fallback to field lookup (will be cached for next time)
-		fv := rv.FieldByNameFunc(func(n string) bool {
-			return n == s.name || strings.EqualFold(n, s.name)
-		})
-		if fv.IsValid() {
-			return fv.Interface(), true
+		return s.next(ctx, rv.Elem().Interface())
+	case reflect.Struct:
+		if v, ok := s.field(ctx, rv); ok {
+			return v, true
 		}
+		return s.method(ctx, rv)
 	case reflect.Map:
-		// Fast path for map[string]any
-		if rv.Type().Key().Kind() == reflect.String && rv.Type().Elem() == reflect.TypeOf((*any)(nil)).Elem() {
-			m := rv.Interface().(map[string]any)
+		// Fast path for map[string]any; named map types take the fallback
+		if m, ok := rv.Interface().(map[string]any); ok {
 			if val, ok := m[s.name]; ok {
 				return val, true
 			}
 			return nil, false
 		}
 		// Fallback
-		mk := stringToReflectValue(s.name)
-		mv := rv.MapIndex(mk)
-		if mv.IsValid() {
-			return mv.Interface(), true
+		if v, ok := mapLookup(rv, s.name, false); ok {
+			return v, true
+		}
+	case reflect.Slice, reflect.Array:
+		// items.0 is the same as items[0]
+		if idx, err := strconv.Atoi(s.name); err == nil {
+			return indexStep{idx: idx}.next(ctx, in)
+		}
+	}
+	return s.method(ctx, rv)
+}
+
+var mapStringAnyType = reflect.TypeOf(map[string]any(nil))
+
+// mapLookup looks key up in the map rv, converting it to the map's key type
+// so that paths such as codes.404 or codes[404] work on a map[int]string.
+// Maps keyed by interfaces are tried with key as a string, then as an int.
+// Keys from the template source come from the value cache; dynamic keys,
+// computed while rendering, are not cached, or they would grow it unbounded.
+func mapLookup(rv reflect.Value, key string, dynamic bool) (any, bool) {
+	kt := rv.Type().Key()
+	var mk reflect.Value
+	switch kt.Kind() {
+	case reflect.String:
+		if dynamic {
+			mk = reflect.ValueOf(key)
+		} else {
+			mk = stringToReflectValue(key)
+		}
+		if kt != mk.Type() {
+			mk = mk.Convert(kt)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(key, 10, kt.Bits())
+		if err != nil {
+			return nil, false
+		}
+		mk = reflect.ValueOf(n).Convert(kt)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(key, 10, kt.Bits())
+		if err != nil {
+			return nil, false
+		}
+		mk = reflect.ValueOf(n).Convert(kt)
+	case reflect.Interface:
+		// Neither a string nor an int can key a map of, say, fmt.Stringer
+		if sk := reflect.ValueOf(key); sk.Type().AssignableTo(kt) {
+			if mv := rv.MapIndex(sk); mv.IsValid() {
+				return mv.Interface(), true
+			}
+		}
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, false
+		}
+		mk = reflect.ValueOf(n)
+		if !mk.Type().AssignableTo(kt) {
+			return nil, false
 		}
+	default:
+		return nil, false
+	}
+	if mv := rv.MapIndex(mk); mv.IsValid() {
+		return mv.Interface(), true
 	}
 	return nil, false
 }
 
-type indexStep struct{ idx int }
+// syncMapLoad looks key up in m, first as a string and then as an int.
+func syncMapLoad(m *sync.Map, key string) (any, bool) {
+	if v, ok := m.Load(key); ok {
+		return v, true
+	}
+	if n, err := strconv.Atoi(key); err == nil {
+		return m.Load(n)
+	}
+	return nil, false
+}
 
-func (s indexStep) next(in any) (any, bool) {
-	rv := reflect.ValueOf(in)
+// field resolves the step against a struct value.
+func (s fieldStep) field(ctx *renderCtx, rv reflect.Value) (any, bool) {
+	typ := rv.Type()
+	var index []int
+	if pc := s.cached(); pc != nil && pc.structType == typ {
+		// Fast path: use cached field index
+		index = pc.fieldIndex
+	}
+	if index == nil {
+		// Fallback to the template's field cache
+		info := ctx.fieldCache.lookup(typ, s.name, ctx.fieldTag)
+		if !info.found {
+			return nil, false
+		}
+		index = info.index
+	}
+	fv, err := rv.FieldByIndexErr(index)
+	if err != nil || !fv.IsValid() {
+		return nil, false
+	}
+	return fv.Interface(), true
+}
+
+// method calls a zero-argument method matching the step name on rv. Pointer
+// receiver methods are reached through an addressable copy when rv is not a
+// pointer.
+func (s fieldStep) method(ctx *renderCtx, rv reflect.Value) (any, bool) {
+	if pc := s.cached(); pc != nil && pc.methodType != nil && rv.Type() == pc.methodType {
+		return callMethod(ctx, s.name, rv.Method(pc.methodIndex))
+	}
+	if m := methodByName(rv, s.name); m.IsValid() {
+		return callMethod(ctx, s.name, m)
+	}
+	if rv.Kind() != reflect.Pointer {
+		if _, ok := findMethod(reflect.PointerTo(rv.Type()), s.name); ok {
+			ptr := reflect.New(rv.Type())
+			ptr.Elem().Set(rv)
+			return callMethod(ctx, s.name, methodByName(ptr, s.name))
+		}
+	}
+	return nil, false
+}
+
+// findMethod looks up an exported method by exact or case-insensitive name.
+func findMethod(typ reflect.Type, name string) (reflect.Method, bool) {
+	if m, ok := typ.MethodByName(name); ok {
+		return m, true
+	}
+	for i := 0; i < typ.NumMethod(); i++ {
+		if m := typ.Method(i); strings.EqualFold(m.Name, name) {
+			return m, true
+		}
+	}
+	return reflect.Method{}, false
+}
+
+func methodByName(rv reflect.Value, name string) reflect.Value {
+	if m, ok := findMethod(rv.Type(), name); ok {
+		return rv.Method(m.Index)
+	}
+	return reflect.Value{}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// callMethod calls m if it takes no arguments and returns a value, optionally
+// followed by an error, which is recorded on ctx.
+func callMethod(ctx *renderCtx, name string, m reflect.Value) (any, bool) {
+	mt := m.Type()
+	if mt.NumIn() != 0 || mt.NumOut() == 0 || mt.NumOut() > 2 {
+		return nil, false
+	}
+	if mt.NumOut() == 2 && !mt.Out(1).Implements(errorType) {
+		return nil, false
+	}
+	out := m.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		if ctx.err == nil {
+			ctx.err = fmt.Errorf("calling %s: %w", name, out[1].Interface().(error))
+		}
+		return nil, false
+	}
+	return out[0].Interface(), true
+}
+
+// indirect follows pointers and interfaces down to the value they refer to.
+// It reports false when it meets a nil on the way, including a nil v.
+func indirect(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
+
+type indexStep struct {
+	idx     int
+	dynamic bool // idx was computed while rendering, as by index()
+}
+
+func (s indexStep) next(_ *renderCtx, in any) (any, bool) {
+	if m, ok := in.(*sync.Map); ok && m != nil {
+		return syncMapLoad(m, strconv.Itoa(s.idx))
+	}
+	rv, ok := indirect(reflect.ValueOf(in))
+	if !ok {
+		return nil, false
+	}
 	switch rv.Kind() {
+	case reflect.Map:
+		return mapLookup(rv, strconv.Itoa(s.idx), s.dynamic)
 	case reflect.Slice, reflect.Array:
-		if s.idx < 0 || s.idx >= rv.Len() {
+		// Negative indices count from the end
+		idx := s.idx
+		if idx < 0 {
+			idx += rv.Len()
+		}
+		if idx < 0 || idx >= rv.Len() {
 			return nil, false
 		}
-		elem := rv.Index(s.idx)
 		// Fast path for []any or []map[string]any
-		if rv.Type().Elem() == reflect.TypeOf((*any)(nil)).Elem() {
-			slice := rv.Interface().([]any)
-			return slice[s.idx], true
-		} else if rv.Type().Elem() == reflect.TypeOf((*map[string]any)(nil)).Elem() {
-			slice := rv.Interface().([]map[string]any)
-			return slice[s.idx], true
+		switch slice := in.(type) {
+		case []any:
+			return slice[idx], true
+		case []map[string]any:
+			return slice[idx], true
 		}
 		// Fallback
-		return elem.Interface(), true
+		return rv.Index(idx).Interface(), true
 	}
 	return nil, false
 }
 
-type keyStep struct{ key string }
+// sliceStep takes the sub-slice items[lo:hi] of a slice or array. Missing
+// bounds default to the start and end; negative ones count from the end.
+type sliceStep struct {
+	lo, hi       int
+	hasLo, hasHi bool
+}
 
-func (s keyStep) next(in any) (any, bool) {
-	rv := reflect.ValueOf(in)
-	if rv.Kind() == reflect.Map {
-		mv := rv.MapIndex(stringToReflectValue(s.key))
-		if mv.IsValid() {
-			return mv.Interface(), true
-		}
+func (s sliceStep) next(_ *renderCtx, in any) (any, bool) {
+	rv, ok := indirect(reflect.ValueOf(in))
+	if !ok {
+		return nil, false
+	}
+	switch rv.Kind() {
+	case reflect.Array:
+		// Only addressable arrays can be sliced
+		arr := reflect.New(rv.Type()).Elem()
+		arr.Set(rv)
+		rv = arr
+	case reflect.Slice:
+	default:
+		return nil, false
+	}
+	n := rv.Len()
+	lo, hi := 0, n
+	if s.hasLo {
+		lo = s.lo
+	}
+	if s.hasHi {
+		hi = s.hi
+	}
+	if lo < 0 {
+		lo += n
+	}
+	if hi < 0 {
+		hi += n
+	}
+	if lo < 0 || hi > n || lo > hi {
+		return nil, false
+	}
+	return rv.Slice(lo, hi).Interface(), true
+}
+
+type keyStep struct {
+	key     string
+	dynamic bool // key was computed while rendering, as by index()
+}
+
+func (s keyStep) next(_ *renderCtx, in any) (any, bool) {
+	if m, ok := in.(*sync.Map); ok && m != nil {
+		return syncMapLoad(m, s.key)
+	}
+	if rv, ok := indirect(reflect.ValueOf(in)); ok && rv.Kind() == reflect.Map {
+		return mapLookup(rv, s.key, s.dynamic)
 	}
 	return nil, false
 }
 
+// literalAcc yields a constant value compiled from the template source.
+type literalAcc struct{ val any }
+
+func (a literalAcc) get(*renderCtx) (any, bool) { return a.val, true }
+
 // boundAcc is the main accessor implementation
 type boundAcc struct {
 	steps []step
+	path  string  // source expression, for error messages
+	pos   *srcPos // position of the tag, filled in once it is parsed
+}
+
+// miss reports a path that did not resolve. In strict mode it records an
+// error on ctx naming the path.
+func (a boundAcc) miss(ctx *renderCtx) (any, bool) {
+	if ctx.strict && ctx.err == nil {
+		ctx.err = fmt.Errorf("missing variable %q%s", a.path, a.pos.at())
+	}
+	return nil, false
 }
 
 func (a boundAcc) get(ctx *renderCtx) (any, bool) {
@@ -123,28 +400,34 @@ func (a boundAcc) get(ctx *renderCtx) (any, bool) {
 		return ctx.data, true
 	}
 
-	var cur any
 	if ls, ok := a.steps[0].(localStep); ok {
 		// Local path: start from locals
 		v, ok := ctx.locals[ls.name]
 		if !ok {
-			return nil, false
+			return a.miss(ctx)
 		}
-		cur = v
-		for _, st := range a.steps[1:] {
-			v, ok = st.next(cur)
-			if !ok {
-				return nil, false
-			}
-			cur = v
+		if v, ok = walkSteps(ctx, v, a.steps[1:]); ok {
+			return v, true
 		}
-		return cur, true
+		return a.miss(ctx)
+	}
+
+	// Non-local path: start from data, then try the fallback roots
+	if v, ok := walkSteps(ctx, ctx.data, a.steps); ok {
+		return v, true
 	}
+	for _, root := range ctx.fallbacks {
+		if v, ok := walkSteps(ctx, root, a.steps); ok {
+			return v, true
+		}
+	}
+	return a.miss(ctx)
+}
 
-	// Non-local path: start from data
-	cur = ctx.data
-	for _, st := range a.steps {
-		v, ok := st.next(cur)
+// walkSteps resolves steps one after another starting from cur.
+func walkSteps(ctx *renderCtx, cur any, steps []step) (any, bool) {
+	for _, st := range steps {
+		v, ok := st.next(ctx, cur)
 		if !ok {
 			return nil, false
 		}
@@ -0,0 +1,235 @@
+package fasttpl
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// ----------------------------- Parse Trees ----------------------------------
+
+// Tree is the parsed form of a template, for tools such as linters and
+// documentation generators that inspect templates without rendering them.
+type Tree struct {
+	nodes []node
+}
+
+// Parse parses a template without compiling it into a renderer. Options
+// select the delimiters and, with WithStrictFilters, the filters to check;
+// the others have no effect on the tree.
+func Parse(src string, opts ...Option) (Tree, error) {
+	nodes, err := newParser(src, newCompileOptions(opts)).parse()
+	if err != nil {
+		return Tree{}, err
+	}
+	return Tree{nodes: nodes}, nil
+}
+
+// Nodes returns the top-level nodes of the tree in source order.
+func (t Tree) Nodes() []Node { return viewNodes(sequence(t.nodes)) }
+
+// Walk calls fn for every node of the tree, depth first in source order.
+// Returning false from fn skips the children of that node.
+func (t Tree) Walk(fn func(Node) bool) {
+	for _, n := range t.Nodes() {
+		n.walk(fn)
+	}
+}
+
+// NodeKind identifies what a Node is. New kinds are only ever added.
+type NodeKind int
+
+const (
+	NodeText    NodeKind = iota // literal text between tags
+	NodePrint                   // {{ expr | filter }}
+	NodeIf                      // {{ if }}, with any elif as an If in its Else
+	NodeRange                   // {{ range item in items }}
+	NodeWith                    // {{ with path }} or {{ with path as name }}
+	NodeInclude                 // {{ include "name" }}
+	NodeLet                     // {{ let name = expr }}
+	NodeSwitch                  // {{ switch expr }}
+	NodeBlock                   // {{ block "name" }}
+	NodeTrans                   // {{ t "key" }}
+	NodeYield                   // {{ yield }}
+)
+
+var nodeKindNames = [...]string{
+	NodeText:    "Text",
+	NodePrint:   "Print",
+	NodeIf:      "If",
+	NodeRange:   "Range",
+	NodeWith:    "With",
+	NodeInclude: "Include",
+	NodeLet:     "Let",
+	NodeSwitch:  "Switch",
+	NodeBlock:   "Block",
+	NodeTrans:   "Trans",
+	NodeYield:   "Yield",
+}
+
+func (k NodeKind) String() string {
+	if k >= 0 && int(k) < len(nodeKindNames) {
+		return nodeKindNames[k]
+	}
+	return "NodeKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Node is a read-only view of a node in a Tree.
+type Node struct {
+	n node
+}
+
+// Kind reports what the node is.
+func (n Node) Kind() NodeKind {
+	switch n.n.(type) {
+	case printNode, constNode:
+		return NodePrint
+	case ifNode:
+		return NodeIf
+	case rangeNode:
+		return NodeRange
+	case withNode:
+		return NodeWith
+	case includeNode:
+		return NodeInclude
+	case letNode:
+		return NodeLet
+	case switchNode:
+		return NodeSwitch
+	case blockNode:
+		return NodeBlock
+	case transNode:
+		return NodeTrans
+	case yieldNode:
+		return NodeYield
+	}
+	return NodeText
+}
+
+// Text returns the text of a Text node, and "" for other kinds.
+func (n Node) Text() string {
+	if t, ok := n.n.(textNode); ok {
+		return t.text
+	}
+	return ""
+}
+
+// Name returns the name a node declares or refers to: the partial of an
+// Include (its expression when the name is dynamic), the local bound by a
+// Let, Range or With ... as, and the name of a Block. It is "" otherwise.
+func (n Node) Name() string {
+	switch node := n.n.(type) {
+	case includeNode:
+		return node.name
+	case letNode:
+		return node.name
+	case rangeNode:
+		return node.item
+	case withNode:
+		return node.name
+	case blockNode:
+		return node.name
+	}
+	return ""
+}
+
+// Vars returns the sorted top-level data keys read by the node's own
+// expressions, not its children's, as Template.Vars reports them. Inside a
+// With without "as" they are relative to its value.
+func (n Node) Vars() []string {
+	seen := make(map[string]bool)
+	switch node := n.n.(type) {
+	case blockNode:
+		// no expressions of its own
+	case withNode:
+		varsAccessor(node.acc, seen)
+	case ifNode:
+		varsAccessor(node.cond, seen)
+	case rangeNode:
+		varsAccessor(node.iter, seen)
+	case switchNode:
+		varsAccessor(node.value, seen)
+	default:
+		varsNode(node, seen)
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// Filters returns the names of the filters a Print node applies to its
+// value, in order, leaving out a final safe or raw.
+func (n Node) Filters() []string {
+	p, ok := n.n.(printNode)
+	if !ok || len(p.pipes) == 0 {
+		return nil
+	}
+	names := make([]string, len(p.pipes))
+	for i, pipe := range p.pipes {
+		names[i] = pipe.name
+	}
+	return names
+}
+
+// Body returns the nodes an If, Range, With or Block renders, or the bodies
+// of a Switch's cases one after another.
+func (n Node) Body() []Node {
+	switch node := n.n.(type) {
+	case ifNode:
+		return viewNodes(node.then)
+	case rangeNode:
+		return viewNodes(node.body)
+	case withNode:
+		return viewNodes(node.body)
+	case blockNode:
+		return viewNodes(node.body)
+	case switchNode:
+		var body []Node
+		for _, c := range node.cases {
+			body = append(body, viewNodes(c.body)...)
+		}
+		return body
+	}
+	return nil
+}
+
+// Else returns the else branch of an If, Range or With, or the default of a
+// Switch.
+func (n Node) Else() []Node {
+	switch node := n.n.(type) {
+	case ifNode:
+		return viewNodes(node.els)
+	case rangeNode:
+		return viewNodes(node.els)
+	case withNode:
+		return viewNodes(node.els)
+	case switchNode:
+		return viewNodes(node.def)
+	}
+	return nil
+}
+
+func (n Node) walk(fn func(Node) bool) {
+	if !fn(n) {
+		return
+	}
+	for _, child := range n.Body() {
+		child.walk(fn)
+	}
+	for _, child := range n.Else() {
+		child.walk(fn)
+	}
+}
+
+// viewNodes returns the nodes n stands for, flattening sequences.
+func viewNodes(n node) []Node {
+	switch node := n.(type) {
+	case nil:
+		return nil
+	case seqNode:
+		views := make([]Node, 0, len(node))
+		for _, child := range node {
+			views = append(views, viewNodes(child)...)
+		}
+		return views
+	}
+	return []Node{{n: n}}
+}
@@ -0,0 +1,89 @@
+package fasttpl
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTree(t *testing.T) {
+	src := `<h1>{{ title | upper | safe }}</h1>` +
+		`{{ let n = items | length }}` +
+		`{{ if user.admin }}{{ include "admin" with user }}{{ elif guest }}hi{{ else }}{{ $n }}{{ end }}` +
+		`{{ range item in items }}{{ with $item.tags as tags }}{{ $tags }}{{ end }}{{ else }}none{{ end }}`
+	tree, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	tree.Walk(func(n Node) bool {
+		kinds = append(kinds, n.Kind().String())
+		return true
+	})
+	want := "Text Print Text Let If Include If Text Print Range With Print Text"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Errorf("walk: expected %q, got %q", want, got)
+	}
+
+	top := tree.Nodes()
+	if len(top) != 6 {
+		t.Fatalf("expected 6 top-level nodes, got %d", len(top))
+	}
+	if top[0].Text() != "<h1>" {
+		t.Errorf("text: got %q", top[0].Text())
+	}
+	if f := top[1].Filters(); !slices.Equal(f, []string{"upper"}) {
+		t.Errorf("filters: got %q", f)
+	}
+	if top[3].Name() != "n" || !slices.Equal(top[3].Vars(), []string{"items"}) {
+		t.Errorf("let: got %q reading %q", top[3].Name(), top[3].Vars())
+	}
+	ifNode := top[4]
+	if v := ifNode.Vars(); !slices.Equal(v, []string{"user"}) {
+		t.Errorf("if vars: got %q", v)
+	}
+	if body := ifNode.Body(); len(body) != 1 || body[0].Kind() != NodeInclude || body[0].Name() != "admin" {
+		t.Errorf("if body: got %v", body)
+	}
+	if els := ifNode.Else(); len(els) != 1 || els[0].Kind() != NodeIf || !slices.Equal(els[0].Vars(), []string{"guest"}) {
+		t.Errorf("elif: got %v", els)
+	}
+	rng := top[5]
+	if rng.Name() != "item" || len(rng.Else()) != 1 || rng.Body()[0].Name() != "tags" {
+		t.Errorf("range: got %q", rng.Name())
+	}
+
+	// Returning false skips a node's children
+	var visited int
+	tree.Walk(func(n Node) bool {
+		visited++
+		return n.Kind() != NodeIf && n.Kind() != NodeRange
+	})
+	if visited != 6 {
+		t.Errorf("expected 6 nodes visited, got %d", visited)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tree, err := Parse(`<< name >>{{ name }}`, WithDelims("<<", ">>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := tree.Nodes(); len(n) != 2 || n[0].Kind() != NodePrint || n[1].Text() != "{{ name }}" {
+		t.Errorf("custom delimiters: got %v", n)
+	}
+
+	_, err = Parse(`{{ name | uper }}`, WithStrictFilters(true))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Column != 11 {
+		t.Errorf("expected an unknown filter error at column 11, got %v", err)
+	}
+	if _, err := Parse(`{{ if x }}`); err == nil {
+		t.Error("expected an error for an unclosed if")
+	}
+	if s := NodeKind(99).String(); s != "NodeKind(99)" {
+		t.Errorf("unknown kind: got %q", s)
+	}
+}
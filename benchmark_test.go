@@ -3,12 +3,27 @@ package fasttpl
 import (
 	"html/template"
 	"io"
+	"reflect"
 	"strings"
 	"testing"
 )
 
+const fastSrc = `
+<html>
+<head><title>{{ title | trim | upper }}</title></head>
+<body>
+  <ul>
+  {{ range item in items }}
+    <li>{{ $item.name }} — {{ $item.price }}</li>
+  {{ end }}
+  </ul>
+  {{ if user.admin }}<div class="admin">Hi, {{ user.name }}</div>{{ else }}<div>Welcome!</div>{{ end }}
+</body>
+</html>`
+
 var (
 	fastTpl *Template
+	fastPre *Template // fastSrc with field access precomputed for data
 	htmlTpl *template.Template
 	data    = map[string]any{
 		"title": "  Products  ",
@@ -19,21 +34,12 @@ var (
 
 func init() {
 	var err error
-	fastTpl, err = Compile(`
-<html>
-<head><title>{{ title | trim | upper }}</title></head>
-<body>
-  <ul>
-  {{ range item in items }}
-    <li>{{ $item.name }} — {{ $item.price }}</li>
-  {{ end }}
-  </ul>
-  {{ if user.admin }}<div class="admin">Hi, {{ user.name }}</div>{{ else }}<div>Welcome!</div>{{ end }}
-</body>
-</html>`)
+	fastTpl, err = Compile(fastSrc)
 	if err != nil {
 		panic(err)
 	}
+	fastPre = MustCompile(fastSrc)
+	fastPre.PrecomputeFieldAccess(reflect.TypeOf(data))
 
 	htmlTpl, err = template.New("test").Funcs(template.FuncMap{
 		"trim":  fastTrim,
@@ -63,6 +69,14 @@ func BenchmarkFastTpl(b *testing.B) {
 	}
 }
 
+func BenchmarkFastTplPrecomputed(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = fastPre.Render(io.Discard, data)
+	}
+}
+
 func BenchmarkHTMLTemplate(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -105,3 +119,13 @@ func TestWithFeature(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, result)
 	}
 }
+
+func BenchmarkPrintNumbers(b *testing.B) {
+	tpl := MustCompile(`{{ count }} {{ total }} {{ ratio }}`)
+	nums := map[string]any{"count": 12345, "total": int64(987654321), "ratio": 0.125}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tpl.Render(io.Discard, nums)
+	}
+}
@@ -2,12 +2,19 @@ package fasttpl
 
 import (
 	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"io/fs"
+	"maps"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,14 +38,101 @@ func WarmupCache() {
 // ----------------------------- Template compilation cache ----------------
 
 type CompileCache struct {
-	mu        sync.RWMutex
-	templates map[string]*Template
+	mu        sync.Mutex // lookups reorder the LRU, so there are no readers
+	templates *lru[*Template]
+	stats     cacheCounters
+}
+
+// CacheStats reports how effective a cache has been since it was created.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int // templates currently cached
+}
+
+type cacheCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+var globalCompileCache = NewCompileCache(500)
+
+// NewCompileCache creates a compile cache holding up to maxSize templates,
+// evicting the least recently used one once full.
+func NewCompileCache(maxSize int) *CompileCache {
+	return &CompileCache{templates: newLRU[*Template](maxSize)}
+}
+
+// lru maps keys to values and, once it holds more than maxSize entries,
+// evicts the least recently used one. It is not safe for concurrent use.
+type lru[V any] struct {
 	maxSize   int
+	order     *list.List // of *lruEntry[V], most recently used first
+	items     map[string]*list.Element
+	evictions uint64
+}
+
+type lruEntry[V any] struct {
+	key string
+	val V
+}
+
+func newLRU[V any](maxSize int) *lru[V] {
+	return &lru[V]{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
 }
 
-var globalCompileCache = &CompileCache{
-	templates: make(map[string]*Template),
-	maxSize:   500,
+// get returns the value for key and marks it as most recently used.
+func (c *lru[V]) get(key string) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[V]).val, true
+}
+
+// add stores val under key, evicting the least recently used entries when
+// the cache is over capacity.
+func (c *lru[V]) add(key string, val V) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry[V]).val = val
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, val: val})
+	for c.maxSize > 0 && c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+		c.evictions++
+	}
+}
+
+func (c *lru[V]) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// keys lists the cached keys, most recently used first.
+func (c *lru[V]) keys() []string {
+	keys := make([]string, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*lruEntry[V]).key)
+	}
+	return keys
+}
+
+func (c *lru[V]) clear() {
+	c.order.Init()
+	clear(c.items)
 }
 
 // ----------------------------- Field reflection cache -----------------------
@@ -51,10 +145,11 @@ type fieldCache struct {
 type fieldCacheKey struct {
 	typ  reflect.Type
 	name string
+	tag  string
 }
 
 type fieldInfo struct {
-	index    []int
+	index    []int // full path for fields promoted from embedded structs
 	found    bool
 	isMethod bool
 }
@@ -65,6 +160,43 @@ func newFieldCache() *fieldCache {
 	}
 }
 
+// lookup resolves name to the index path of an exported field of the struct
+// type typ. When tag is set (e.g. "json"), a field whose tag names name wins
+// over a Go field name match, which is case-insensitive.
+func (fc *fieldCache) lookup(typ reflect.Type, name, tag string) *fieldInfo {
+	key := fieldCacheKey{typ: typ, name: name, tag: tag}
+	fc.mu.RLock()
+	info, ok := fc.cache[key]
+	fc.mu.RUnlock()
+	if ok {
+		return info
+	}
+
+	info = &fieldInfo{}
+	if tag != "" {
+		for _, f := range reflect.VisibleFields(typ) {
+			tagName, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+			if f.IsExported() && tagName == name {
+				info.index, info.found = f.Index, true
+				break
+			}
+		}
+	}
+	if !info.found {
+		f, found := typ.FieldByNameFunc(func(n string) bool {
+			return n == name || strings.EqualFold(n, name)
+		})
+		if found && f.IsExported() {
+			info.index, info.found = f.Index, true
+		}
+	}
+
+	fc.mu.Lock()
+	fc.cache[key] = info
+	fc.mu.Unlock()
+	return info
+}
+
 type valueCache struct {
 	mu    sync.RWMutex
 	cache map[string]reflect.Value
@@ -88,22 +220,28 @@ func (vc *valueCache) get(s string) reflect.Value {
 	return v
 }
 
-// CompileCached compiles a template with in-memory caching
+// CompileCached compiles a template with in-memory caching. Templates using
+// custom filters, funcs or handlers are only cached under a WithCacheKey.
 func CompileCached(src string, opts ...Option) (*Template, error) {
 	return globalCompileCache.Compile(src, opts...)
 }
 
 func (cc *CompileCache) Compile(src string, opts ...Option) (*Template, error) {
-	// Create a cache key from source and options
-	key := src // Simple key - could hash for very large templates
+	key, ok := compileCacheKey(src, newCompileOptions(opts))
+	if !ok {
+		cc.stats.misses.Add(1)
+		return Compile(src, opts...)
+	}
 
-	cc.mu.RLock()
-	tmpl, exists := cc.templates[key]
-	cc.mu.RUnlock()
+	cc.mu.Lock()
+	tmpl, exists := cc.templates.get(key)
+	cc.mu.Unlock()
 
 	if exists {
+		cc.stats.hits.Add(1)
 		return tmpl, nil
 	}
+	cc.stats.misses.Add(1)
 
 	// Compile new template
 	tmpl, err := Compile(src, opts...)
@@ -113,49 +251,152 @@ func (cc *CompileCache) Compile(src string, opts ...Option) (*Template, error) {
 
 	// Cache result
 	cc.mu.Lock()
-	if len(cc.templates) >= cc.maxSize {
-		// Simple eviction: remove first entry
-		for k := range cc.templates {
-			delete(cc.templates, k)
-			break
-		}
-	}
-	cc.templates[key] = tmpl
+	cc.templates.add(key, tmpl)
 	cc.mu.Unlock()
 
 	return tmpl, nil
 }
 
+// compileCacheKey hashes the source together with every option that affects
+// the compiled template. Functions can't be compared, so options passing
+// them only contribute the names they register, and the caller's
+// WithCacheKey tells them apart; without one the template can't be cached
+// and ok is false.
+func compileCacheKey(src string, co compileOptions) (key string, ok bool) {
+	if co.funcOpts && co.cacheKey == "" {
+		return "", false
+	}
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, part := range parts {
+			io.WriteString(h, part)
+			h.Write([]byte{0})
+		}
+	}
+	write(src, co.leftDelim, co.rightDelim, co.fieldTag,
+		strconv.FormatBool(co.strict), strconv.Itoa(co.maxDepth), strconv.FormatBool(co.strictFilters),
+		co.timeout.String())
+	if co.funcOpts {
+		write("key", co.cacheKey)
+		write(slices.Sorted(maps.Keys(co.filters))...)
+		write("typed")
+		write(slices.Sorted(maps.Keys(co.typed))...)
+		write("writers")
+		write(slices.Sorted(maps.Keys(co.writers))...)
+		write("funcs")
+		write(slices.Sorted(maps.Keys(co.funcs))...)
+		write("escaper", strconv.FormatBool(co.escaper != nil))
+		write("missing", strconv.FormatBool(co.missing != nil))
+		write("markdown", strconv.FormatBool(co.markdown != nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// Stats returns the cache's hit, miss and eviction counts and current size.
+func (cc *CompileCache) Stats() CacheStats {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return CacheStats{
+		Hits:      cc.stats.hits.Load(),
+		Misses:    cc.stats.misses.Load(),
+		Evictions: cc.templates.evictions,
+		Size:      cc.templates.order.Len(),
+	}
+}
+
+// Len returns the number of cached templates.
+func (cc *CompileCache) Len() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.templates.order.Len()
+}
+
+// Keys returns the cache keys, most recently used first. Keys are hex hashes
+// of the source and compile options rather than the source itself.
+func (cc *CompileCache) Keys() []string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.templates.keys()
+}
+
 type compileOptions struct {
-	filters    Filters
-	leftDelim  string
-	rightDelim string
+	filters       Filters
+	typed         TypedFilters
+	writers       WriterFilters
+	funcs         Funcs
+	escaper       func(string) string // nil means htmlEscapeFast
+	missing       func(path string) (string, bool)
+	markdown      MarkdownRenderer // backs the markdown filter when set
+	fieldTag      string
+	strict        bool
+	maxDepth      int
+	timeout       time.Duration
+	strictFilters bool // rejects unknown filters at compile time
+	filtersSet    bool // WithFilters replaced the defaults
+	typedSet      bool // WithTypedFilters replaced the defaults
+	funcOpts      bool // filters, funcs or handlers were passed, so see cacheKey
+	cacheKey      string
+	leftDelim     string
+	rightDelim    string
+	patterns      []string           // selects template files; not part of the cache key
+	partials      *PartialConvention // nil disables partial auto-discovery
 }
 
 // FileCache provides template file caching with modification time checking
 type FileCache struct {
-	mu        sync.RWMutex
-	templates map[string]*cachedTemplate
-	maxSize   int
+	mu        sync.Mutex // lookups reorder the LRU, so there are no readers
+	templates *lru[*cachedTemplate]
+	fs        templateFS
+	stats     cacheCounters
+	ttl       time.Duration
+	now       func() time.Time
 }
 
 type cachedTemplate struct {
 	template *Template
 	modTime  time.Time
+	expires  time.Time // zero when entries don't expire
+}
+
+// FileCacheOption configures a FileCache.
+type FileCacheOption func(*FileCache)
+
+// WithTTL expires cached templates after d even if their file is unchanged,
+// so they are re-read and recompiled. A zero TTL only checks modification times.
+func WithTTL(d time.Duration) FileCacheOption {
+	return func(fc *FileCache) { fc.ttl = d }
 }
 
 // Global file cache instance
 var globalFileCache = &FileCache{
-	templates: make(map[string]*cachedTemplate),
-	maxSize:   1000, // configurable
+	templates: newLRU[*cachedTemplate](1000), // configurable
+	fs:        nativeFS,
+	now:       time.Now,
 }
 
-// NewFileCache creates a new file cache with specified max size
-func NewFileCache(maxSize int) *FileCache {
-	return &FileCache{
-		templates: make(map[string]*cachedTemplate),
-		maxSize:   maxSize,
+// NewFileCache creates a new file cache with specified max size. Once full,
+// the least recently used template is evicted; a max size of 0 disables
+// eviction.
+func NewFileCache(maxSize int, opts ...FileCacheOption) *FileCache {
+	return newFileCache(nativeFS, maxSize, opts)
+}
+
+// NewFileCacheFS creates a file cache that loads templates from fsys, such as
+// an embed.FS, instead of the OS filesystem.
+func NewFileCacheFS(fsys fs.FS, maxSize int, opts ...FileCacheOption) *FileCache {
+	return newFileCache(ioFS(fsys), maxSize, opts)
+}
+
+func newFileCache(tfs templateFS, maxSize int, opts []FileCacheOption) *FileCache {
+	fc := &FileCache{
+		templates: newLRU[*cachedTemplate](maxSize),
+		fs:        tfs,
+		now:       time.Now,
+	}
+	for _, o := range opts {
+		o(fc)
 	}
+	return fc
 }
 
 type Option func(*compileOptions)
@@ -165,99 +406,96 @@ func CompileFile(filename string, opts ...Option) (*Template, error) {
 	return globalFileCache.CompileFile(filename, opts...)
 }
 
+// MustCompileFile is like CompileFile but panics if the template cannot be
+// read or compiled.
+func MustCompileFile(filename string, opts ...Option) *Template {
+	t, err := CompileFile(filename, opts...)
+	if err != nil {
+		panic(fmt.Sprintf("fasttpl: MustCompileFile(%q): %v", filename, err))
+	}
+	return t
+}
+
 // CompileFile compiles a template from file with caching and automatic include discovery
 func (fc *FileCache) CompileFile(filename string, opts ...Option) (*Template, error) {
 	// Get file info first
-	info, err := os.Stat(filename)
+	info, err := fs.Stat(fc.fs.fsys, filename)
 	if err != nil {
 		return nil, fmt.Errorf("template file %q: %w", filename, err)
 	}
 
 	// Check cache
-	fc.mu.RLock()
-	cached, exists := fc.templates[filename]
-	fc.mu.RUnlock()
+	fc.mu.Lock()
+	cached, exists := fc.templates.get(filename)
+	fc.mu.Unlock()
 
-	if exists && !cached.modTime.Before(info.ModTime()) && len(opts) == 0 {
+	expired := exists && !cached.expires.IsZero() && !fc.now().Before(cached.expires)
+	if exists && !expired && !cached.modTime.Before(info.ModTime()) && len(opts) == 0 {
+		fc.stats.hits.Add(1)
 		return cached.template, nil
 	}
+	fc.stats.misses.Add(1)
 
-	// Read and compile
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("reading template %q: %w", filename, err)
-	}
-
-	tmpl, err := Compile(string(content), opts...)
+	// Read and compile, registering partials from the same directory
+	tmpl, err := fc.fs.compile(filename, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("compiling template %q: %w", filename, err)
-	}
-
-	// Auto-discover and register partials in the same directory
-	dir := filepath.Dir(filename)
-	base := filepath.Base(filename)
-	baseNoExt := strings.TrimSuffix(base, filepath.Ext(base))
-
-	// Look for partial files (e.g., _header.html, _footer.html)
-	entries, err := os.ReadDir(dir)
-	if err == nil { // Don't fail if we can't read directory
-		for _, entry := range entries {
-			name := entry.Name()
-			if entry.IsDir() || name == base {
-				continue
-			}
-
-			// Register files that start with underscore as partials
-			if strings.HasPrefix(name, "_") {
-				partialPath := filepath.Join(dir, name)
-				partialName := strings.TrimPrefix(name, "_")
-				partialName = strings.TrimSuffix(partialName, filepath.Ext(partialName))
-
-				// Skip if partial name matches the main template's base name (to avoid conflicts)
-				if partialName == baseNoExt {
-					continue
-				}
-
-				// Compile partial without include discovery to avoid infinite recursion
-				partialContent, err := os.ReadFile(partialPath)
-				if err != nil {
-					// Skip failed partials but don't fail the main compilation
-					continue
-				}
-
-				partial, err := Compile(string(partialContent), opts...)
-				if err != nil {
-					// Skip failed partials but don't fail the main compilation
-					continue
-				}
-				tmpl.RegisterPartial(partialName, partial)
-			}
-		}
+		return nil, err
 	}
 
 	// Cache the result only if no opts
 	if len(opts) == 0 {
 		fc.mu.Lock()
-		if len(fc.templates) >= fc.maxSize {
-			// Simple LRU: remove first entry (could be improved with proper LRU)
-			for k := range fc.templates {
-				delete(fc.templates, k)
-				break
-			}
-		}
-		fc.templates[filename] = &cachedTemplate{
+		entry := &cachedTemplate{
 			template: tmpl,
 			modTime:  info.ModTime(),
 		}
+		if fc.ttl > 0 {
+			entry.expires = fc.now().Add(fc.ttl)
+		}
+		fc.templates.add(filename, entry)
 		fc.mu.Unlock()
 	}
 
 	return tmpl, nil
 }
 
+// Stats returns the cache's hit, miss and eviction counts and current size.
+func (fc *FileCache) Stats() CacheStats {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return CacheStats{
+		Hits:      fc.stats.hits.Load(),
+		Misses:    fc.stats.misses.Load(),
+		Evictions: fc.templates.evictions,
+		Size:      fc.templates.order.Len(),
+	}
+}
+
+// Len returns the number of cached templates.
+func (fc *FileCache) Len() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.templates.order.Len()
+}
+
+// Keys returns the cached filenames, most recently used first.
+func (fc *FileCache) Keys() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.templates.keys()
+}
+
+// forget drops filename so that the next CompileFile recompiles it even if
+// the file itself is unchanged, e.g. because one of its partials changed.
+func (fc *FileCache) forget(filename string) {
+	fc.mu.Lock()
+	fc.templates.remove(filename)
+	fc.mu.Unlock()
+}
+
 // ClearCache clears the file cache
 func (fc *FileCache) ClearCache() {
 	fc.mu.Lock()
-	fc.templates = make(map[string]*cachedTemplate)
+	fc.templates.clear()
 	fc.mu.Unlock()
 }
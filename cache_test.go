@@ -0,0 +1,223 @@
+package fasttpl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLRUEviction(t *testing.T) {
+	c := newLRU[int](3)
+	c.add("a", 1)
+	c.add("b", 2)
+	c.add("c", 3)
+	c.get("a") // a is now the most recently used
+	c.add("d", 4)
+
+	if _, ok := c.get("b"); ok {
+		t.Error("expected least recently used entry b to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestFileCacheKeepsHotTemplate(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i := 0; i < 20; i++ {
+		fsys[fmt.Sprintf("t%d.html", i)] = &fstest.MapFile{Data: []byte(fmt.Sprint(i))}
+	}
+	fc := NewFileCacheFS(fsys, 4)
+	hot, err := fc.CompileFile("t0.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Touch the hot template between every cold compile
+	for i := 1; i < 20; i++ {
+		if _, err := fc.CompileFile(fmt.Sprintf("t%d.html", i)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fc.CompileFile("t0.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != hot {
+			t.Fatalf("hot template was evicted after %d cold compiles", i)
+		}
+	}
+	if n := fc.Len(); n != 4 {
+		t.Errorf("expected 4 cached templates, got %d", n)
+	}
+}
+
+func TestCompileCacheKeepsHotTemplate(t *testing.T) {
+	cc := NewCompileCache(2)
+	hot, _ := cc.Compile("hot")
+	for i := 0; i < 10; i++ {
+		cc.Compile(fmt.Sprint("cold ", i))
+		if got, _ := cc.Compile("hot"); got != hot {
+			t.Fatalf("hot template was evicted after %d cold compiles", i+1)
+		}
+	}
+}
+
+func TestCompileCacheKeyIncludesOptions(t *testing.T) {
+	cc := NewCompileCache(10)
+	src := "{{ name }} << name >>"
+	data := map[string]any{"name": "x"}
+
+	plain, err := cc.Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delims, err := cc.Compile(src, WithDelims("<<", ">>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain == delims {
+		t.Fatal("expected distinct templates for different delimiters")
+	}
+	if result, _ := plain.RenderString(data); result != "x << name >>" {
+		t.Errorf("expected %q, got %q", "x << name >>", result)
+	}
+	if result, _ := delims.RenderString(data); result != "{{ name }} x" {
+		t.Errorf("expected %q, got %q", "{{ name }} x", result)
+	}
+
+	// Equivalent options hit the same entry, different filters do not
+	if again, _ := cc.Compile(src, WithDelims("<<", ">>")); again != delims {
+		t.Error("expected the cached template for identical options")
+	}
+	custom := Filters{"shout": func(s string, _ []string) (string, error) { return s + "!", nil }}
+	if filtered, _ := cc.Compile(src, WithFilters(custom)); filtered == plain {
+		t.Error("expected a distinct template for a different filter set")
+	}
+}
+
+// Functions can't be told apart, so templates using custom ones are only
+// cached under the caller's key.
+func TestCompileCacheKeyFuncs(t *testing.T) {
+	cc := NewCompileCache(10)
+	cur := func(sym string) func(string, []string) (string, error) {
+		return func(s string, _ []string) (string, error) { return sym + s, nil }
+	}
+	dollar, euro := WithFilters(Filters{"cur": cur("$")}), WithFilters(Filters{"cur": cur("€")})
+	src := "{{ price | cur }}"
+	data := map[string]any{"price": 5}
+
+	// Without a key every call compiles afresh
+	first, err := cc.Compile(src, dollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cc.Compile(src, euro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || cc.Len() != 0 {
+		t.Fatalf("expected uncached templates, got %d cached", cc.Len())
+	}
+	if result, _ := first.RenderString(data); result != "$5" {
+		t.Errorf("expected %q, got %q", "$5", result)
+	}
+	if result, _ := second.RenderString(data); result != "€5" {
+		t.Errorf("expected %q, got %q", "€5", result)
+	}
+
+	usd, _ := cc.Compile(src, dollar, WithCacheKey("usd"))
+	eur, _ := cc.Compile(src, euro, WithCacheKey("eur"))
+	if usd == eur {
+		t.Fatal("expected distinct templates for distinct cache keys")
+	}
+	if result, _ := eur.RenderString(data); result != "€5" {
+		t.Errorf("expected %q, got %q", "€5", result)
+	}
+	if again, _ := cc.Compile(src, dollar, WithCacheKey("usd")); again != usd {
+		t.Error("expected the cached template for the same cache key")
+	}
+	if stats := cc.Stats(); stats.Hits != 1 || stats.Misses != 4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Handlers are functions too
+	mk := func(label string) func(string) (string, bool) {
+		return func(string) (string, bool) { return label, true }
+	}
+	a, _ := cc.Compile(`{{ missing }}`, WithMissingHandler(mk("first")))
+	b, _ := cc.Compile(`{{ missing }}`, WithMissingHandler(mk("second")))
+	if result, _ := a.RenderString(nil); result != "first" {
+		t.Errorf("expected %q, got %q", "first", result)
+	}
+	if result, _ := b.RenderString(nil); result != "second" {
+		t.Errorf("expected %q, got %q", "second", result)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.html": {Data: []byte("a")},
+		"b.html": {Data: []byte("b")},
+	}
+	fc := NewFileCacheFS(fsys, 1)
+	fc.CompileFile("a.html") // miss
+	fc.CompileFile("a.html") // hit
+	fc.CompileFile("b.html") // miss, evicts a.html
+
+	want := CacheStats{Hits: 1, Misses: 2, Evictions: 1, Size: 1}
+	if got := fc.Stats(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if keys := fc.Keys(); len(keys) != 1 || keys[0] != "b.html" {
+		t.Errorf("expected keys [b.html], got %v", keys)
+	}
+
+	cc := NewCompileCache(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc.Compile("shared")
+		}()
+	}
+	wg.Wait()
+	stats := cc.Stats()
+	if stats.Hits+stats.Misses != 8 || cc.Len() != 1 || len(cc.Keys()) != 1 {
+		t.Errorf("unexpected stats %+v with %d keys", stats, len(cc.Keys()))
+	}
+}
+
+func TestFileCacheTTL(t *testing.T) {
+	fsys := fstest.MapFS{"a.html": {Data: []byte("a")}}
+	now := time.Unix(1000, 0)
+	fc := NewFileCacheFS(fsys, 10, WithTTL(time.Minute))
+	fc.now = func() time.Time { return now }
+
+	first, _ := fc.CompileFile("a.html")
+	now = now.Add(59 * time.Second)
+	if second, _ := fc.CompileFile("a.html"); second != first {
+		t.Error("expected the cached template before the TTL passes")
+	}
+	now = now.Add(time.Second)
+	third, _ := fc.CompileFile("a.html")
+	if third == first {
+		t.Error("expected a recompiled template once the TTL passed")
+	}
+	if fourth, _ := fc.CompileFile("a.html"); fourth != third {
+		t.Error("expected the recompiled template to be cached again")
+	}
+
+	// Without a TTL only the modification time matters
+	fc = NewFileCacheFS(fsys, 10)
+	fc.now = func() time.Time { return now }
+	first, _ = fc.CompileFile("a.html")
+	now = now.Add(24 * time.Hour)
+	if second, _ := fc.CompileFile("a.html"); second != first {
+		t.Error("expected entries without a TTL not to expire")
+	}
+}
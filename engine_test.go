@@ -0,0 +1,322 @@
+package fasttpl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestEngineRenderAndLookup(t *testing.T) {
+	engine, err := NewTemplateFS(testFS, "views", ".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"title": "Hi", "name": "Ann"}
+
+	if _, ok := engine.Lookup("index"); !ok {
+		t.Error("expected index to be loaded")
+	}
+	if _, ok := engine.Lookup("missing"); ok {
+		t.Error("expected missing template not to be found")
+	}
+
+	result, err := engine.RenderString("index", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<h1>Hi</h1><p>Ann</p>" {
+		t.Errorf("expected %q, got %q", "<h1>Hi</h1><p>Ann</p>", result)
+	}
+
+	var sb strings.Builder
+	if err := engine.Render(&sb, "index", data, "layout"); err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != "<main><h1>Hi</h1><p>Ann</p></main>" {
+		t.Errorf("expected %q, got %q", "<main><h1>Hi</h1><p>Ann</p></main>", sb.String())
+	}
+
+	if _, err := engine.RenderString("missing", data); err == nil || err.Error() != `template "missing" not found` {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if _, err := engine.RenderString("index", data, "nolayout"); err == nil || err.Error() != `layout template "nolayout" not found` {
+		t.Errorf("expected layout not found error, got %v", err)
+	}
+}
+
+func TestEngineCompileAll(t *testing.T) {
+	fsys := fstest.MapFS{"a.html": {Data: []byte("a")}}
+	engine, err := NewTemplateFS(fsys, ".", ".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := engine.CompileAll(); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	fsys["a.html"] = &fstest.MapFile{Data: []byte(`a{{ include "p" }}`)}
+	fsys["b.html"] = &fstest.MapFile{Data: []byte(`{{ if x }}`)}
+	fsys["c.html"] = &fstest.MapFile{Data: []byte(`{{ end }}`)}
+	fsys["_p.html"] = &fstest.MapFile{Data: []byte(`{{ range }}`)}
+
+	// Load stops at the first failure and keeps the old templates
+	if err := engine.Load(); err == nil || !strings.Contains(err.Error(), `"_p.html"`) {
+		t.Errorf("Load: expected the _p.html error, got %v", err)
+	}
+	if result, _ := engine.RenderString("a", nil); result != "a" {
+		t.Errorf("after Load: expected %q, got %q", "a", result)
+	}
+
+	// CompileAll reports each broken file once and loads the rest
+	var failed []string
+	for _, err := range engine.CompileAll() {
+		failed = append(failed, strings.SplitN(err.Error(), `"`, 3)[1])
+	}
+	if strings.Join(failed, " ") != "_p.html b.html c.html" {
+		t.Errorf("expected errors for _p.html, b.html and c.html, got %q", failed)
+	}
+	if _, err := engine.RenderString("a", nil); err == nil || !strings.Contains(err.Error(), `partial "p" not found`) {
+		t.Errorf("after CompileAll: expected a with the broken partial skipped, got %v", err)
+	}
+}
+
+func TestEngineDefaultLayout(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.html": {Data: []byte("page")},
+		"base.html": {Data: []byte(`[{{ include "content" }}]`)},
+	}
+	engine, err := NewTemplateFS(fsys, ".", ".html", WithLayout("base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := engine.RenderString("page", nil); result != "[page]" {
+		t.Errorf("expected %q, got %q", "[page]", result)
+	}
+}
+
+func TestEngineLayouts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.html":  {Data: []byte("page")},
+		"own.html":   {Data: []byte(`{{ layout "alt" }}own`)},
+		"bare.html":  {Data: []byte(`{{ layout none }}bare`)},
+		"base.html":  {Data: []byte(`[{{ yield }}]`)},
+		"alt.html":   {Data: []byte(`<{{ yield }}>`)},
+		"other.html": {Data: []byte(`({{ include "content" }})`)},
+	}
+	engine, err := NewTemplateFS(fsys, ".", ".html", WithLayout("base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		layout   []string
+		expected string
+	}{
+		{"page", nil, "[page]"},
+		{"own", nil, "<own>"},
+		{"bare", nil, "bare"},
+		{"page", []string{"other"}, "(page)"},
+		{"own", []string{"base"}, "[own]"},
+		{"page", []string{""}, "page"},
+		{"base", []string{""}, "[]"},
+	}
+	for _, c := range cases {
+		if result, err := engine.RenderString(c.name, nil, c.layout...); err != nil || result != c.expected {
+			t.Errorf("%s in %v: expected %q, got %q (%v)", c.name, c.layout, c.expected, result, err)
+		}
+	}
+
+	var sb strings.Builder
+	if err := engine.RenderWithLayout(&sb, "alt", "bare", nil); err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != "<bare>" {
+		t.Errorf("expected %q, got %q", "<bare>", sb.String())
+	}
+
+	if _, err := Compile(`{{ layout "a" }}{{ layout "b" }}`); err == nil {
+		t.Error("expected an error for a second layout tag")
+	}
+}
+
+func TestEngineAddFilter(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(filename, []byte(`{{ name | shout }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "_sig.html"), []byte(`{{ name | shout }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewTemplate(dir, ".html", WithReloadInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+
+	shout := func(s string, _ []string) (string, error) { return strings.ToUpper(s) + "!", nil }
+	if err := engine.AddFilter("shout", shout); err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"name": "ann"}
+	if result, err := engine.RenderString("page", data); err != nil || result != "ANN!" {
+		t.Errorf("expected %q, got %q (%v)", "ANN!", result, err)
+	}
+
+	// Reloaded templates and their partials keep the engine's filters
+	old, _ := engine.Lookup("page")
+	later := time.Now().Add(time.Second)
+	if err := os.WriteFile(filename, []byte(`<{{ name | shout }}{{ include "sig" }}>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filename, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if tmpl, _ := engine.Lookup("page"); tmpl != old {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("template was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if result, err := engine.RenderString("page", data); err != nil || result != "<ANN!ANN!>" {
+		t.Errorf("expected %q, got %q (%v)", "<ANN!ANN!>", result, err)
+	}
+}
+
+func TestEngineStrictFilters(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "page.html")
+	write := func(name, src string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(name, mod, mod)
+	}
+	write(filename, `{{ name }}`, time.Now())
+	engine, err := NewTemplate(dir, ".html", WithReloadInterval(10*time.Millisecond),
+		WithCompileOptions(WithStrictFilters(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+	if err := engine.AddFilter("shout", func(s string, _ []string) (string, error) { return strings.ToUpper(s), nil }); err != nil {
+		t.Fatal(err)
+	}
+	// reloaded waits for the reload of page.html, which the engine has
+	// handled by the time the event arrives
+	reloaded := func() ReloadEvent {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-engine.reloadManager.Events():
+				if ev.Filename == filename {
+					return ev
+				}
+			case <-timeout:
+				t.Fatal("template was not reloaded")
+			}
+		}
+	}
+	data := map[string]any{"name": "ann"}
+
+	// The strict check knows the added filter when the file is reloaded
+	write(filename, `{{ name | shout }}`, time.Now().Add(time.Second))
+	if ev := reloaded(); ev.Err != nil {
+		t.Fatalf("reload: %v", ev.Err)
+	}
+	if result, err := engine.RenderString("page", data); err != nil || result != "ANN" {
+		t.Errorf("expected %q, got %q (%v)", "ANN", result, err)
+	}
+
+	// Failed reloads keep the last good version, also when only a partial fails
+	good, _ := engine.Lookup("page")
+	write(filepath.Join(dir, "_sig.html"), `{{ name | nope }}`, time.Now())
+	write(filename, `{{ name | shout }}{{ include "sig" }}`, time.Now().Add(2*time.Second))
+	reloaded()
+	write(filename, `{{ name | nope }}`, time.Now().Add(3*time.Second))
+	if ev := reloaded(); ev.Err == nil {
+		t.Error("expected the reload to fail on the unknown filter")
+	}
+	if tmpl, _ := engine.Lookup("page"); tmpl != good {
+		t.Error("expected the previous template to be kept")
+	}
+	if result, err := engine.RenderString("page", data); err != nil || result != "ANN" {
+		t.Errorf("expected %q, got %q (%v)", "ANN", result, err)
+	}
+}
+
+func TestEngineCompileOptions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.html":   {Data: []byte(`<% name | shout %><% include "sig" %>`)},
+		"_sig.html":   {Data: []byte(` -<% name | upper %>`)},
+		"layout.html": {Data: []byte(`[<% yield %>]`)},
+	}
+	shout := Filters{"shout": func(s string, _ []string) (string, error) { return s + "!", nil }}
+	engine, err := NewTemplateFS(fsys, ".", ".html", WithLayout("layout"),
+		WithCompileOptions(WithDelims("<%", "%>"), WithFilters(shout)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"name": "ann"}
+	if _, err := engine.RenderString("page", data); err == nil {
+		t.Error("expected upper to be unavailable when WithFilters replaces the defaults")
+	}
+
+	// Added filters layer over the configured ones
+	if err := engine.AddFilter("upper", func(s string, _ []string) (string, error) { return strings.ToUpper(s), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := engine.RenderString("page", data); err != nil || result != "[ann! -ANN]" {
+		t.Errorf("expected %q, got %q (%v)", "[ann! -ANN]", result, err)
+	}
+}
+
+func TestEnginePatterns(t *testing.T) {
+	fsys := fstest.MapFS{
+		"home.gohtml":     {Data: []byte(`home`)},
+		"card.mustache":   {Data: []byte(`card`)},
+		"notes.html":      {Data: []byte(`notes`)},
+		"home.gohtml.bak": {Data: []byte(`old`)},
+	}
+	engine, err := NewTemplateFS(fsys, ".", ".gohtml",
+		WithCompileOptions(WithPatterns("*.gohtml", "*.mustache")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"home": true, "card": true, "notes": false, "home.gohtml": false} {
+		if _, ok := engine.Lookup(name); ok != want {
+			t.Errorf("Lookup(%q): expected %v, got %v", name, want, ok)
+		}
+	}
+
+	_, err = NewTemplateFS(fsys, ".", ".gohtml", WithCompileOptions(WithPatterns("[")))
+	if err == nil || !strings.Contains(err.Error(), `template pattern "["`) {
+		t.Errorf("expected a malformed pattern error, got %v", err)
+	}
+}
+
+func TestEngineRenderBuffered(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.html": {Data: []byte(`page {{ include "nope" }}`)},
+		"ok.html":   {Data: []byte(`ok`)},
+		"base.html": {Data: []byte(`[{{ yield }}]`)},
+	}
+	engine, err := NewTemplateFS(fsys, ".", ".html", WithLayout("base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err := engine.RenderBuffered(&sb, "page", nil); err == nil || sb.Len() != 0 {
+		t.Errorf("expected an error and no output, got %q (%v)", sb.String(), err)
+	}
+	if err := engine.RenderBuffered(&sb, "ok", nil); err != nil || sb.String() != "[ok]" {
+		t.Errorf("expected %q, got %q (%v)", "[ok]", sb.String(), err)
+	}
+}
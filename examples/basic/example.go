@@ -161,7 +161,7 @@ func main() {
 	defer outputFile.Close()
 	defer os.Remove("output.html")
 
-	err = tmpl.Render(outputFile, data)
+	err = tmpl.RenderFlush(outputFile, data)
 	if err != nil {
 		fmt.Printf("Error rendering to file: %v\n", err)
 		return
@@ -5,3 +5,8 @@ go 1.25.0
 replace github.com/oarkflow/fasttpl => ../
 
 require github.com/oarkflow/fasttpl v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/fsnotify/fsnotify v1.9.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
@@ -75,20 +75,14 @@ func (s *Server) handlePage(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	// Render the template using the engine (it will use the default layout)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Render the template using the engine (it will use the default layout),
+	// serving the index page for unknown paths
 	templateName := page[1:] // Remove leading slash
-	if err := engine.Render(w, templateName, data); err != nil {
-		// Try to serve the index page as fallback
-		if templateName != "index" {
-			if err := engine.Render(w, "index", data); err != nil {
-				http.Error(w, fmt.Sprintf("Template error: %v", err), 500)
-				return
-			}
-		} else {
-			http.Error(w, fmt.Sprintf("Template error: %v", err), 500)
-			return
-		}
+	if _, ok := engine.Lookup(templateName); !ok {
+		templateName = "index"
+	}
+	if err := engine.RenderHTTP(w, templateName, data); err != nil {
+		log.Printf("render %s: %v", templateName, err)
 	}
 }
 
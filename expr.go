@@ -0,0 +1,760 @@
+package fasttpl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------- Condition expressions ------------------------
+
+// compareAcc evaluates a binary comparison and yields a bool.
+type compareAcc struct {
+	op    string
+	left  accessor
+	right accessor
+}
+
+func (a compareAcc) get(ctx *renderCtx) (any, bool) {
+	l, _ := a.left.get(ctx)
+	r, _ := a.right.get(ctx)
+	switch a.op {
+	case "==":
+		return equalValues(l, r), true
+	case "!=":
+		return !equalValues(l, r), true
+	}
+	c, ok := compareValues(l, r)
+	if !ok {
+		return false, true
+	}
+	switch a.op {
+	case "<":
+		return c < 0, true
+	case "<=":
+		return c <= 0, true
+	case ">":
+		return c > 0, true
+	case ">=":
+		return c >= 0, true
+	}
+	return false, true
+}
+
+// andAcc yields true when every term is truthy, stopping at the first falsy one.
+type andAcc []accessor
+
+func (a andAcc) get(ctx *renderCtx) (any, bool) {
+	for _, term := range a {
+		if v, _ := term.get(ctx); !truthyFast(v) {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// orAcc yields true when any term is truthy, stopping at the first truthy one.
+type orAcc []accessor
+
+func (a orAcc) get(ctx *renderCtx) (any, bool) {
+	for _, term := range a {
+		if v, _ := term.get(ctx); truthyFast(v) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// notAcc negates the truthiness of its operand.
+type notAcc struct{ acc accessor }
+
+func (a notAcc) get(ctx *renderCtx) (any, bool) {
+	v, _ := a.acc.get(ctx)
+	return !truthyFast(v), true
+}
+
+// compileCond compiles the expression of an if tag into a boolean-yielding
+// accessor. From loosest to tightest binding the grammar is: or, and, a
+// not/! prefix, then comparisons between operands. Parentheses group.
+func compileCond(expr string) (accessor, error) {
+	expr = fastTrim(expr)
+	if expr == "" {
+		return nil, errors.New("empty condition")
+	}
+	if terms := splitTopLevelWord(expr, "or"); len(terms) > 1 {
+		acc, err := compileTerms(terms)
+		return orAcc(acc), err
+	}
+	if terms := splitTopLevelWord(expr, "and"); len(terms) > 1 {
+		acc, err := compileTerms(terms)
+		return andAcc(acc), err
+	}
+	if strings.HasPrefix(expr, "not ") || strings.HasPrefix(expr, "not(") {
+		acc, err := compileCond(expr[3:])
+		if err != nil {
+			return nil, err
+		}
+		return notAcc{acc: acc}, nil
+	}
+	if expr[0] == '!' && !strings.HasPrefix(expr, "!=") {
+		acc, err := compileCond(expr[1:])
+		if err != nil {
+			return nil, err
+		}
+		return notAcc{acc: acc}, nil
+	}
+	if inner, ok := unwrapParens(expr); ok {
+		return compileCond(inner)
+	}
+	if idx, op := indexCompareOp(expr); idx >= 0 {
+		left, err := compileOperand(expr[:idx])
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileOperand(expr[idx+len(op):])
+		if err != nil {
+			return nil, err
+		}
+		return compareAcc{op: op, left: left, right: right}, nil
+	}
+	return compileOperand(expr)
+}
+
+func compileTerms(terms []string) ([]accessor, error) {
+	accs := make([]accessor, len(terms))
+	for i, term := range terms {
+		acc, err := compileCond(term)
+		if err != nil {
+			return nil, err
+		}
+		accs[i] = acc
+	}
+	return accs, nil
+}
+
+// compileOperand compiles a single literal or path operand, optionally
+// followed by filters.
+func compileOperand(expr string) (accessor, error) {
+	expr = fastTrim(expr)
+	if expr == "" {
+		return nil, errors.New("missing operand")
+	}
+	acc, pipes, err := compileAccessor(expr)
+	if err != nil || len(pipes) == 0 {
+		return acc, err
+	}
+	return pipeAcc{acc: acc, pipes: pipes}, nil
+}
+
+// ternaryAcc yields then when cond is truthy and els otherwise, as in
+// {{ user.admin ? "Admin" : "User" }}.
+type ternaryAcc struct {
+	cond, then, els accessor
+}
+
+func (a ternaryAcc) get(ctx *renderCtx) (any, bool) {
+	if v, _ := a.cond.get(ctx); truthyFast(v) {
+		return a.then.get(ctx)
+	}
+	return a.els.get(ctx)
+}
+
+// compileTernary compiles the parts of a cond ? then : else expression. The
+// condition may compare values like an if tag; the branches are operands
+// with their own filters, and may be ternaries themselves.
+func compileTernary(cond, then, els string) (accessor, error) {
+	c, err := compileCond(cond)
+	if err != nil {
+		return nil, err
+	}
+	t, err := compileOperand(then)
+	if err != nil {
+		return nil, err
+	}
+	e, err := compileOperand(els)
+	if err != nil {
+		return nil, err
+	}
+	return ternaryAcc{cond: c, then: t, els: e}, nil
+}
+
+// splitTernary splits expr at its top-level " ? " and the matching " : ".
+// Both must have whitespace on either side, which sets them apart from
+// filter argument colons such as truncate:10. Question marks and colons
+// inside quotes or parentheses are skipped, and a nested ternary in the
+// middle operand is matched with its own colon.
+func splitTernary(expr string) (cond, then, els string, ok bool) {
+	q := -1
+	nested := 0
+	inQuote := byte(0)
+	depth := 0
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		if inQuote != 0 {
+			if c == inQuote {
+				inQuote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			inQuote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '?', ':':
+			if depth != 0 || i == 0 || i == len(expr)-1 || !isSpace(expr[i-1]) || !isSpace(expr[i+1]) {
+				continue
+			}
+			switch {
+			case c == '?' && q < 0:
+				q = i
+			case c == '?':
+				nested++
+			case q < 0:
+			case nested > 0:
+				nested--
+			default:
+				return expr[:q], expr[q+1 : i], expr[i+1:], true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+// callAcc calls a function registered with WithFuncs.
+type callAcc struct {
+	name string
+	args []accessor
+}
+
+func (a callAcc) get(ctx *renderCtx) (any, bool) {
+	f := ctx.funcs[a.name]
+	if f == nil {
+		if ctx.err == nil {
+			ctx.err = fmt.Errorf("unknown function %q", a.name)
+		}
+		return nil, false
+	}
+	args := make([]any, len(a.args))
+	for i, arg := range a.args {
+		args[i], _ = arg.get(ctx)
+	}
+	if ctx.err != nil {
+		return nil, false
+	}
+	v, err := f(args...)
+	if err != nil {
+		if ctx.err == nil {
+			ctx.err = fmt.Errorf("%s: %w", a.name, err)
+		}
+		return nil, false
+	}
+	return v, true
+}
+
+// splitCall splits a call such as t("greeting", user.name) into the function
+// name and the text between the parentheses.
+func splitCall(expr string) (name, args string, ok bool) {
+	open := strings.IndexByte(expr, '(')
+	if open <= 0 || !isIdent(expr[:open]) {
+		return "", "", false
+	}
+	inner, ok := unwrapParens(expr[open:])
+	return expr[:open], inner, ok
+}
+
+// coalesceAcc yields the first truthy operand, or the last operand when none
+// is, as in coalesce(user.nickname, user.name, "Guest"). Operands after the
+// first truthy one aren't evaluated.
+type coalesceAcc []accessor
+
+func (a coalesceAcc) get(ctx *renderCtx) (any, bool) {
+	// A missing fallback isn't an error, even in strict mode
+	strict := ctx.strict
+	ctx.strict = false
+	defer func() { ctx.strict = strict }()
+	var v any
+	ok := false
+	for _, op := range a {
+		if v, ok = op.get(ctx); truthyFast(v) {
+			return v, true
+		}
+	}
+	return v, ok
+}
+
+// indexAcc looks each key operand up in turn in the value of the first, as
+// in index(items, $i) or index(grid, row, col), for keys held in variables
+// rather than written in the path. Integer keys index slices and arrays,
+// counting from the end when negative, and other keys look maps up. A key
+// that isn't there yields not found, like a missing path.
+type indexAcc []accessor
+
+func (a indexAcc) get(ctx *renderCtx) (any, bool) {
+	v, ok := a[0].get(ctx)
+	for _, keyAcc := range a[1:] {
+		if !ok {
+			return nil, false
+		}
+		key, found := keyAcc.get(ctx)
+		if !found {
+			return nil, false
+		}
+		v, ok = indexValue(ctx, v, key)
+	}
+	return v, ok
+}
+
+// indexValue looks key up in v for indexAcc.
+func indexValue(ctx *renderCtx, v, key any) (any, bool) {
+	if i, _, isInt, ok := numberValue(key); ok && isInt {
+		return indexStep{idx: int(i), dynamic: true}.next(ctx, v)
+	}
+	if s, ok := key.(string); ok {
+		return keyStep{key: s, dynamic: true}.next(ctx, v)
+	}
+	rv, ok := indirect(reflect.ValueOf(v))
+	kv := reflect.ValueOf(key)
+	if !ok || rv.Kind() != reflect.Map || !kv.IsValid() || !kv.Type().AssignableTo(rv.Type().Key()) {
+		return nil, false
+	}
+	if e := rv.MapIndex(kv); e.IsValid() {
+		return e.Interface(), true
+	}
+	return nil, false
+}
+
+// compileCall compiles the comma-separated arguments of a call. Each may be
+// any operand, including other calls and filtered values. The coalesce and
+// index builtins are compiled here rather than looked up among the funcs,
+// since coalesce evaluates its operands lazily and index can report a
+// missing key.
+func compileCall(name, args string) (accessor, error) {
+	call := callAcc{name: name}
+	if fastTrim(args) != "" {
+		for _, arg := range splitTopLevel(args, ',') {
+			acc, err := compileOperand(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			call.args = append(call.args, acc)
+		}
+	}
+	switch name {
+	case "coalesce":
+		return coalesceAcc(call.args), nil
+	case "index":
+		if len(call.args) < 2 {
+			return nil, errors.New("index: want a collection and at least one key")
+		}
+		return indexAcc(call.args), nil
+	}
+	return call, nil
+}
+
+// splitTopLevel splits s at each sep outside quotes and parentheses.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	for {
+		i := indexTopLevel(s, sep)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// indexTopLevel returns the index of the first c in s outside quotes and
+// parentheses, or -1.
+func indexTopLevel(s string, c byte) int {
+	inQuote := byte(0)
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuote != 0:
+			if s[i] == inQuote {
+				inQuote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			inQuote = s[i]
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		case s[i] == c && depth == 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// isIdent reports whether s is a plain identifier such as a function name.
+func isIdent(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isAlphaNum(s[i]) && s[i] != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// compileIterable compiles the collection of a range tag: an operand or an
+// a..b span of integers.
+func compileIterable(expr string) (accessor, error) {
+	i := indexSpan(expr)
+	if i < 0 {
+		return compileOperand(expr)
+	}
+	from, err := compileOperand(expr[:i])
+	if err != nil {
+		return nil, err
+	}
+	to, err := compileOperand(expr[i+2:])
+	if err != nil {
+		return nil, err
+	}
+	return spanAcc{from: from, to: to}, nil
+}
+
+// indexSpan returns the index of the first unquoted "..", or -1.
+func indexSpan(s string) int {
+	for off := 0; off < len(s); {
+		i := indexUnquoted(s[off:], '.')
+		if i < 0 {
+			return -1
+		}
+		i += off
+		if i+1 < len(s) && s[i+1] == '.' {
+			return i
+		}
+		off = i + 1
+	}
+	return -1
+}
+
+// intSpan is the integers from..to, both included, that a range iterates.
+type intSpan struct{ from, to int64 }
+
+// spanAcc yields the intSpan of an a..b range, as in range i in 1..pages.
+type spanAcc struct{ from, to accessor }
+
+func (a spanAcc) get(ctx *renderCtx) (any, bool) {
+	var bounds [2]int64
+	for i, acc := range [2]accessor{a.from, a.to} {
+		v, _ := acc.get(ctx)
+		n, ok := intValue(v)
+		if !ok {
+			if ctx.err == nil {
+				ctx.err = fmt.Errorf("range: bound %v of a..b is not an integer", v)
+			}
+			return nil, false
+		}
+		bounds[i] = n
+	}
+	return intSpan{from: bounds[0], to: bounds[1]}, true
+}
+
+// intValue returns v as an integer when it is one, including whole floats
+// such as numbers decoded from JSON.
+func intValue(v any) (int64, bool) {
+	i, f, isInt, ok := numberValue(v)
+	switch {
+	case !ok:
+		return 0, false
+	case isInt:
+		return i, true
+	case f == math.Trunc(f) && math.Abs(f) < 1<<63:
+		return int64(f), true
+	}
+	return 0, false
+}
+
+// pipeAcc runs an operand through filters, as in {{ if items | length }}.
+type pipeAcc struct {
+	acc   accessor
+	pipes []pipe
+}
+
+func (a pipeAcc) get(ctx *renderCtx) (any, bool) {
+	v, ok := a.acc.get(ctx)
+	if !ok {
+		// Missing values flow through filters as "", like in output tags
+		v = ""
+	}
+	sb := stringBuilderPool.Get().(*strings.Builder)
+	defer stringBuilderPool.Put(sb)
+	for _, p := range a.pipes {
+		sb.Reset()
+		var err error
+		if v, err = p.apply(ctx, v, sb); err != nil {
+			if ctx.err == nil {
+				ctx.err = err
+			}
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// parseLiteral recognizes quoted strings, integers, floats and booleans.
+func parseLiteral(s string) (any, bool) {
+	if s == "" {
+		return nil, false
+	}
+	switch s {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	if c := s[0]; c == '"' || c == '\'' {
+		if len(s) >= 2 && s[len(s)-1] == c {
+			return s[1 : len(s)-1], true
+		}
+		return nil, false
+	}
+	if c := s[0]; !isDigit(c) && c != '-' && c != '+' && c != '.' {
+		return nil, false
+	}
+	if i, err := strconv.Atoi(s); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// indexCompareOp finds the first comparison operator outside of quotes and
+// parentheses, returning its byte offset and spelling or -1.
+func indexCompareOp(s string) (int, string) {
+	inQuote := byte(0)
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inQuote != 0 {
+			if c == inQuote {
+				inQuote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			inQuote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '=', '!', '<', '>':
+			if depth > 0 {
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '=' {
+				return i, s[i : i+2]
+			}
+			if c == '<' || c == '>' {
+				return i, s[i : i+1]
+			}
+		}
+	}
+	return -1, ""
+}
+
+// splitTopLevelWord splits s around a keyword operator such as "and" that
+// appears outside of quotes and parentheses, delimited by spaces or parens.
+func splitTopLevelWord(s, word string) []string {
+	var parts []string
+	inQuote := byte(0)
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inQuote != 0 {
+			if c == inQuote {
+				inQuote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			inQuote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		default:
+			if depth != 0 || i == 0 || !strings.HasPrefix(s[i:], word) {
+				continue
+			}
+			end := i + len(word)
+			if end >= len(s) {
+				continue
+			}
+			before, after := s[i-1], s[end]
+			if (before == ' ' || before == ')') && (after == ' ' || after == '(') {
+				parts = append(parts, s[start:i])
+				start = end
+				i = end - 1
+			}
+		}
+	}
+	if parts == nil {
+		return nil
+	}
+	return append(parts, s[start:])
+}
+
+// unwrapParens strips one pair of parentheses enclosing the whole expression.
+func unwrapParens(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return "", false
+	}
+	inQuote := byte(0)
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inQuote != 0 {
+			if c == inQuote {
+				inQuote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			inQuote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i != len(s)-1 {
+				return "", false
+			}
+		}
+	}
+	return s[1 : len(s)-1], depth == 0
+}
+
+// ----------------------------- Value comparison -----------------------------
+
+// numberValue converts numeric kinds to either an int64 or a float64.
+func numberValue(v any) (i int64, f float64, isInt bool, ok bool) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), float64(x), true, true
+	case int64:
+		return x, float64(x), true, true
+	case float64:
+		return 0, x, false, true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), float64(rv.Int()), true, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u <= 1<<63-1 {
+			return int64(u), float64(u), true, true
+		}
+		return 0, float64(u), false, true
+	case reflect.Float32, reflect.Float64:
+		return 0, rv.Float(), false, true
+	}
+	return 0, 0, false, false
+}
+
+// numericString parses a string operand so it can be compared against a number.
+func numericString(v any) (any, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+func compareNumbers(a, b any) (int, bool) {
+	ai, af, aInt, aok := numberValue(a)
+	bi, bf, bInt, bok := numberValue(b)
+	if !aok || !bok {
+		return 0, false
+	}
+	if aInt && bInt {
+		switch {
+		case ai < bi:
+			return -1, true
+		case ai > bi:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch {
+	case af < bf:
+		return -1, true
+	case af > bf:
+		return 1, true
+	}
+	return 0, true
+}
+
+// compareValues orders numbers numerically and strings lexically. A number and
+// a numeric string compare as numbers. Other combinations are not ordered.
+func compareValues(a, b any) (int, bool) {
+	if c, ok := compareNumbers(a, b); ok {
+		return c, true
+	}
+	_, _, _, aNum := numberValue(a)
+	_, _, _, bNum := numberValue(b)
+	if aNum {
+		if n, ok := numericString(b); ok {
+			return compareNumbers(a, n)
+		}
+		return 0, false
+	}
+	if bNum {
+		if n, ok := numericString(a); ok {
+			return compareNumbers(n, b)
+		}
+		return 0, false
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(as, bs), true
+	}
+	return 0, false
+}
+
+// equalValues reports whether two values are equal, comparing numbers by
+// value regardless of their Go type and falling back to string forms.
+func equalValues(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	if ab, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		return ok && ab == bb
+	}
+	if _, ok := b.(bool); ok {
+		return false
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
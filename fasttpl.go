@@ -1,18 +1,64 @@
 package fasttpl
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
+	"maps"
+	"math"
+	"net/url"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Filters map[string]func(string, []string) (string, error)
 
+// TypedFilters receive the original value instead of its string form, so they
+// can work with numbers, times, slices and structs. When a typed and a string
+// filter share a name, the typed filter wins.
+type TypedFilters map[string]func(any, []string) (any, error)
+
+// WriterFilters write their output straight to the template's writer instead
+// of returning a string, which saves building large results such as encoded
+// blobs in memory. Used last in a pipeline they write to the output, escaped
+// unless the pipeline ends in safe; anywhere else their output is collected
+// into a string for the next filter. Typed filters win over writer filters,
+// and writer filters over string filters, when they share a name.
+type WriterFilters map[string]func(w io.Writer, in string, args []string) error
+
+// Funcs are functions templates can call with arguments, as in
+// {{ asset("css/main.css") }}. Each receives the evaluated arguments, with
+// missing values passed as nil.
+type Funcs map[string]func(args ...any) (any, error)
+
+// MarkdownRenderer converts Markdown to HTML for the markdown filter, so
+// that the package itself needs no Markdown dependency. See WithMarkdown.
+type MarkdownRenderer interface {
+	RenderMarkdown(w io.Writer, source string) error
+}
+
+// MarkdownFunc adapts an ordinary function to a MarkdownRenderer.
+type MarkdownFunc func(w io.Writer, source string) error
+
+// RenderMarkdown calls f(w, source).
+func (f MarkdownFunc) RenderMarkdown(w io.Writer, source string) error { return f(w, source) }
+
+// SafeString marks a value that is already safe to emit as-is. When a
+// pipeline ends in a SafeString the output is not HTML-escaped.
+type SafeString string
+
 // Global reload manager instance
 var globalReloadManager = NewReloadManager(1 * time.Second)
 
@@ -48,34 +94,191 @@ func GetWatchedTemplate(filename string, opts ...Option) (*Template, error) {
 
 // Compile parses and compiles a template string into a high-performance renderer.
 func Compile(src string, opts ...Option) (*Template, error) {
-	co := compileOptions{
-		filters:    DefaultFilters(),
-		leftDelim:  "{{",
-		rightDelim: "}}",
+	co := newCompileOptions(opts)
+	p := newParser(src, co)
+	nodes, err := p.parse()
+	if err != nil {
+		return nil, err
 	}
-	for _, o := range opts {
-		o(&co)
+	if co.markdown != nil {
+		co.writers = maps.Clone(co.writers)
+		if co.writers == nil {
+			co.writers = make(WriterFilters)
+		}
+		co.writers["markdown"] = markdownFilter(co.markdown)
 	}
-	p := parser{
+	co.typed = co.typedFilters()
+	t := &Template{
+		root:         sequence(nodes),
+		parts:        newPartialSet(make(map[string]*Template)),
+		filt:         co.filters,
+		typed:        co.typed,
+		writers:      co.writers,
+		funcs:        co.funcs,
+		escaper:      co.escaper,
+		missing:      co.missing,
+		fieldCache:   newFieldCache(),
+		fieldTag:     co.fieldTag,
+		defaultFilt:  !co.filtersSet,
+		defaultTyped: !co.typedSet,
+		strict:       co.strict,
+		maxDepth:     co.maxDepth,
+		timeout:      co.timeout,
+		layout:       p.layout,
+		blocks:       p.blocks,
+	}
+	t.root = t.foldNode(t.root)
+	return t, nil
+}
+
+// newParser returns a parser for src using the delimiters and filter checks
+// that co selects.
+func newParser(src string, co compileOptions) *parser {
+	p := &parser{
 		src:        src,
 		leftDelim:  co.leftDelim,
 		rightDelim: co.rightDelim,
 	}
-	nodes, err := p.parse()
+	if co.strictFilters {
+		p.knownFilter = func(name string) bool {
+			return co.filters[name] != nil || co.typed[name] != nil || co.writers[name] != nil ||
+				name == "markdown" && co.markdown != nil
+		}
+	}
+	return p
+}
+
+// MustCompile is like Compile but panics if the template cannot be compiled.
+// It simplifies initializing package-level template variables.
+func MustCompile(src string, opts ...Option) *Template {
+	t, err := Compile(src, opts...)
 	if err != nil {
-		return nil, err
+		panic("fasttpl: MustCompile: " + err.Error())
 	}
-	root := sequence(nodes)
-	return &Template{
-		root:       root,
-		parts:      make(map[string]*Template),
-		filt:       co.filters,
-		fieldCache: newFieldCache(),
-	}, nil
+	return t
+}
+
+// defaultFilters and defaultTypedFilters are the filters of templates
+// compiled without WithFilters or WithTypedFilters, built once and shared,
+// since nothing modifies a template's filter sets.
+var (
+	defaultFilters      = sync.OnceValue(DefaultFilters)
+	defaultTypedFilters = sync.OnceValue(DefaultTypedFilters)
+)
+
+func newCompileOptions(opts []Option) compileOptions {
+	co := compileOptions{
+		filters:    defaultFilters(),
+		typed:      defaultTypedFilters(),
+		maxDepth:   DefaultMaxIncludeDepth,
+		leftDelim:  "{{",
+		rightDelim: "}}",
+		partials:   &defaultPartials,
+	}
+	for _, o := range opts {
+		o(&co)
+	}
+	return co
+}
+
+// typedFilters returns the typed filters of templates compiled with co: the
+// ones the options set, or else the defaults for the field tag.
+func (co compileOptions) typedFilters() TypedFilters {
+	if co.fieldTag != "" && !co.typedSet {
+		return TaggedTypedFilters(co.fieldTag)
+	}
+	return co.typed
 }
 
 // WithFilters allows registering/overriding filters.
-func WithFilters(f Filters) Option { return func(co *compileOptions) { co.filters = f } }
+func WithFilters(f Filters) Option {
+	return func(co *compileOptions) { co.filters, co.filtersSet, co.funcOpts = f, true, true }
+}
+
+// WithTypedFilters allows registering/overriding typed filters.
+func WithTypedFilters(f TypedFilters) Option {
+	return func(co *compileOptions) { co.typed, co.typedSet, co.funcOpts = f, true, true }
+}
+
+// WithWriterFilters allows registering/overriding writer filters.
+func WithWriterFilters(f WriterFilters) Option {
+	return func(co *compileOptions) { co.writers, co.funcOpts = f, true }
+}
+
+// WithFuncs registers functions that templates can call, as in
+// {{ t("greeting", user.name) }}.
+func WithFuncs(f Funcs) Option {
+	return func(co *compileOptions) { co.funcs, co.funcOpts = f, true }
+}
+
+// WithEscaper replaces the HTML escaper applied to output that isn't raw or
+// safe, such as one that also escapes '/' or, for trusted pipelines, one
+// that returns its input unchanged. A nil escaper restores the default.
+func WithEscaper(f func(string) string) Option {
+	return func(co *compileOptions) { co.escaper, co.funcOpts = f, co.funcOpts || f != nil }
+}
+
+// WithMarkdown sets the renderer behind the markdown filter, as in
+// {{ post.body | markdown | safe }}. Without one the filter fails. The
+// renderer produces HTML, so its output should end in safe to avoid
+// escaping it a second time.
+func WithMarkdown(r MarkdownRenderer) Option {
+	return func(co *compileOptions) { co.markdown, co.funcOpts = r, co.funcOpts || r != nil }
+}
+
+// WithMissingHandler sets a fallback for print tags whose path is missing,
+// such as a placeholder image for {{ user.avatar }}. The handler receives
+// the path as written and returns the text to use in its place, which goes
+// through the tag's filters and escaping like a found value would; returning
+// false renders nothing, as without a handler. Tags printing other
+// expressions aren't affected, and in strict mode a missing path is an
+// error before the handler is consulted.
+func WithMissingHandler(f func(path string) (string, bool)) Option {
+	return func(co *compileOptions) { co.missing, co.funcOpts = f, co.funcOpts || f != nil }
+}
+
+// WithCacheKey names the functions passed in the other options, such as
+// filters and escapers, for CompileCached and CompileCache.Compile, which
+// can't tell functions apart and otherwise compile such templates afresh
+// every time. Calls with the same key and source and otherwise equal options
+// share a template, so each distinct set of functions needs its own key.
+// Compile ignores it.
+func WithCacheKey(key string) Option { return func(co *compileOptions) { co.cacheKey = key } }
+
+// WithFieldTag resolves struct fields by the given struct tag (e.g. "json")
+// before falling back to matching Go field names, in paths and in the keys
+// of the sortby and where filters.
+func WithFieldTag(tag string) Option { return func(co *compileOptions) { co.fieldTag = tag } }
+
+// WithStrictVars makes rendering fail with an error naming the path when a
+// referenced variable is missing, instead of rendering nothing.
+func WithStrictVars(strict bool) Option { return func(co *compileOptions) { co.strict = strict } }
+
+// WithStrictFilters makes Compile fail with a ParseError positioned at the
+// first filter that isn't registered, catching typos in rarely rendered
+// branches. Filters passed to RenderWith aren't known at compile time, so
+// templates relying on them should leave this off.
+func WithStrictFilters(strict bool) Option {
+	return func(co *compileOptions) { co.strictFilters = strict }
+}
+
+// ErrRenderTimeout is returned by renders that run past the duration set with
+// WithRenderTimeout.
+var ErrRenderTimeout = errors.New("fasttpl: render timed out")
+
+// WithRenderTimeout aborts renders that take longer than d with
+// ErrRenderTimeout, as a safety valve against pathological data such as a
+// huge list. Like context cancellation it is checked before each loop
+// iteration and each node of a sequence, so a single slow filter or method
+// call still runs to completion. Zero, the default, means no timeout.
+func WithRenderTimeout(d time.Duration) Option { return func(co *compileOptions) { co.timeout = d } }
+
+// DefaultMaxIncludeDepth bounds include nesting unless WithMaxIncludeDepth is used.
+const DefaultMaxIncludeDepth = 100
+
+// WithMaxIncludeDepth sets how deeply includes may nest, which bounds
+// recursive partials such as comment trees.
+func WithMaxIncludeDepth(n int) Option { return func(co *compileOptions) { co.maxDepth = n } }
 
 // WithDelims allows setting custom delimiters.
 func WithDelims(left, right string) Option {
@@ -85,11 +288,40 @@ func WithDelims(left, right string) Option {
 	}
 }
 
+// WithPatterns limits the files that ReloadManager.WatchDirectory and the
+// Engine load as templates to those whose names match one of the
+// filepath.Match patterns, such as "*.gohtml". Without patterns the reload
+// manager loads .html and .tpl files, and the Engine files with its extension.
+func WithPatterns(patterns ...string) Option {
+	return func(co *compileOptions) { co.patterns = append(co.patterns, patterns...) }
+}
+
+// WithPartials sets how files compiled with CompileFile, CompileFS or the
+// Engine find the partials next to them. The default is an underscore
+// prefix, so _header.html becomes the partial "header".
+func WithPartials(conv PartialConvention) Option {
+	return func(co *compileOptions) { co.partials = &conv }
+}
+
+// WithPartialDiscovery turns partial auto-discovery off, for templates whose
+// partials are all registered with RegisterPartial, or back on.
+func WithPartialDiscovery(enabled bool) Option {
+	return func(co *compileOptions) {
+		switch {
+		case !enabled:
+			co.partials = nil
+		case co.partials == nil:
+			co.partials = &defaultPartials
+		}
+	}
+}
+
 // ----------------------------- Template Engine -----------------------------
 
 type EngineOptions struct {
 	defaultLayout  string
 	reloadInterval time.Duration
+	compileOpts    []Option
 }
 
 type EngineOption func(*EngineOptions)
@@ -102,84 +334,225 @@ func WithReloadInterval(interval time.Duration) EngineOption {
 	return func(eo *EngineOptions) { eo.reloadInterval = interval }
 }
 
+// WithCompileOptions sets the options, such as WithDelims or WithFilters,
+// that the engine compiles and recompiles its templates with.
+func WithCompileOptions(opts ...Option) EngineOption {
+	return func(eo *EngineOptions) { eo.compileOpts = append(eo.compileOpts, opts...) }
+}
+
 type Engine struct {
 	templates     map[string]*Template
 	defaultLayout string
 	reloadManager *ReloadManager
 	dir           string
 	ext           string
+	fs            templateFS
+	opts          []Option      // from WithCompileOptions
+	patterns      []string      // from WithPatterns among opts
+	filters       Filters       // added with AddFilter
+	typed         TypedFilters  // added with AddTypedFilter
+	writers       WriterFilters // added with AddWriterFilter
 	mu            sync.RWMutex
 }
 
-// Load loads all templates from the directory
+// Load loads all templates from the directory. It stops at the first
+// template that fails to compile, leaving the loaded templates as they were;
+// CompileAll reports every failure instead.
 func (e *Engine) Load() error {
-	entries, err := os.ReadDir(e.dir)
+	if errs := e.load(true); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// CompileAll compiles every template in the directory and the partials they
+// discover, and returns an error for each file that fails, so a CI check
+// can catch broken templates before they ship. Templates that compile are
+// loaded as by Load; those that don't keep their previous version. Partials
+// that fail are reported once, however many templates discover them.
+func (e *Engine) CompileAll() []error {
+	return e.load(false)
+}
+
+// load compiles the templates in the directory and stores those that
+// compile. With failFast it returns at the first failure and stores none.
+func (e *Engine) load(failFast bool) []error {
+	if err := checkPatterns(e.patterns); err != nil {
+		return []error{err}
+	}
+	entries, err := fs.ReadDir(e.fs.fsys, e.dir)
 	if err != nil {
-		return fmt.Errorf("reading directory %q: %w", e.dir, err)
+		return []error{fmt.Errorf("reading directory %q: %w", e.dir, err)}
 	}
 
+	opts := e.compileOptions()
+	templates := make(map[string]*Template)
+	var errs []error
+	reported := make(map[string]bool)
+	report := func(err error) {
+		// A file fails the same way wherever it is compiled
+		if msg := err.Error(); !reported[msg] {
+			reported[msg] = true
+			errs = append(errs, err)
+		}
+	}
 	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), e.ext) {
+		if entry.IsDir() || !e.selects(entry.Name()) {
 			continue
 		}
-
-		name := strings.TrimSuffix(entry.Name(), e.ext)
-		path := filepath.Join(e.dir, entry.Name())
-		content, err := os.ReadFile(path)
+		tmpl, partialErrs, err := e.compile(entry.Name(), opts)
 		if err != nil {
-			return fmt.Errorf("reading template %q: %w", path, err)
+			if failFast {
+				return []error{err}
+			}
+			report(err)
+			continue
 		}
-
-		tmpl, err := Compile(string(content))
-		if err != nil {
-			return fmt.Errorf("compiling template %q: %w", path, err)
+		for _, err := range partialErrs {
+			report(err)
 		}
+		templates[e.templateName(entry.Name())] = tmpl
+	}
 
-		// Auto-discover and register partials in the same directory
-		base := entry.Name()
-		baseNoExt := strings.TrimSuffix(base, e.ext)
+	e.mu.Lock()
+	maps.Copy(e.templates, templates)
+	e.mu.Unlock()
+	if failFast {
+		// Broken partials were skipped, as they always have been
+		return nil
+	}
+	return errs
+}
 
-		// Look for partial files (e.g., _header.html, _footer.html)
-		partialEntries, err := os.ReadDir(e.dir)
-		if err == nil { // Don't fail if we can't read directory
-			for _, partialEntry := range partialEntries {
-				partialName := partialEntry.Name()
-				if partialEntry.IsDir() || partialName == base {
-					continue
-				}
+// selects reports whether the file called base is one of the engine's templates.
+func (e *Engine) selects(base string) bool {
+	return selectFile(e.patterns, base, func(name string) bool {
+		return strings.HasSuffix(name, e.ext)
+	})
+}
 
-				// Register files that start with underscore as partials
-				if strings.HasPrefix(partialName, "_") {
-					partialPath := filepath.Join(e.dir, partialName)
-					partialBaseName := strings.TrimPrefix(partialName, "_")
-					partialBaseName = strings.TrimSuffix(partialBaseName, e.ext)
-
-					// Skip if partial name matches the main template's base name (to avoid conflicts)
-					if partialBaseName == baseNoExt {
-						continue
-					}
-
-					// Compile partial without include discovery to avoid infinite recursion
-					partialContent, err := os.ReadFile(partialPath)
-					if err != nil {
-						// Skip failed partials but don't fail the main compilation
-						continue
-					}
-
-					partial, err := Compile(string(partialContent))
-					if err != nil {
-						// Skip failed partials but don't fail the main compilation
-						continue
-					}
-					tmpl.RegisterPartial(partialBaseName, partial)
-				}
-			}
+// templateName names the template in the file called base after the file,
+// without the engine's extension or, for files selected by a pattern with
+// another extension, without their own.
+func (e *Engine) templateName(base string) string {
+	if strings.HasSuffix(base, e.ext) {
+		return strings.TrimSuffix(base, e.ext)
+	}
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// compile reads and compiles the template file base in the engine's
+// directory, registering the partials found next to it. The errors of
+// partials that were skipped are returned separately.
+func (e *Engine) compile(base string, opts []Option) (*Template, []error, error) {
+	path := e.fs.join(e.dir, base)
+	content, err := fs.ReadFile(e.fs.fsys, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading template %q: %w", path, err)
+	}
+
+	tmpl, err := Compile(string(content), opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compiling template %q: %w", path, err)
+	}
+	tmpl.source = path
+
+	// Auto-discover and register partials in the same directory
+	partialErrs := e.fs.discoverPartials(tmpl, e.dir, base, e.ext, opts...)
+	return tmpl, partialErrs, nil
+}
+
+// reload recompiles a changed template file with the engine's current options.
+func (e *Engine) reload(filename string) {
+	base := filepath.Base(filename)
+	if !e.selects(base) {
+		return
+	}
+	tmpl, partialErrs, err := e.compile(base, e.compileOptions())
+	if err != nil || len(partialErrs) > 0 {
+		// Keep serving the previous version rather than one missing partials
+		return
+	}
+	e.mu.Lock()
+	e.templates[e.templateName(base)] = tmpl
+	e.mu.Unlock()
+}
+
+// compileOptions returns the options the engine compiles templates with,
+// ending with addedFilters so that every compile, the reload manager's
+// included, sees the filters added so far.
+func (e *Engine) compileOptions() []Option {
+	return append(slices.Clip(e.opts), e.addedFilters)
+}
+
+// addedFilters layers the filters added with AddFilter, AddTypedFilter and
+// AddWriterFilter over the ones the earlier options select, so that
+// WithStrictFilters checks templates against the merged sets.
+func (e *Engine) addedFilters(co *compileOptions) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if len(e.filters) > 0 {
+		filters := maps.Clone(co.filters)
+		maps.Copy(filters, e.filters)
+		WithFilters(filters)(co)
+	}
+	if len(e.typed) > 0 {
+		typed := maps.Clone(co.typedFilters())
+		maps.Copy(typed, e.typed)
+		WithTypedFilters(typed)(co)
+	}
+	if len(e.writers) > 0 {
+		writers := maps.Clone(co.writers)
+		if writers == nil {
+			writers = make(WriterFilters)
 		}
+		maps.Copy(writers, e.writers)
+		WithWriterFilters(writers)(co)
+	}
+}
 
-		e.templates[name] = tmpl
+// AddFilter registers a filter for every template of the engine. Loaded
+// templates are recompiled so they can use it right away, and templates
+// reloaded later keep it.
+func (e *Engine) AddFilter(name string, fn func(string, []string) (string, error)) error {
+	e.mu.Lock()
+	if e.filters == nil {
+		e.filters = make(Filters)
 	}
+	e.filters[name] = fn
+	e.mu.Unlock()
+	return e.Load()
+}
 
-	return nil
+// AddTypedFilter is like AddFilter for a typed filter.
+func (e *Engine) AddTypedFilter(name string, fn func(any, []string) (any, error)) error {
+	e.mu.Lock()
+	if e.typed == nil {
+		e.typed = make(TypedFilters)
+	}
+	e.typed[name] = fn
+	e.mu.Unlock()
+	return e.Load()
+}
+
+// AddWriterFilter is like AddFilter for a writer filter.
+func (e *Engine) AddWriterFilter(name string, fn func(io.Writer, string, []string) error) error {
+	e.mu.Lock()
+	if e.writers == nil {
+		e.writers = make(WriterFilters)
+	}
+	e.writers[name] = fn
+	e.mu.Unlock()
+	return e.Load()
+}
+
+// Lookup returns the loaded template with the given name, which is its file
+// name without the extension.
+func (e *Engine) Lookup(name string) (*Template, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	t, ok := e.templates[name]
+	return t, ok
 }
 
 // Stop stops the template reloading
@@ -191,6 +564,12 @@ func (e *Engine) Stop() {
 
 // Render renders the specified template with optional layout
 func (e *Engine) Render(w io.Writer, tmplName string, data any, layout ...string) error {
+	return e.RenderContext(context.Background(), w, tmplName, data, layout...)
+}
+
+// RenderContext is like Render but stops once ctx is canceled, see
+// Template.RenderContext.
+func (e *Engine) RenderContext(ctx context.Context, w io.Writer, tmplName string, data any, layout ...string) error {
 	e.mu.RLock()
 	tmpl, ok := e.templates[tmplName]
 	e.mu.RUnlock()
@@ -200,12 +579,15 @@ func (e *Engine) Render(w io.Writer, tmplName string, data any, layout ...string
 	}
 
 	var layoutTmpl *Template
-	var layoutName string
 
+	// An explicit layout wins over the template's own layout tag, which
+	// wins over the engine's default
+	layoutName := e.defaultLayout
+	if tmpl.layout != nil {
+		layoutName = *tmpl.layout
+	}
 	if len(layout) > 0 {
 		layoutName = layout[0]
-	} else {
-		layoutName = e.defaultLayout
 	}
 
 	if layoutName != "" {
@@ -220,22 +602,29 @@ func (e *Engine) Render(w io.Writer, tmplName string, data any, layout ...string
 
 	if layoutTmpl != nil {
 		// Clone the layout to avoid modifying the original
-		layoutCopy := &Template{
-			root:       layoutTmpl.root,
-			parts:      make(map[string]*Template),
-			filt:       layoutTmpl.filt,
-			fieldCache: layoutTmpl.fieldCache,
-		}
-		for k, v := range layoutTmpl.parts {
-			layoutCopy.parts[k] = v
-		}
-		layoutCopy.RegisterPartial("content", tmpl)
-		return layoutCopy.Render(w, data)
+		layoutCopy := layoutTmpl.Clone()
+		layoutCopy.RegisterPartial(contentPartial, tmpl)
+		return layoutCopy.RenderContext(ctx, w, data)
 	} else {
-		return tmpl.Render(w, data)
+		return tmpl.RenderContext(ctx, w, data)
 	}
 }
 
+// RenderBuffered is like Render but writes nothing to w unless rendering
+// succeeds, see Template.RenderBuffered.
+func (e *Engine) RenderBuffered(w io.Writer, tmplName string, data any, layout ...string) error {
+	return renderBuffered(w, func(buf io.Writer) error {
+		return e.Render(buf, tmplName, data, layout...)
+	})
+}
+
+// RenderWithLayout renders the named template inside the given layout, which
+// overrides both the default layout and the template's layout tag. An empty
+// layout renders the template on its own.
+func (e *Engine) RenderWithLayout(w io.Writer, layout, tmplName string, data any) error {
+	return e.RenderContext(context.Background(), w, tmplName, data, layout)
+}
+
 // RenderString renders the specified template with optional layout and returns a string
 func (e *Engine) RenderString(tmplName string, data any, layout ...string) (string, error) {
 	sb := stringBuilderPool.Get().(*strings.Builder)
@@ -257,16 +646,81 @@ func sequence(nodes []node) node {
 // ----------------------------- Filters --------------------------------------
 
 type pipe struct {
-	name string
-	args []string
+	name    string
+	args    []string
+	argAccs []accessor // per argument, for $-prefixed ones, read as locals
+	argData []accessor // the same arguments read from the data
+	pos     srcPos     // position of the tag, for error messages
 }
 
-func (p pipe) apply(ctx *renderCtx, in string) (string, error) {
+// apply runs the filter on in. Typed filters see the value as-is; string
+// filters see it stringified, using sb as scratch space.
+func (p pipe) apply(ctx *renderCtx, in any, sb *strings.Builder) (any, error) {
+	args := p.args
+	if p.argAccs != nil {
+		args = p.resolveArgs(ctx, sb)
+	}
+	if f := ctx.extraFilters[p.name]; f != nil {
+		v, err := f(toStringFast(in, sb), args)
+		return v, p.wrapErr(err)
+	}
+	if tf := ctx.typedFilters[p.name]; tf != nil {
+		v, err := tf(in, args)
+		return v, p.wrapErr(err)
+	}
+	if wf := ctx.writerFilters[p.name]; wf != nil {
+		s := toStringFast(in, sb)
+		sb.Reset()
+		err := wf(sb, s, args)
+		return sb.String(), p.wrapErr(err)
+	}
 	f := ctx.filters[p.name]
 	if f == nil {
-		return "", fmt.Errorf("unknown filter %q", p.name)
+		return "", fmt.Errorf("unknown filter %q%s", p.name, p.pos.at())
 	}
-	return f(in, p.args)
+	v, err := f(toStringFast(in, sb), args)
+	return v, p.wrapErr(err)
+}
+
+// wrapErr names the filter and where it is used in an error it returned.
+func (p pipe) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("filter %q%s: %w", p.name, p.pos.at(), err)
+}
+
+// writer returns the writer filter the pipe runs, if any.
+func (p pipe) writer(ctx *renderCtx) func(io.Writer, string, []string) error {
+	if ctx.extraFilters[p.name] != nil || ctx.typedFilters[p.name] != nil {
+		return nil
+	}
+	return ctx.writerFilters[p.name]
+}
+
+// resolveArgs returns the filter arguments with those naming a variable,
+// such as $sep, replaced by its value in string form: the local of that name
+// when one is bound, and the data's otherwise. A variable that doesn't
+// resolve is passed as "".
+func (p pipe) resolveArgs(ctx *renderCtx, sb *strings.Builder) []string {
+	args := slices.Clone(p.args)
+	// A missing variable isn't an error here, even in strict mode
+	strict := ctx.strict
+	ctx.strict = false
+	for i, acc := range p.argAccs {
+		if acc == nil {
+			continue
+		}
+		if _, bound := ctx.locals[acc.(boundAcc).steps[0].(localStep).name]; !bound {
+			acc = p.argData[i]
+		}
+		args[i] = ""
+		if v, ok := acc.get(ctx); ok && v != nil {
+			args[i] = toStringFast(v, sb)
+		}
+	}
+	ctx.strict = strict
+	return args
 }
 
 func DefaultFilters() Filters {
@@ -274,6 +728,14 @@ func DefaultFilters() Filters {
 		"upper": func(s string, _ []string) (string, error) { return strings.ToUpper(s), nil },
 		"lower": func(s string, _ []string) (string, error) { return strings.ToLower(s), nil },
 		"trim":  func(s string, _ []string) (string, error) { return fastTrim(s), nil },
+		"capitalize": func(s string, _ []string) (string, error) {
+			r, size := utf8.DecodeRuneInString(s)
+			if size == 0 || unicode.IsTitle(r) {
+				return s, nil
+			}
+			return string(unicode.ToTitle(r)) + s[size:], nil
+		},
+		"title": func(s string, _ []string) (string, error) { return titleCase(s), nil },
 		"truncate": func(s string, args []string) (string, error) {
 			if len(args) == 0 {
 				return s, nil
@@ -282,23 +744,518 @@ func DefaultFilters() Filters {
 			if err != nil || n < 0 {
 				return s, nil
 			}
-			if len(s) <= n {
-				return s, nil
+			suffix := ""
+			if len(args) > 1 {
+				suffix = args[1]
 			}
-			return s[:n], nil
+			return truncateRunes(s, n, suffix), nil
 		},
 		"replace": func(s string, args []string) (string, error) {
-			if len(args) < 2 {
+			// An empty search string would insert at every position, so it is a no-op
+			if len(args) < 2 || args[0] == "" {
 				return s, nil
 			}
-			return strings.ReplaceAll(s, args[0], args[1]), nil
+			n := -1
+			if len(args) > 2 {
+				var err error
+				if n, err = strconv.Atoi(args[2]); err != nil {
+					return "", fmt.Errorf("replace: invalid count %q", args[2])
+				}
+			}
+			return strings.Replace(s, args[0], args[1], n), nil
 		},
 		"length": func(s string, _ []string) (string, error) {
-			return strconv.Itoa(len(s)), nil
+			// Counts runes, like the typed length that normally takes precedence
+			return strconv.Itoa(utf8.RuneCountInString(s)), nil
+		},
+		"urlescape": func(s string, _ []string) (string, error) { return url.QueryEscape(s), nil },
+		"jsescape":  func(s string, _ []string) (string, error) { return jsEscape(s), nil },
+		"cssescape": func(s string, _ []string) (string, error) { return cssEscape(s), nil },
+		"default": func(s string, args []string) (string, error) {
+			if s == "" && len(args) > 0 {
+				return args[0], nil
+			}
+			return s, nil
+		},
+		"markdown": func(string, []string) (string, error) {
+			return "", errors.New("no markdown renderer configured, see WithMarkdown")
+		},
+	}
+}
+
+// markdownFilter is the writer filter that stands in for the default
+// markdown filter when a renderer is set with WithMarkdown.
+func markdownFilter(r MarkdownRenderer) func(io.Writer, string, []string) error {
+	return func(w io.Writer, in string, _ []string) error { return r.RenderMarkdown(w, in) }
+}
+
+// truncateRunes shortens s to at most n runes. When it has to cut, suffix
+// (such as "…") replaces the end of the kept text so the result stays within
+// n runes, unless the suffix alone is longer than n.
+func truncateRunes(s string, n int, suffix string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	keep := n
+	if sn := utf8.RuneCountInString(suffix); sn <= n {
+		keep -= sn
+	} else {
+		suffix = ""
+	}
+	i := 0
+	for range keep {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return s[:i] + suffix
+}
+
+// titleCase converts the first letter of each whitespace-separated word in s
+// to title case, leaving the rest of the word unchanged. Leading punctuation
+// is skipped, so "(note)" becomes "(Note)", but a word starting with a digit
+// keeps its letters as they are.
+func titleCase(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	start := true
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			start = true
+		case start && unicode.IsLetter(r):
+			r = unicode.ToTitle(r)
+			start = false
+		case unicode.IsDigit(r):
+			start = false
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func DefaultTypedFilters() TypedFilters { return TaggedTypedFilters("") }
+
+// TaggedTypedFilters returns the default typed filters with sortby and where
+// resolving struct fields by tag first, as WithFieldTag does for paths.
+// Templates compiled WithFieldTag get them unless WithTypedFilters replaces
+// the defaults, so extend these rather than DefaultTypedFilters then.
+func TaggedTypedFilters(tag string) TypedFilters {
+	return TypedFilters{
+		"round": func(v any, args []string) (any, error) {
+			places := 0
+			if len(args) > 0 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("round: invalid precision %q", args[0])
+				}
+				places = n
+			}
+			if n, ok := numericString(v); ok {
+				v = n
+			}
+			_, f, isInt, ok := numberValue(v)
+			if !ok || isInt {
+				return v, nil
+			}
+			p := math.Pow10(places)
+			return math.Round(f*p) / p, nil
+		},
+		"json": func(v any, args []string) (any, error) {
+			var b []byte
+			var err error
+			if len(args) > 0 && args[0] == "indent" {
+				b, err = json.MarshalIndent(v, "", "  ")
+			} else {
+				b, err = json.Marshal(v)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("json: %w", err)
+			}
+			// The output is escaped like any other, as quotes would end an
+			// attribute. encoding/json escapes <, > and &, so json | safe is
+			// fine inside <script>, but only there
+			return string(b), nil
 		},
+		"number":   number,
+		"abs":      absFilter,
+		"min":      minFilter,
+		"max":      maxFilter,
+		"clamp":    clampFilter,
+		"join":     join,
+		"length":   length,
+		"len":      length,
+		"sortby":   sortBy(tag),
+		"where":    where(tag),
+		"contains": contains,
+		"hasPrefix": func(v any, args []string) (any, error) {
+			if len(args) == 0 {
+				return nil, errors.New("hasPrefix: missing prefix")
+			}
+			return strings.HasPrefix(stringOf(v), args[0]), nil
+		},
+		"hasSuffix": func(v any, args []string) (any, error) {
+			if len(args) == 0 {
+				return nil, errors.New("hasSuffix: missing suffix")
+			}
+			return strings.HasSuffix(stringOf(v), args[0]), nil
+		},
+		"matches": matches,
+		"date": func(v any, args []string) (any, error) {
+			layout := time.RFC3339
+			if len(args) > 0 && args[0] != "" {
+				layout = args[0]
+			}
+			var t time.Time
+			switch x := v.(type) {
+			case time.Time:
+				t = x
+			case *time.Time:
+				if x == nil {
+					return "", nil
+				}
+				t = *x
+			case int64:
+				t = time.Unix(x, 0).UTC()
+			case int:
+				t = time.Unix(int64(x), 0).UTC()
+			default:
+				return v, nil
+			}
+			if t.IsZero() {
+				return "", nil
+			}
+			return t.Format(layout), nil
+		},
+	}
+}
+
+// number formats a number with a fixed count of decimal places and grouped
+// thousands, e.g. number:2 renders 1234.567 as 1,234.57. An optional second
+// argument holds the decimal separator followed by the grouping separator,
+// e.g. number:2:",." renders 1.234,57.
+func number(v any, args []string) (any, error) {
+	places := 0
+	if len(args) > 0 && args[0] != "" {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("number: invalid precision %q", args[0])
+		}
+		places = n
+	}
+	decimal, group := ".", ","
+	if len(args) > 1 && args[1] != "" {
+		r, size := utf8.DecodeRuneInString(args[1])
+		decimal, group = string(r), args[1][size:]
+	}
+
+	if n, ok := numericString(v); ok {
+		v = n
+	}
+	i, f, isInt, ok := numberValue(v)
+	if !ok {
+		return v, nil
+	}
+	var s string
+	if rv := reflect.ValueOf(v); isInt || rv.CanUint() {
+		if isInt {
+			s = strconv.FormatInt(i, 10)
+		} else {
+			// Unsigned values past MaxInt64 would lose digits as floats
+			s = strconv.FormatUint(rv.Uint(), 10)
+		}
+		if places > 0 {
+			s += "." + strings.Repeat("0", places)
+		}
+	} else {
+		s = strconv.FormatFloat(f, 'f', places, 64)
+	}
+
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	intPart, frac, _ := strings.Cut(s, ".")
+	var sb strings.Builder
+	sb.WriteString(sign)
+	for i := 0; i < len(intPart); i++ {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			sb.WriteString(group)
+		}
+		sb.WriteByte(intPart[i])
+	}
+	if frac != "" {
+		sb.WriteString(decimal)
+		sb.WriteString(frac)
+	}
+	return sb.String(), nil
+}
+
+// join stringifies the elements of a slice or array like output tags do and
+// joins them with the separator argument, a space by default.
+func join(v any, args []string) (any, error) {
+	sep := " "
+	if len(args) > 0 {
+		sep = args[0]
+	}
+	var out, scratch strings.Builder
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case []string:
+		return strings.Join(x, sep), nil
+	case []any:
+		for i, item := range x {
+			if i > 0 {
+				out.WriteString(sep)
+			}
+			out.WriteString(toStringFast(item, &scratch))
+		}
+		return out.String(), nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return v, nil
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if i > 0 {
+			out.WriteString(sep)
+		}
+		out.WriteString(toStringFast(rv.Index(i).Interface(), &scratch))
+	}
+	return out.String(), nil
+}
+
+// length counts the elements of a slice, array or map, or the runes of a string.
+func length(v any, _ []string) (any, error) {
+	switch x := v.(type) {
+	case string:
+		return utf8.RuneCountInString(x), nil
+	case SafeString:
+		return utf8.RuneCountInString(string(x)), nil
+	case []any:
+		return len(x), nil
+	case map[string]any:
+		return len(x), nil
+	case nil:
+		return 0, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return rv.Len(), nil
+	case reflect.String:
+		return utf8.RuneCountInString(rv.String()), nil
+	}
+	return nil, fmt.Errorf("length: unsupported type %T", v)
+}
+
+// elementField returns a function looking up the path key, such as "name"
+// or "address.city", on the elements of a slice the way templates do. With a
+// tag, struct fields resolve by it first, as for WithFieldTag.
+func elementField(key, tag string) (func(item any) any, error) {
+	acc, err := compilePath(key)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &renderCtx{fieldCache: elementFieldCache, fieldTag: tag}
+	return func(item any) any {
+		ctx.data = item
+		v, _ := acc.get(ctx)
+		return v
+	}, nil
+}
+
+// elementFieldCache caches struct fields for filters that look at slice
+// elements, which run without a template's render context.
+var elementFieldCache = newFieldCache()
+
+// sortBy returns the sortby filter, which returns a copy of a slice or
+// array of maps or structs, stably sorted by the field or key named by the
+// first argument. A second argument of "desc" sorts in descending order.
+// Elements missing the key sort as if it held the zero value. Struct fields
+// resolve by tag first when it is set, as for WithFieldTag.
+func sortBy(tag string) func(any, []string) (any, error) {
+	return func(v any, args []string) (any, error) {
+		if len(args) == 0 || args[0] == "" {
+			return nil, errors.New("sortby: missing key")
+		}
+		desc := false
+		if len(args) > 1 {
+			switch args[1] {
+			case "asc":
+			case "desc":
+				desc = true
+			default:
+				return nil, fmt.Errorf("sortby: invalid order %q, want asc or desc", args[1])
+			}
+		}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return v, nil
+		}
+		field, err := elementField(args[0], tag)
+		if err != nil {
+			return nil, fmt.Errorf("sortby: %w", err)
+		}
+
+		n := rv.Len()
+		keys := make([]any, n)
+		order := make([]int, n)
+		for i := range n {
+			keys[i] = field(rv.Index(i).Interface())
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			c := compareSortKeys(keys[a], keys[b])
+			if desc {
+				return -c
+			}
+			return c
+		})
+
+		sorted := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), n, n)
+		for i, j := range order {
+			sorted.Index(i).Set(rv.Index(j))
+		}
+		return sorted.Interface(), nil
+	}
+}
+
+// compareSortKeys orders the values of a sort key. A missing (nil) key
+// compares as the zero value of the other's type; values that compareValues
+// can't order fall back to booleans, times and then their string forms.
+func compareSortKeys(a, b any) int {
+	if a == nil && b != nil {
+		a = reflect.Zero(reflect.TypeOf(b)).Interface()
+	} else if b == nil && a != nil {
+		b = reflect.Zero(reflect.TypeOf(a)).Interface()
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c
+	}
+	switch x := a.(type) {
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case y:
+				return -1
+			}
+			return 1
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// where returns the where filter, which returns a new slice holding the
+// elements of a slice or array of maps or structs whose field or key named
+// by the first argument equals the second argument. Numbers compare by
+// value, so "3" matches 3 and 3.0, and booleans match "true" or "false".
+// Elements missing the key never match. Struct fields resolve by tag first
+// when it is set, as for WithFieldTag.
+func where(tag string) func(any, []string) (any, error) {
+	return func(v any, args []string) (any, error) {
+		if len(args) != 2 || args[0] == "" {
+			return nil, errors.New("where: want a key and a value")
+		}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return v, nil
+		}
+		field, err := elementField(args[0], tag)
+		if err != nil {
+			return nil, fmt.Errorf("where: %w", err)
+		}
+
+		n := rv.Len()
+		matched := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), 0, n)
+		for i := range n {
+			if whereMatches(field(rv.Index(i).Interface()), args[1]) {
+				matched = reflect.Append(matched, rv.Index(i))
+			}
+		}
+		return matched.Interface(), nil
 	}
 }
 
+func whereMatches(v any, want string) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return want == strconv.FormatBool(x)
+	}
+	return equalValues(v, want)
+}
+
+// stringOf returns the string form of v as templates print it.
+func stringOf(v any) string {
+	var sb strings.Builder
+	return toStringFast(v, &sb)
+}
+
+// contains reports whether a string contains the argument or a slice or
+// array has an element whose string form equals it.
+func contains(v any, args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("contains: missing value")
+	}
+	rv := reflect.ValueOf(v)
+	if k := rv.Kind(); k == reflect.Slice || k == reflect.Array {
+		for i := range rv.Len() {
+			if stringOf(rv.Index(i).Interface()) == args[0] {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return strings.Contains(stringOf(v), args[0]), nil
+}
+
+// matches reports whether the string form of v matches the regular
+// expression given as the argument.
+func matches(v any, args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("matches: missing pattern")
+	}
+	re, err := regexps.compile(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("matches: %w", err)
+	}
+	return re.MatchString(stringOf(v)), nil
+}
+
+// regexpCache keeps recently used compiled patterns, which may come from
+// the data as well as from templates.
+type regexpCache struct {
+	mu       sync.Mutex
+	patterns *lru[*regexp.Regexp]
+}
+
+var regexps = regexpCache{patterns: newLRU[*regexp.Regexp](256)}
+
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if re, ok := c.patterns.get(pattern); ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.patterns.add(pattern, re)
+	return re, nil
+}
+
 // ----------------------------- Additional optimizations ------------------
 
 // ByteBuffer provides a zero-allocation byte buffer for template rendering
@@ -312,21 +1269,24 @@ var byteBufferPool = sync.Pool{
 	},
 }
 
-// RenderToBytes renders template to a byte slice without allocations
+// RenderToBytes renders the template into a pooled buffer and returns a copy
+// of the output. Each call takes a buffer of its own from the pool and only
+// returns it after copying, so RenderToBytes may be called again while a
+// render is in progress, such as from a function or filter rendering a
+// fragment.
 func (t *Template) RenderToBytes(data any) ([]byte, error) {
 	bb := byteBufferPool.Get().(*ByteBuffer)
 	bb.buf = bb.buf[:0] // reset length but keep capacity
-	defer byteBufferPool.Put(bb)
 
 	err := t.Render((*byteWriter)(bb), data)
-	if err != nil {
-		return nil, err
+	var result []byte
+	if err == nil {
+		result = make([]byte, len(bb.buf))
+		copy(result, bb.buf)
 	}
-
-	// Return copy of the bytes
-	result := make([]byte, len(bb.buf))
-	copy(result, bb.buf)
-	return result, nil
+	// Nothing may refer to bb once it is back in the pool
+	byteBufferPool.Put(bb)
+	return result, err
 }
 
 // byteWriter implements io.Writer for ByteBuffer
@@ -352,10 +1312,10 @@ type FastStruct interface {
 // Optimized field step for types that implement FastStruct
 type fastFieldStep struct{ name string }
 
-func (s fastFieldStep) next(in any) (any, bool) {
+func (s fastFieldStep) next(ctx *renderCtx, in any) (any, bool) {
 	if fs, ok := in.(FastStruct); ok {
 		return fs.FastGet(s.name)
 	}
 	// Fallback to reflection
-	return fieldStep{name: s.name}.next(in)
+	return fieldStep{name: s.name}.next(ctx, in)
 }
@@ -0,0 +1,747 @@
+package fasttpl
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestDefaultFilter(t *testing.T) {
+	type user struct {
+		Name     string
+		Nickname string
+	}
+	cases := []struct {
+		name     string
+		data     any
+		expected string
+	}{
+		{"missing map key", map[string]any{"user": map[string]any{}}, "Anonymous"},
+		{"missing parent", map[string]any{}, "Anonymous"},
+		{"missing struct field", map[string]any{"user": struct{ Name string }{"bob"}}, "Anonymous"},
+		{"empty string", map[string]any{"user": user{Name: "bob"}}, "Anonymous"},
+		{"present", map[string]any{"user": user{Nickname: "bobby"}}, "bobby"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, `{{ user.nickname | default:"Anonymous" }}`, c.data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, result)
+		}
+	}
+
+	if result := renderTest(t, `[{{ user.nickname }}]`, map[string]any{}); result != "[]" {
+		t.Errorf("expected missing value without filters to render nothing, got %q", result)
+	}
+}
+
+func TestTypedFilters(t *testing.T) {
+	data := map[string]any{"price": 3.14159, "count": 7, "text": "2.5"}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ price | round:2 }}`, "3.14"},
+		{`{{ price | round }}`, "3"},
+		{`{{ count | round:2 }}`, "7"},
+		{`{{ text | round }}`, "3"},
+		{`{{ price | round:1 | upper }}`, "3.1"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	typed := DefaultTypedFilters()
+	typed["double"] = func(v any, _ []string) (any, error) {
+		if n, ok := v.(int); ok {
+			return n * 2, nil
+		}
+		return v, nil
+	}
+	filters := DefaultFilters()
+	filters["exclaim"] = func(s string, _ []string) (string, error) { return s + "!", nil }
+	result := renderTest(t, `{{ count | double | double | exclaim }}`, data, WithTypedFilters(typed), WithFilters(filters))
+	if result != "28!" {
+		t.Errorf("expected %q, got %q", "28!", result)
+	}
+}
+
+func TestMathFilters(t *testing.T) {
+	data := map[string]any{"neg": -4, "negf": -2.5, "big": int64(120), "small": uint8(3), "text": "-7", "word": "abc"}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ neg | abs }} {{ negf | abs }} {{ big | abs }} {{ text | abs }} {{ word | abs }}`, "4 2.5 120 7 abc"},
+		{`{{ big | min:100 }} {{ neg | min:100 }} {{ big | min:99.5 }} {{ small | min:2 }}`, "100 -4 99.5 2"},
+		{`{{ neg | max:0 }} {{ big | max:0 }} {{ negf | max:-1.5 }} {{ small | max:-1 }}`, "0 120 -1.5 3"},
+		{`{{ big | clamp:0:100 }} {{ neg | clamp:0:100 }} {{ small | clamp:0:100 }}`, "100 0 3"},
+		{`{{ word | min:1 }} {{ word | clamp:0:1 }}`, "abc abc"},
+		{`{{ neg | abs | number }} {{ big | min:1000.5 | number:1 }}`, "4 120.0"},
+		{`{{ if big | clamp:0:100 == 100 }}full{{ end }}`, "full"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	// Results keep the input's type where it can hold them
+	if v, _ := minFilter(uint8(200), []string{"100"}); v != uint8(100) {
+		t.Errorf("min on uint8: got %T %v", v, v)
+	}
+	if v, _ := absFilter(-3, nil); v != 3 {
+		t.Errorf("abs on int: got %T %v", v, v)
+	}
+	if v, _ := maxFilter(float32(1), []string{"2"}); v != float32(2) {
+		t.Errorf("max on float32: got %T %v", v, v)
+	}
+
+	errCases := map[string]string{
+		`{{ neg | min }}`:           `filter "min" at template:1:1: min: missing bound`,
+		`{{ neg | max:"x" }}`:       `filter "max" at template:1:1: max: invalid number "x"`,
+		`{{ neg | clamp:1 }}`:       `filter "clamp" at template:1:1: clamp: want lower and upper bounds`,
+		`{{ neg | clamp:10:1 }}`:    `filter "clamp" at template:1:1: clamp: lower bound 10 above upper bound 1`,
+		`{{ neg | clamp:0:"top" }}`: `filter "clamp" at template:1:1: clamp: invalid number "top"`,
+	}
+	for src, expected := range errCases {
+		if _, err := renderTestErr(src, data); err == nil || err.Error() != expected {
+			t.Errorf("%s: expected error %q, got %v", src, expected, err)
+		}
+	}
+}
+
+func TestFilterArgsWithColons(t *testing.T) {
+	filters := DefaultFilters()
+	filters["args"] = func(s string, args []string) (string, error) {
+		return strings.Join(args, "|"), nil
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ x | args:"15:04:05" }}`, "15:04:05"},
+		{`{{ x | args:"https://example.com:8080/a?b=c":'x:y' }}`, "https://example.com:8080/a?b=c|x:y"},
+		{`{{ x | args:a:b }}`, "a|b"},
+		{`{{ x | args:" ":"a|b" }}`, " |a|b"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, map[string]any{"x": ""}, WithFilters(filters)); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+	if result := renderTest(t, `{{ t | replace:"12:00":"noon" }}`, map[string]any{"t": "at 12:00"}); result != "at noon" {
+		t.Errorf("expected %q, got %q", "at noon", result)
+	}
+}
+
+func TestFilterPathArgs(t *testing.T) {
+	typed := DefaultTypedFilters()
+	typed["multiply"] = func(v any, args []string) (any, error) {
+		_, f, _, _ := numberValue(v)
+		by, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		return f * by, nil
+	}
+	data := map[string]any{
+		"price":   10.0,
+		"pi":      3.14159,
+		"taxRate": 1.5,
+		"sep":     " / ",
+		"cfg":     map[string]any{"places": 2},
+		"items":   []string{"a", "b"},
+		"words":   []string{"x", "y"},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ price | multiply:$taxRate }}`, "15"},
+		{`{{ pi | round:$cfg.places }}`, "3.14"},
+		{`{{ items | join:$sep }}`, "a / b"},
+		{`{{ items | join:"sep" }}`, "asepb"},
+		{`{{ items | join:sep }}`, "asepb"},
+		{`{{ range w in words }}{{ items | join:$w }};{{ end }}`, "axb;ayb;"},
+		// A bound local wins over a data key of the same name
+		{`{{ range sep in words }}{{ items | join:$sep }};{{ end }}`, "axb;ayb;"},
+		{`{{ title | default:missing }}`, "missing"},
+		// Bare words are literal, whatever the data holds
+		{`{{ cfg | json:indent | safe }}`, "{\n  \"places\": 2\n}"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, WithTypedFilters(typed)); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+	if result := renderTest(t, `{{ cfg | json:indent }}`, map[string]any{"cfg": 1, "indent": false}); result != "1" {
+		t.Errorf("json:indent with an indent key: got %q", result)
+	}
+
+	// Unresolved variables are passed as "", even in strict mode
+	if result := renderTest(t, `{{ items | join:$none }}`, data, WithStrictVars(true)); result != "ab" {
+		t.Errorf("expected %q, got %q", "ab", result)
+	}
+}
+
+func TestDateFilter(t *testing.T) {
+	ts := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+	var nilTime *time.Time
+	cases := []struct {
+		src      string
+		value    any
+		expected string
+	}{
+		{`{{ v | date:"2006-01-02" }}`, ts, "2025-03-14"},
+		{`{{ v | date:"15:04:05" }}`, &ts, "15:09:26"},
+		{`{{ v | date }}`, ts, "2025-03-14T15:09:26Z"},
+		{`{{ v | date:"2006-01-02 15:04" }}`, ts.Unix(), "2025-03-14 15:09"},
+		{`{{ v | date }}`, time.Time{}, ""},
+		{`{{ v | date }}`, nilTime, ""},
+		{`{{ missing | date }}`, nil, ""},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, map[string]any{"v": c.value}); result != c.expected {
+			t.Errorf("%q with %v: expected %q, got %q", c.src, c.value, c.expected, result)
+		}
+	}
+}
+
+func TestJSONFilter(t *testing.T) {
+	type item struct {
+		Name  string `json:"name"`
+		Price int    `json:"price"`
+	}
+	data := map[string]any{
+		"config": map[string]any{"debug": true, "html": "</script><b>&"},
+		"list":   []int{1, 2, 3},
+		"item":   item{Name: "Alpha", Price: 100},
+		"attr":   map[string]int{`x" onmouseover="y`: 1},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ config | json | safe }}`, `{"debug":true,"html":"\u003c/script\u003e\u003cb\u003e\u0026"}`},
+		{`{{ list | json }}`, `[1,2,3]`},
+		{`{{ item | json | safe }}`, `{"name":"Alpha","price":100}`},
+		{`{{ list | json:"indent" }}`, "[\n  1,\n  2,\n  3\n]"},
+		{`{{ item.Name | json | safe }}`, `"Alpha"`},
+		{`{{ item | json | upper }}`, `{&quot;NAME&quot;:&quot;ALPHA&quot;,&quot;PRICE&quot;:100}`},
+		// Without safe the quotes are escaped, so data can't end an attribute
+		{`<a title="{{ attr | json }}">`, `<a title="{&quot;x\&quot; onmouseover=\&quot;y&quot;:1}">`},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+}
+
+func TestLengthFilter(t *testing.T) {
+	data := map[string]any{
+		"items":  []string{"a", "b", "c"},
+		"empty":  []int{},
+		"attrs":  map[string]int{"x": 1, "y": 2},
+		"word":   "héllo",
+		"arr":    [2]int{},
+		"number": 5,
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ items | length }}`, "3"},
+		{`{{ attrs | len }}`, "2"},
+		{`{{ word | length }}`, "5"},
+		{`{{ arr | length }}`, "2"},
+		{`{{ missing | length }}`, "0"},
+		{`{{ if items | length }}some{{ else }}none{{ end }}`, "some"},
+		{`{{ if empty | length }}some{{ else }}none{{ end }}`, "none"},
+		{`{{ if items | length > 2 }}many{{ end }}`, "many"},
+		{`{{ if not (empty | length) }}empty{{ end }}`, "empty"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := renderTestErr(`{{ number | length }}`, data); err == nil || !strings.Contains(err.Error(), "length: unsupported type int") {
+		t.Errorf("expected unsupported type error, got %v", err)
+	}
+	if _, err := renderTestErr(`{{ if items | nope }}x{{ end }}`, data); err == nil || !strings.Contains(err.Error(), `unknown filter "nope"`) {
+		t.Errorf("expected unknown filter error in condition, got %v", err)
+	}
+
+	// The string filter, used without the typed one, counts runes too
+	if result := renderTest(t, `{{ word | length }}`, data, WithTypedFilters(nil)); result != "5" {
+		t.Errorf("string length: expected %q, got %q", "5", result)
+	}
+}
+
+func TestJoinFilter(t *testing.T) {
+	data := map[string]any{
+		"tags":  []string{"go", "templates"},
+		"mixed": []any{"a", 1, 2.5, true},
+		"nums":  []int{1, 2, 3},
+		"nil":   []string(nil),
+		"html":  []string{"<b>", "&"},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ tags | join:", " }}`, "go, templates"},
+		{`{{ mixed | join:"-" }}`, "a-1-2.5-true"},
+		{`{{ nums | join }}`, "1 2 3"},
+		{`{{ nums | join:":" }}`, "1:2:3"},
+		{`[{{ nil | join:", " }}]`, "[]"},
+		{`[{{ missing | join }}]`, "[]"},
+		{`{{ html | join:" " }}`, "&lt;b&gt; &amp;"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+}
+
+func TestReplaceFilter(t *testing.T) {
+	data := map[string]any{"s": "a-b-c", "url": "http://x.io/?a=1&b=2"}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ s | replace:"-":"+" }}`, "a+b+c"},
+		{`{{ s | replace:"-":"+":1 }}`, "a+b-c"},
+		{`{{ s | replace:"-":"+":-1 }}`, "a+b+c"},
+		{`{{ s | replace:"-":"" }}`, "abc"},
+		{`{{ s | replace:"":"+" }}`, "a-b-c"},
+		{`{{ s | replace:"-" }}`, "a-b-c"},
+		{`{{ url | replace:"http://":"https://" }}`, "https://x.io/?a=1&amp;b=2"},
+		{`{{ url | replace:"&":"|" }}`, "http://x.io/?a=1|b=2"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := renderTestErr(`{{ s | replace:"-":"+":x }}`, data); err == nil || !strings.Contains(err.Error(), `replace: invalid count "x"`) {
+		t.Errorf("expected invalid count error, got %v", err)
+	}
+}
+
+func TestNumberFilter(t *testing.T) {
+	data := map[string]any{
+		"price": 1234.567,
+		"int":   1234567,
+		"neg":   -9876543.21,
+		"small": 999,
+		"big":   1e21,
+		"text":  "42000",
+		"name":  "n/a",
+		"max":   uint64(math.MaxUint64),
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ price | number:2 }}`, "1,234.57"},
+		{`{{ price | number }}`, "1,235"},
+		{`{{ int | number }}`, "1,234,567"},
+		{`{{ int | number:2 }}`, "1,234,567.00"},
+		{`{{ neg | number:1 }}`, "-9,876,543.2"},
+		{`{{ small | number }}`, "999"},
+		{`{{ big | number }}`, "1,000,000,000,000,000,000,000"},
+		{`{{ text | number }}`, "42,000"},
+		{`{{ price | number:2:",." }}`, "1.234,57"},
+		{`{{ price | number:2:", " }}`, "1 234,57"},
+		{`{{ int | number:0:"." }}`, "1234567"},
+		{`{{ name | number:2 }}`, "n/a"},
+		{`{{ max | number }}`, "18,446,744,073,709,551,615"},
+		{`{{ max | number:2 }}`, "18,446,744,073,709,551,615.00"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := renderTestErr(`{{ price | number:x }}`, data); err == nil || !strings.Contains(err.Error(), `number: invalid precision "x"`) {
+		t.Errorf("expected invalid precision error, got %v", err)
+	}
+}
+
+func TestSafePipe(t *testing.T) {
+	data := map[string]any{"body": "<b>hi</b>"}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ body }}`, "&lt;b&gt;hi&lt;/b&gt;"},
+		{`{{ body | safe }}`, "<b>hi</b>"},
+		{`{{ body | upper | safe }}`, "<B>HI</B>"},
+		{`{{ body | upper | raw }}`, "<B>HI</B>"},
+		{`[{{ missing | safe }}]`, "[]"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := Compile(`{{ body | safe | upper }}`); err == nil || !strings.Contains(err.Error(), `filter "safe" must be the last`) {
+		t.Errorf("expected error for safe in the middle of a pipeline, got %v", err)
+	}
+}
+
+func TestContextEscapers(t *testing.T) {
+	data := map[string]any{
+		"q":     `a b&c=d"><script>alert(1)</script>`,
+		"js":    "';alert(1)//</script><!--\n\u2028\\",
+		"css":   `red;}</style><script>x</script>{background:url(evil)`,
+		"color": "#ff0000",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`<a href="/search?q={{ q | urlescape }}">`,
+			`<a href="/search?q=a+b%26c%3Dd%22%3E%3Cscript%3Ealert%281%29%3C%2Fscript%3E">`},
+		{`<script>var s = '{{ js | jsescape }}';</script>`,
+			`<script>var s = '\u0027;alert(1)//\u003C/script\u003E\u003C!--\u000A\u2028\u005C';</script>`},
+		{`<button onclick="f('{{ q | jsescape }}')">`,
+			`<button onclick="f('a b\u0026c\u003Dd\u0022\u003E\u003Cscript\u003Ealert(1)\u003C/script\u003E')">`},
+		{`<p style="color: {{ css | cssescape }}">`,
+			`<p style="color: red\3b \7d \3c \2f style\3e \3c script\3e x\3c \2f script\3e \7b background\3a url\28 evil\29 ">`},
+		{`<p style="color: {{ color | cssescape }}">`, `<p style="color: #ff0000">`},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s:\nexpected %s\n     got %s", c.src, c.expected, result)
+		}
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	users := []map[string]any{
+		{"name": "carol", "age": 35},
+		{"name": "alice", "age": 30},
+		{"name": "bob"},
+		{"name": "dave", "age": 30},
+	}
+	data := map[string]any{
+		"users":   users,
+		"structs": []user{{"carol", 35}, {"alice", 30}, {"bob", 25}},
+		"nested":  []map[string]any{{"n": 1, "a": map[string]any{"c": "b"}}, {"n": 2, "a": map[string]any{"c": "a"}}},
+		"order":   "desc",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ range u in users | sortby:"name" }}{{ $u.name }} {{ end }}`, "alice bob carol dave "},
+		{`{{ range u in users | sortby:"age" }}{{ $u.name }} {{ end }}`, "bob alice dave carol "},
+		{`{{ range u in users | sortby:"age":desc }}{{ $u.name }} {{ end }}`, "carol alice dave bob "},
+		{`{{ range u in users | sortby:"age":$order }}{{ $u.name }} {{ end }}`, "carol alice dave bob "},
+		{`{{ range u in structs | sortby:"Age" }}{{ $u.Name }} {{ end }}`, "bob alice carol "},
+		{`{{ range u in nested | sortby:"a.c" }}{{ $u.n }}{{ end }}`, "21"},
+		{`{{ range u in missing | sortby:"name" }}x{{ else }}none{{ end }}`, "none"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if users[0]["name"] != "carol" || users[1]["name"] != "alice" {
+		t.Errorf("sortby mutated the input slice: %v", users)
+	}
+	if _, err := renderTestErr(`{{ range u in users | sortby:"name":up }}{{ end }}`, data); err == nil || !strings.Contains(err.Error(), `sortby: invalid order "up"`) {
+		t.Errorf("expected invalid order error, got %v", err)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	type product struct {
+		Name    string
+		Price   float64
+		InStock bool
+	}
+	products := []map[string]any{
+		{"name": "pen", "price": 2, "inStock": true},
+		{"name": "ink", "price": 5.0, "inStock": false},
+		{"name": "pad", "price": 5, "inStock": true},
+		{"name": "box"},
+	}
+	data := map[string]any{
+		"products": products,
+		"structs":  []product{{"pen", 2, true}, {"ink", 5, false}, {"pad", 5, true}},
+		"wanted":   "pad",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ range p in products | where:"inStock":"true" }}{{ $p.name }} {{ end }}`, "pen pad "},
+		{`{{ range p in products | where:"inStock":"false" }}{{ $p.name }} {{ end }}`, "ink "},
+		{`{{ range p in products | where:"price":5 }}{{ $p.name }} {{ end }}`, "ink pad "},
+		{`{{ range p in products | where:"name":$wanted }}{{ $p.name }} {{ end }}`, "pad "},
+		{`{{ range p in structs | where:"InStock":"true" }}{{ $p.Name }} {{ end }}`, "pen pad "},
+		{`{{ range p in structs | where:"Price":"5" }}{{ $p.Name }} {{ end }}`, "ink pad "},
+		{`{{ range p in products | where:"name":"nope" }}x{{ else }}none{{ end }}`, "none"},
+		{`{{ products | where:"inStock":"true" | length }}`, "2"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if len(products) != 4 || products[1]["name"] != "ink" {
+		t.Errorf("where mutated the input slice: %v", products)
+	}
+	if _, err := renderTestErr(`{{ range p in products | where:"name" }}{{ end }}`, data); err == nil || !strings.Contains(err.Error(), "where: want a key and a value") {
+		t.Errorf("expected missing value error, got %v", err)
+	}
+}
+
+func TestWriterFilters(t *testing.T) {
+	repeat := WriterFilters{"repeat": func(w io.Writer, in string, args []string) error {
+		n := 2
+		if len(args) > 0 {
+			n, _ = strconv.Atoi(args[0])
+		}
+		for range n {
+			if _, err := io.WriteString(w, in); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	data := map[string]any{"s": "<a>", "n": 3}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ s | repeat }}`, "&lt;a&gt;&lt;a&gt;"},
+		{`{{ s | repeat:$n }}`, "&lt;a&gt;&lt;a&gt;&lt;a&gt;"},
+		{`{{ s | repeat | safe }}`, "<a><a>"},
+		{`{{ s | upper | repeat | safe }}`, "<A><A>"},
+		{`{{ s | repeat | upper }}`, "&lt;A&gt;&lt;A&gt;"},
+		{`{{ n | repeat:1 }}`, "3"},
+		{`{{ if s | repeat == "<a><a>" }}yes{{ end }}`, "yes"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, WithWriterFilters(repeat)); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	// Typed filters take precedence over writer filters of the same name
+	typed := DefaultTypedFilters()
+	typed["repeat"] = func(v any, _ []string) (any, error) { return "typed", nil }
+	if result := renderTest(t, `{{ s | repeat }}`, data, WithWriterFilters(repeat), WithTypedFilters(typed)); result != "typed" {
+		t.Errorf("expected the typed filter, got %q", result)
+	}
+
+	failing := WriterFilters{"fail": func(io.Writer, string, []string) error { return errors.New("boom") }}
+	if _, err := renderTestErr(`{{ s | fail }}`, data, WithWriterFilters(failing)); err == nil || err.Error() != `filter "fail" at template:1:1: boom` {
+		t.Errorf("expected the filter's error, got %v", err)
+	}
+}
+
+func TestEscaper(t *testing.T) {
+	strict := func(s string) string { return strings.ReplaceAll(htmlEscapeFast(s), "/", "&#x2F;") }
+	trusted := func(s string) string { return s }
+	wrap := WriterFilters{"wrap": func(w io.Writer, in string, _ []string) error {
+		_, err := io.WriteString(w, "<"+in+">")
+		return err
+	}}
+	digits := func(s string) string { return strings.ReplaceAll(s, "4", "four") }
+	data := map[string]any{"s": "</b>", "html": SafeString("<i>"), "n": 42}
+	cases := []struct {
+		src      string
+		escaper  func(string) string
+		expected string
+	}{
+		{`{{ s }}`, nil, "&lt;/b&gt;"},
+		{`{{ s }}`, strict, "&lt;&#x2F;b&gt;"},
+		{`{{ s }}`, trusted, "</b>"},
+		{`{{ s | upper }}`, strict, "&lt;&#x2F;B&gt;"},
+		{`{{ s | wrap }}`, strict, "&lt;&lt;&#x2F;b&gt;&gt;"},
+		{`{{ s | wrap }}`, trusted, "<</b>>"},
+		{`{{ s | safe }}{{ html }}{{ raw s }}`, strict, "</b><i></b>"},
+		{`{{ t "a/b" }}`, strict, "a&#x2F;b"},
+		{`{{ n }}|{{ raw n }}`, digits, "four2|42"},
+		{`{{ n }}`, nil, "42"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, WithWriterFilters(wrap), WithEscaper(c.escaper)); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	// Partials are escaped by the template being rendered
+	page := MustCompile(`{{ include "p" }}`, WithEscaper(strict))
+	page.RegisterPartial("p", MustCompile(`{{ s }}`))
+	if result, err := page.RenderString(data); err != nil || result != "&lt;&#x2F;b&gt;" {
+		t.Errorf("partial: got %q (%v)", result, err)
+	}
+
+	cc := NewCompileCache(10)
+	a, _ := cc.Compile(`{{ s }}`, WithEscaper(strict))
+	b, _ := cc.Compile(`{{ s }}`)
+	if a == b {
+		t.Error("templates with different escapers share a cache entry")
+	}
+}
+
+func TestCapitalizeAndTitle(t *testing.T) {
+	cases := []struct {
+		src      string
+		in       string
+		expected string
+	}{
+		{`{{ s | capitalize }}`, "hello world", "Hello world"},
+		{`{{ s | capitalize }}`, "élan vital", "Élan vital"},
+		{`{{ s | capitalize }}`, "ßtraße", "ßtraße"},
+		{`{{ s | capitalize }}`, "ǆungla", "ǅungla"},
+		{`{{ s | capitalize }}`, "already Upper", "Already Upper"},
+		{`{{ s | capitalize }}`, "", ""},
+		{`{{ s | title }}`, "hello wORLD", "Hello WORLD"},
+		{`{{ s | title }}`, "über  älter\tçava", "Über  Älter\tÇava"},
+		{`{{ s | title }}`, "(note) 1st place", "(Note) 1st Place"},
+		{`{{ s | title }}`, "日本 ñandú", "日本 Ñandú"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, map[string]any{"s": c.in}); result != c.expected {
+			t.Errorf("%s with %q: expected %q, got %q", c.src, c.in, c.expected, result)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	cases := []struct {
+		src      string
+		in       string
+		expected string
+	}{
+		{`{{ s | truncate:5 }}`, "Hello World", "Hello"},
+		{`{{ s | truncate:20 }}`, "Hello World", "Hello World"},
+		{`{{ s | truncate:11:"…" }}`, "Hello World", "Hello World"},
+		{`{{ s | truncate:8:"…" }}`, "Hello World", "Hello W…"},
+		{`{{ s | truncate:8:"..." }}`, "Hello World", "Hello..."},
+		{`{{ s | truncate:2:"..." }}`, "Hello World", "He"},
+		{`{{ s | truncate:0 }}`, "Hello", ""},
+		{`{{ s | truncate:3 }}`, "日本語のテキスト", "日本語"},
+		{`{{ s | truncate:4:"…" }}`, "日本語のテキスト", "日本語…"},
+		{`{{ s | truncate:2 }}`, "😀😃😄", "😀😃"},
+		{`{{ s | truncate:2:"…" }}`, "😀😃😄", "😀…"},
+		{`{{ s | truncate:3:"…" }}`, "😀😃😄", "😀😃😄"},
+		{`{{ s | truncate:x }}`, "Hello", "Hello"},
+	}
+	for _, c := range cases {
+		result := renderTest(t, c.src, map[string]any{"s": c.in})
+		if result != c.expected {
+			t.Errorf("%s with %q: expected %q, got %q", c.src, c.in, c.expected, result)
+		}
+		if !utf8.ValidString(result) {
+			t.Errorf("%s with %q: invalid UTF-8 %q", c.src, c.in, result)
+		}
+	}
+}
+
+func TestStringPredicates(t *testing.T) {
+	data := map[string]any{
+		"path":   "/admin/users",
+		"tags":   []string{"go", "web"},
+		"ids":    []int{1, 22},
+		"prefix": "/admin",
+		"code":   404,
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ if path | hasPrefix:"/admin" }}admin{{ end }}`, "admin"},
+		{`{{ if path | hasPrefix:"/user" }}user{{ else }}no{{ end }}`, "no"},
+		{`{{ if path | hasPrefix:$prefix }}admin{{ end }}`, "admin"},
+		{`{{ if path | hasSuffix:"users" }}list{{ end }}`, "list"},
+		{`{{ if path | contains:"min/u" }}yes{{ end }}`, "yes"},
+		{`{{ if tags | contains:"web" }}web{{ end }}`, "web"},
+		{`{{ if tags | contains:"we" }}we{{ else }}no{{ end }}`, "no"},
+		{`{{ if ids | contains:22 }}22{{ end }}`, "22"},
+		{`{{ if code | hasPrefix:"4" }}client error{{ end }}`, "client error"},
+		{`{{ if path | matches:"^/admin/[a-z]+$" }}match{{ end }}`, "match"},
+		{`{{ if not (path | matches:"^/api/") }}not api{{ end }}`, "not api"},
+		{`{{ path | hasSuffix:"x" }}`, "false"},
+		{`{{ path | matches:"users" ? "users page" : "other" }}`, "users page"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := renderTestErr(`{{ path | matches:"(" }}`, data); err == nil || !strings.Contains(err.Error(), "matches: error parsing regexp") {
+		t.Errorf("expected invalid pattern error, got %v", err)
+	}
+	first, _ := regexps.compile("^a+$")
+	second, _ := regexps.compile("^a+$")
+	if first != second {
+		t.Error("expected the compiled pattern to be cached")
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	data := map[string]any{"body": "*hi* & <b>"}
+	if _, err := MustCompile(`{{ body | markdown | safe }}`).RenderString(data); err == nil ||
+		!strings.Contains(err.Error(), "WithMarkdown") {
+		t.Errorf("without a renderer: expected an error, got %v", err)
+	}
+
+	emphasis := MarkdownFunc(func(w io.Writer, src string) error {
+		_, err := io.WriteString(w, "<p>"+strings.ReplaceAll(src, "*", "")+"</p>")
+		return err
+	})
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ body | markdown | safe }}`, "<p>hi & <b></p>"},
+		{`{{ body | markdown }}`, "&lt;p&gt;hi &amp; &lt;b&gt;&lt;/p&gt;"},
+		{`{{ body | markdown | upper | safe }}`, "<P>HI & <B></P>"},
+		{`{{ "*x*" | markdown | safe }}`, "<p>x</p>"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, WithMarkdown(emphasis)); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	failing := MarkdownFunc(func(io.Writer, string) error { return errors.New("bad input") })
+	if _, err := MustCompile(`{{ body | markdown | safe }}`, WithMarkdown(failing)).RenderString(data); err == nil ||
+		!strings.Contains(err.Error(), "bad input") {
+		t.Errorf("failing renderer: expected its error, got %v", err)
+	}
+
+	cc := NewCompileCache(10)
+	a, _ := cc.Compile(`{{ body | markdown | safe }}`, WithMarkdown(emphasis))
+	b, _ := cc.Compile(`{{ body | markdown | safe }}`, WithMarkdown(failing))
+	if a == b {
+		t.Error("templates with different markdown renderers share a cache entry")
+	}
+}
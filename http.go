@@ -0,0 +1,62 @@
+package fasttpl
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ----------------------------- net/http helpers -----------------------------
+
+// RenderHTTP renders the template as an HTML response. The page is rendered
+// into a pooled buffer first, so when rendering fails nothing of it is sent:
+// w gets a 500 with the error instead, and the error is returned for
+// logging. Content-Type is set to text/html unless the handler already set
+// one.
+func (t *Template) RenderHTTP(w http.ResponseWriter, data any) error {
+	return serveHTML(w, func(buf io.Writer) error {
+		return t.Render(buf, data)
+	})
+}
+
+// RenderHTTP is like Template.RenderHTTP for the named template, laid out
+// as by Render.
+func (e *Engine) RenderHTTP(w http.ResponseWriter, tmplName string, data any, layout ...string) error {
+	return serveHTML(w, func(buf io.Writer) error {
+		return e.Render(buf, tmplName, data, layout...)
+	})
+}
+
+// Handler returns an http.Handler that renders the named template, laid out
+// as by Render, with the data dataFn builds for each request; dataFn may be
+// nil. Rendering stops when the request's context is canceled. Failures are
+// answered as by RenderHTTP.
+func (e *Engine) Handler(tmplName string, dataFn func(*http.Request) any, layout ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data any
+		if dataFn != nil {
+			data = dataFn(r)
+		}
+		serveHTML(w, func(buf io.Writer) error {
+			return e.RenderContext(r.Context(), buf, tmplName, data, layout...)
+		})
+	})
+}
+
+// serveHTML writes what render produces as an HTML response, or a 500 if it
+// fails.
+func serveHTML(w http.ResponseWriter, render func(io.Writer) error) error {
+	buf := AcquireBuffer()
+	defer ReleaseBuffer(buf)
+	if err := render(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,84 @@
+package fasttpl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRenderHTTP(t *testing.T) {
+	tpl := MustCompile(`<p>{{ name }}</p>{{ missing }}`, WithStrictVars(true))
+
+	rec := httptest.NewRecorder()
+	if err := tpl.RenderHTTP(rec, map[string]any{"name": "Ann", "missing": "!"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "<p>Ann</p>!" {
+		t.Errorf("expected 200 with the page, got %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("expected an HTML content type, got %q", ct)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "11" {
+		t.Errorf("expected Content-Length 11, got %q", cl)
+	}
+
+	// A failure partway through sends none of the page
+	rec = httptest.NewRecorder()
+	if err := tpl.RenderHTTP(rec, map[string]any{"name": "Ann"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "Ann") {
+		t.Errorf("expected a 500 without the partial page, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A content type set by the handler is kept
+	rec = httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "image/svg+xml")
+	if err := MustCompile(`<svg/>`).RenderHTTP(rec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("expected the handler's content type, got %q", ct)
+	}
+}
+
+func TestEngineHandler(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.html":   {Data: []byte(`Hi {{ name }}`)},
+		"broken.html": {Data: []byte(`{{ include "nope" }}`)},
+		"base.html":   {Data: []byte(`[{{ yield }}]`)},
+	}
+	engine, err := NewTemplateFS(fsys, ".", ".html", WithLayout("base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFn := func(r *http.Request) any {
+		return map[string]any{"name": r.URL.Query().Get("name")}
+	}
+
+	rec := httptest.NewRecorder()
+	engine.Handler("page", dataFn).ServeHTTP(rec, httptest.NewRequest("GET", "/?name=<Ann>", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "[Hi &lt;Ann&gt;]" {
+		t.Errorf("expected 200 with the page, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	engine.Handler("page", nil, "").ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "Hi " {
+		t.Errorf("expected the page without a layout, got %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	engine.Handler("broken", dataFn).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), `partial "nope" not found`) {
+		t.Errorf("expected a 500 with the error, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	if err := engine.RenderHTTP(rec, "missing", nil); err == nil || rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected a 500 for a missing template, got %d (%v)", rec.Code, err)
+	}
+}
@@ -0,0 +1,220 @@
+package fasttpl
+
+import "fmt"
+
+// ----------------------------- Lint -----------------------------------------
+
+// Warning reports a likely mistake that doesn't stop a template from
+// compiling. Line and Column are 1-based, as in ParseError.
+type Warning struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("template:%d:%d: %s", w.Line, w.Column, w.Message)
+}
+
+// Lint parses a template and reports likely mistakes without failing on
+// them: currently let variables that nothing reads. A let followed by an
+// include or yield in its scope counts as read, since partials and pages see
+// the same locals. Syntax errors are returned as the error, as from Parse.
+func Lint(src string, opts ...Option) ([]Warning, error) {
+	tree, err := Parse(src, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var l linter
+	for _, n := range tree.nodes {
+		l.node(n)
+	}
+	var warnings []Warning
+	for _, let := range l.lets {
+		if !let.used {
+			warnings = append(warnings, Warning{
+				Line:    let.pos.line,
+				Column:  let.pos.col,
+				Message: fmt.Sprintf("let %q is never used", let.name),
+			})
+		}
+	}
+	return warnings, nil
+}
+
+// linter walks a parse tree in render order, matching each read of a local
+// to the let it sees.
+type linter struct {
+	lets   []*letUse
+	bound  []binding // locals bound by the enclosing ranges and with ... as
+	replay int       // > 0 while revisiting a range body as its next iteration
+}
+
+type letUse struct {
+	name string
+	pos  *srcPos
+	used bool
+}
+
+// binding is a local bound by a range or with ... as. It hides lets of the
+// same name declared before it, of which there were lets.
+type binding struct {
+	name string
+	lets int
+}
+
+func (l *linter) node(n node) {
+	switch n := n.(type) {
+	case printNode:
+		l.accessor(n.acc)
+		l.pipes(n.pipes)
+	case ifNode:
+		l.accessor(n.cond)
+		l.node(n.then)
+		l.node(n.els)
+	case rangeNode:
+		l.accessor(n.iter)
+		l.bind(n.item, localIndex, localFirst, localLast)
+		l.node(n.body)
+		// Reads early in the body see lets from the end of the last iteration
+		l.replay++
+		l.node(n.body)
+		l.replay--
+		l.bound = l.bound[:len(l.bound)-4]
+		l.node(n.els)
+	case switchNode:
+		l.accessor(n.value)
+		for _, c := range n.cases {
+			l.node(c.body)
+		}
+		l.node(n.def)
+	case letNode:
+		l.accessor(n.acc)
+		if l.replay == 0 {
+			l.lets = append(l.lets, &letUse{name: n.name, pos: n.pos})
+		}
+	case withNode:
+		l.accessor(n.acc)
+		if n.name == "" {
+			l.node(n.body)
+		} else {
+			l.bind(n.name)
+			l.node(n.body)
+			l.bound = l.bound[:len(l.bound)-1]
+		}
+		l.node(n.els)
+	case blockNode:
+		l.node(n.body)
+	case transNode:
+		l.accessor(n.key)
+		for _, arg := range n.args {
+			l.accessor(arg)
+		}
+		for _, param := range n.params {
+			l.accessor(param.acc)
+		}
+	case includeNode:
+		l.accessor(n.nameAcc)
+		l.accessor(n.data)
+		for _, param := range n.params {
+			l.accessor(param.acc)
+		}
+		l.useAll()
+	case yieldNode:
+		l.useAll()
+	case seqNode:
+		for _, child := range n {
+			l.node(child)
+		}
+	}
+}
+
+func (l *linter) accessor(acc accessor) {
+	switch a := acc.(type) {
+	case boundAcc:
+		if len(a.steps) > 0 {
+			if ls, ok := a.steps[0].(localStep); ok {
+				l.use(ls.name)
+			}
+		}
+	case compareAcc:
+		l.accessor(a.left)
+		l.accessor(a.right)
+	case andAcc:
+		for _, term := range a {
+			l.accessor(term)
+		}
+	case orAcc:
+		for _, term := range a {
+			l.accessor(term)
+		}
+	case notAcc:
+		l.accessor(a.acc)
+	case pipeAcc:
+		l.accessor(a.acc)
+		l.pipes(a.pipes)
+	case spanAcc:
+		l.accessor(a.from)
+		l.accessor(a.to)
+	case ternaryAcc:
+		l.accessor(a.cond)
+		l.accessor(a.then)
+		l.accessor(a.els)
+	case callAcc:
+		for _, arg := range a.args {
+			l.accessor(arg)
+		}
+	case coalesceAcc:
+		for _, op := range a {
+			l.accessor(op)
+		}
+	case indexAcc:
+		for _, op := range a {
+			l.accessor(op)
+		}
+	}
+}
+
+// pipes visits the filter arguments that name a variable, such as $sep.
+func (l *linter) pipes(pipes []pipe) {
+	for _, p := range pipes {
+		for _, acc := range p.argAccs {
+			l.accessor(acc)
+		}
+	}
+}
+
+func (l *linter) bind(names ...string) {
+	for _, name := range names {
+		l.bound = append(l.bound, binding{name: name, lets: len(l.lets)})
+	}
+}
+
+// use marks the let a read of the local name sees, unless a range or with
+// ... as binding declared after that let hides it.
+func (l *linter) use(name string) {
+	i := len(l.lets) - 1
+	for i >= 0 && l.lets[i].name != name {
+		i--
+	}
+	if i < 0 {
+		return
+	}
+	for j := len(l.bound) - 1; j >= 0; j-- {
+		if b := l.bound[j]; b.name == name {
+			if i < b.lets {
+				return
+			}
+			break
+		}
+	}
+	l.lets[i].used = true
+}
+
+// useAll marks every let so far, for includes and yields, whose templates
+// can read any local.
+func (l *linter) useAll() {
+	for _, let := range l.lets {
+		let.used = true
+	}
+}
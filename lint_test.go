@@ -0,0 +1,52 @@
+package fasttpl
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLintUnusedLets(t *testing.T) {
+	cases := []struct {
+		src    string
+		unused []string
+	}{
+		{`{{ let a = x }}{{ $a }}`, nil},
+		{`{{ let a = x }}{{ let b = y }}{{ $b }}`, []string{`template:1:1: let "a" is never used`}},
+		{"{{ let a = x }}\n  {{ let a = y }}{{ $a }}", []string{`template:1:1: let "a" is never used`}},
+		{`{{ if ok }}{{ let a = x }}{{ end }}{{ $a }}`, nil},
+		{`{{ let a = x }}{{ if $a > 1 }}{{ end }}`, nil},
+		{`{{ let sep = "," }}{{ items | join:$sep }}`, nil},
+		{`{{ let a = x }}{{ upper($a) }}`, nil},
+		// A range item hides an outer let of the same name
+		{`{{ let item = x }}{{ range item in items }}{{ $item }}{{ end }}`, []string{`template:1:1: let "item" is never used`}},
+		{`{{ let index = x }}{{ range i in items }}{{ $index }}{{ end }}`, []string{`template:1:1: let "index" is never used`}},
+		{`{{ range i in items }}{{ let i = 1 }}{{ $i }}{{ end }}`, nil},
+		{`{{ let u = x }}{{ with user as u }}{{ $u }}{{ end }}`, []string{`template:1:1: let "u" is never used`}},
+		{`{{ let u = x }}{{ with user }}{{ $u }}{{ end }}`, nil},
+		// The next iteration reads what the last one left
+		{`{{ range i in items }}{{ $prev }}{{ let prev = $i }}{{ end }}`, nil},
+		{`{{ range i in items }}{{ let prev = $i }}{{ end }}`, []string{`template:1:23: let "prev" is never used`}},
+		// Partials and pages see the caller's locals
+		{`{{ let a = x }}{{ include "p" }}`, nil},
+		{`{{ include "p" }}{{ let a = x }}`, []string{`template:1:18: let "a" is never used`}},
+		{`{{ let a = x }}{{ yield }}`, nil},
+	}
+	for _, c := range cases {
+		warnings, err := Lint(c.src)
+		if err != nil {
+			t.Errorf("%q: %v", c.src, err)
+			continue
+		}
+		var got []string
+		for _, w := range warnings {
+			got = append(got, w.String())
+		}
+		if !slices.Equal(got, c.unused) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.unused, got)
+		}
+	}
+
+	if _, err := Lint(`{{ if }}`); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
@@ -0,0 +1,176 @@
+package fasttpl
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ----------------------------- Template loading -----------------------------
+
+// osFS reads native OS paths. Unlike os.DirFS it accepts relative and
+// absolute filenames, so the os-based APIs keep their existing behavior.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error)          { return os.Open(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (osFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+// templateFS pairs a filesystem with the path functions matching its naming:
+// native paths for the OS, forward slashes for io/fs.
+type templateFS struct {
+	fsys fs.FS
+	join func(elem ...string) string
+	dir  func(name string) string
+	base func(name string) string
+}
+
+var nativeFS = templateFS{fsys: osFS{}, join: filepath.Join, dir: filepath.Dir, base: filepath.Base}
+
+func ioFS(fsys fs.FS) templateFS {
+	return templateFS{fsys: fsys, join: path.Join, dir: path.Dir, base: path.Base}
+}
+
+// compile reads and compiles the named template and registers the partials
+// found next to it.
+func (tfs templateFS) compile(name string, opts ...Option) (*Template, error) {
+	content, err := fs.ReadFile(tfs.fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("reading template %q: %w", name, err)
+	}
+
+	tmpl, err := Compile(string(content), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("compiling template %q: %w", name, err)
+	}
+	tmpl.source = name
+
+	tfs.discoverPartials(tmpl, tfs.dir(name), tfs.base(name), "", opts...)
+	return tmpl, nil
+}
+
+// PartialConvention describes which files next to a template are
+// auto-discovered as its partials, and what they are called. A file is a
+// partial when its name without the extension starts with Prefix and ends
+// with Suffix; the partial is named after what remains in between.
+type PartialConvention struct {
+	Prefix string // e.g. "_": _header.html becomes "header"
+	Suffix string // e.g. ".partial": header.partial.html becomes "header"
+
+	// Dir, when set, is a subdirectory of the template's directory holding
+	// the partials, e.g. "partials" for partials/header.html.
+	Dir string
+}
+
+var defaultPartials = PartialConvention{Prefix: "_"}
+
+// name returns the partial name for a file called stem, without its
+// extension, or false if the file isn't a partial.
+func (pc *PartialConvention) name(stem string) (string, bool) {
+	if len(stem) <= len(pc.Prefix)+len(pc.Suffix) ||
+		!strings.HasPrefix(stem, pc.Prefix) || !strings.HasSuffix(stem, pc.Suffix) {
+		return "", false
+	}
+	return stem[len(pc.Prefix) : len(stem)-len(pc.Suffix)], true
+}
+
+// discoverPartials registers the files in dir that follow the partial
+// convention of opts as partials of tmpl (by default, _header.html becomes
+// "header"). base is the file name of tmpl itself. ext is trimmed from
+// partial names; when empty, each partial's own extension is trimmed.
+// Partials that fail to load are skipped, and their errors returned for
+// callers that want to report them.
+func (tfs templateFS) discoverPartials(tmpl *Template, dir, base, ext string, opts ...Option) (errs []error) {
+	conv := newCompileOptions(opts).partials
+	if conv == nil {
+		return nil
+	}
+	trimExt := func(name string) string {
+		if ext == "" {
+			return strings.TrimSuffix(name, path.Ext(name))
+		}
+		return strings.TrimSuffix(name, ext)
+	}
+	baseNoExt := trimExt(base)
+	if conv.Dir != "" {
+		dir = tfs.join(dir, conv.Dir)
+	}
+
+	// Look for partial files (e.g., _header.html, _footer.html)
+	entries, err := fs.ReadDir(tfs.fsys, dir)
+	if err != nil { // Don't fail if we can't read directory
+		return nil
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (conv.Dir == "" && name == base) {
+			continue
+		}
+
+		partialPath := tfs.join(dir, name)
+		partialName, ok := conv.name(trimExt(name))
+		if !ok {
+			continue
+		}
+
+		// Skip if partial name matches the main template's base name (to avoid conflicts)
+		if partialName == baseNoExt {
+			continue
+		}
+
+		// Compile partial without include discovery to avoid infinite recursion
+		partialContent, err := fs.ReadFile(tfs.fsys, partialPath)
+		if err != nil {
+			// Skip failed partials but don't fail the main compilation
+			errs = append(errs, fmt.Errorf("reading template %q: %w", partialPath, err))
+			continue
+		}
+
+		partial, err := Compile(string(partialContent), opts...)
+		if err != nil {
+			// Skip failed partials but don't fail the main compilation
+			errs = append(errs, fmt.Errorf("compiling template %q: %w", partialPath, err))
+			continue
+		}
+		partial.source = partialPath
+		tmpl.RegisterPartial(partialName, partial)
+		tmpl.partialFiles = append(tmpl.partialFiles, partialPath)
+	}
+	return errs
+}
+
+// checkPatterns reports the first malformed file selection pattern.
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("template pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// selectFile reports whether the file called name should be loaded as a
+// template: whether it matches one of patterns or, when there are none,
+// whether fallback accepts it.
+func selectFile(patterns []string, name string, fallback func(string) bool) bool {
+	if len(patterns) == 0 {
+		return fallback(name)
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CompileFS compiles the named template from fsys, such as an embed.FS, with
+// the same partial auto-discovery as CompileFile. Names are slash-separated
+// as io/fs requires. Results are not cached; use NewFileCacheFS for that.
+func CompileFS(fsys fs.FS, name string, opts ...Option) (*Template, error) {
+	return ioFS(fsys).compile(name, opts...)
+}
@@ -0,0 +1,137 @@
+package fasttpl
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+var testFS = fstest.MapFS{
+	"views/index.html":   {Data: []byte(`{{ include "header" }}<p>{{ name }}</p>`)},
+	"views/_header.html": {Data: []byte(`<h1>{{ title }}</h1>`)},
+	"views/layout.html":  {Data: []byte(`<main>{{ include "content" }}</main>`)},
+}
+
+func TestCompileFS(t *testing.T) {
+	tpl, err := CompileFS(testFS, "views/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := tpl.RenderString(map[string]any{"title": "Hi", "name": "Ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<h1>Hi</h1><p>Ann</p>" {
+		t.Errorf("expected %q, got %q", "<h1>Hi</h1><p>Ann</p>", result)
+	}
+
+	if _, err := CompileFS(testFS, "views/missing.html"); err == nil {
+		t.Error("expected error for missing template")
+	}
+}
+
+func TestFileCacheFS(t *testing.T) {
+	fc := NewFileCacheFS(testFS, 10)
+	first, err := fc.CompileFile("views/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := fc.CompileFile("views/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected cached template to be reused")
+	}
+}
+
+func TestNewTemplateFS(t *testing.T) {
+	engine, err := NewTemplateFS(testFS, "views", ".html", WithLayout("layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+
+	result, err := engine.RenderString("index", map[string]any{"title": "Hi", "name": "Ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<main><h1>Hi</h1><p>Ann</p></main>" {
+		t.Errorf("expected %q, got %q", "<main><h1>Hi</h1><p>Ann</p></main>", result)
+	}
+}
+
+func TestPartialConventions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"views/page.html":          {Data: []byte(`page`)},
+		"views/_nav.html":          {Data: []byte(`underscore`)},
+		"views/foot.partial.html":  {Data: []byte(`suffix`)},
+		"views/partials/nav.html":  {Data: []byte(`dir`)},
+		"views/partials/foot.html": {Data: []byte(`dir foot`)},
+	}
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected map[string]string // partial name to its output
+	}{
+		{"default", nil, map[string]string{"nav": "underscore"}},
+		{"suffix", []Option{WithPartials(PartialConvention{Suffix: ".partial"})}, map[string]string{"foot": "suffix"}},
+		{"dir", []Option{WithPartials(PartialConvention{Dir: "partials"})}, map[string]string{"nav": "dir", "foot": "dir foot"}},
+		{"disabled", []Option{WithPartialDiscovery(false)}, map[string]string{}},
+		{"re-enabled", []Option{WithPartialDiscovery(false), WithPartialDiscovery(true)}, map[string]string{"nav": "underscore"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := CompileFS(fsys, "views/page.html", tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := tpl.parts.load()
+			if len(parts) != len(tt.expected) {
+				t.Errorf("expected %d partials, got %d", len(tt.expected), len(parts))
+			}
+			for name, expected := range tt.expected {
+				partial, ok := parts[name]
+				if !ok {
+					t.Errorf("expected partial %q", name)
+					continue
+				}
+				if result, _ := partial.RenderString(nil); result != expected {
+					t.Errorf("partial %q: expected %q, got %q", name, expected, result)
+				}
+			}
+		})
+	}
+}
+
+func TestPartialSource(t *testing.T) {
+	tpl, err := CompileFS(testFS, "views/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, ok := tpl.PartialSource("header"); !ok || src != "views/_header.html" {
+		t.Errorf("header: expected views/_header.html, got %q (%v)", src, ok)
+	}
+	if _, ok := tpl.PartialSource("missing"); ok {
+		t.Error("missing: expected no source")
+	}
+
+	// Partials registered by hand report the file they came from, if any
+	tpl.RegisterPartial("inline", MustCompile(`x`))
+	if _, ok := tpl.PartialSource("inline"); ok {
+		t.Error("inline: expected no source")
+	}
+	layout, _ := CompileFS(testFS, "views/layout.html")
+	tpl.RegisterPartial("header", layout)
+	if src, _ := tpl.PartialSource("header"); src != "views/layout.html" {
+		t.Errorf("replaced header: expected views/layout.html, got %q", src)
+	}
+
+	engine, err := NewTemplateFS(testFS, "views", ".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := engine.Lookup("index")
+	if src, _ := page.PartialSource("header"); src != "views/_header.html" {
+		t.Errorf("engine: expected views/_header.html, got %q", src)
+	}
+}
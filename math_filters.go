@@ -0,0 +1,111 @@
+package fasttpl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ----------------------------- Numeric filters ------------------------------
+
+// The numeric filters take numbers of any Go numeric type as well as numeric
+// strings, and pass other input through unchanged. Results keep the input's
+// type when it can hold them, so an int stays an int.
+
+// absFilter returns the absolute value of a number.
+func absFilter(v any, _ []string) (any, error) {
+	if n, ok := numericString(v); ok {
+		v = n
+	}
+	i, f, isInt, ok := numberValue(v)
+	switch {
+	case !ok:
+		return v, nil
+	case isInt && i < 0:
+		return convertNumber(-i, v), nil
+	case !isInt && f < 0:
+		return convertNumber(-f, v), nil
+	}
+	return v, nil
+}
+
+// minFilter returns the smaller of a number and its argument, as in
+// {{ retries | min:3 }}.
+func minFilter(v any, args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("min: missing bound")
+	}
+	bound, err := numberArg("min", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return limit(v, bound, 1), nil
+}
+
+// maxFilter returns the larger of a number and its argument, as in
+// {{ balance | max:0 }}.
+func maxFilter(v any, args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("max: missing bound")
+	}
+	bound, err := numberArg("max", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return limit(v, bound, -1), nil
+}
+
+// clampFilter limits a number to the range given by its two arguments, as in
+// {{ percent | clamp:0:100 }}.
+func clampFilter(v any, args []string) (any, error) {
+	if len(args) < 2 {
+		return nil, errors.New("clamp: want lower and upper bounds")
+	}
+	lo, err := numberArg("clamp", args[0])
+	if err != nil {
+		return nil, err
+	}
+	hi, err := numberArg("clamp", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if c, _ := compareNumbers(lo, hi); c > 0 {
+		return nil, fmt.Errorf("clamp: lower bound %s above upper bound %s", args[0], args[1])
+	}
+	return limit(limit(v, lo, -1), hi, 1), nil
+}
+
+// numberArg parses the argument of a numeric filter.
+func numberArg(filter, arg string) (any, error) {
+	if n, ok := numericString(arg); ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("%s: invalid number %q", filter, arg)
+}
+
+// limit returns bound in place of v when v lies beyond it: above it for a
+// side of 1, below it for -1. Non-numeric input is returned as is.
+func limit(v, bound any, side int) any {
+	if n, ok := numericString(v); ok {
+		v = n
+	}
+	if c, ok := compareNumbers(v, bound); ok && c == side {
+		return convertNumber(bound, v)
+	}
+	return v
+}
+
+// convertNumber converts n to the type of like when that keeps its value, as
+// when an int64 bound replaces an int or uint8 input. Otherwise, such as for
+// a fractional bound and an integer input, n is returned unchanged.
+func convertNumber(n, like any) any {
+	rv, typ := reflect.ValueOf(n), reflect.TypeOf(like)
+	if rv.Type() == typ || !rv.CanConvert(typ) {
+		return n
+	}
+	converted := rv.Convert(typ).Interface()
+	if c, ok := compareNumbers(converted, n); ok && c == 0 {
+		return converted
+	}
+	return n
+}
@@ -1,11 +1,16 @@
 package fasttpl
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"maps"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // ----------------------------- AST & runtime --------------------------------
@@ -15,22 +20,98 @@ type node interface {
 }
 
 type renderCtx struct {
-	data       any
-	locals     map[string]any
-	parts      map[string]*Template
-	filters    Filters
-	fieldCache *fieldCache
+	data          any
+	fallbacks     []any // roots tried in order when a path misses data
+	locals        map[string]any
+	parts         map[string]*Template
+	filters       Filters
+	typedFilters  TypedFilters
+	writerFilters WriterFilters
+	extraFilters  Filters // layered over the others for one render by RenderWith
+	funcs         Funcs
+	escaper       func(string) string // nil means htmlEscapeFast
+	missing       func(path string) (string, bool)
+	translator    Translator
+	fieldCache    *fieldCache
+	fieldTag      string
+	strict        bool
+	maxDepth      int   // maximum include nesting
+	depth         int   // current include nesting
+	err           error // first error raised while evaluating an accessor
+	context       context.Context
+	done          <-chan struct{} // nil when the context can never be canceled
+	deadline      time.Time       // from WithRenderTimeout; zero for none
+	num           []byte          // scratch space for printing numbers
 }
 
-func (ctx *renderCtx) reset(data any, parts map[string]*Template, filters Filters, fc *fieldCache) {
+func (ctx *renderCtx) reset(data any, t *Template) {
 	ctx.data = data
+	ctx.fallbacks = ctx.fallbacks[:0]
+	if t.globals != nil {
+		ctx.fallbacks = append(ctx.fallbacks, t.globals)
+	}
 	// Clear locals map without reallocating
 	for k := range ctx.locals {
 		delete(ctx.locals, k)
 	}
-	ctx.parts = parts
-	ctx.filters = filters
-	ctx.fieldCache = fc
+	ctx.parts = t.parts.load()
+	ctx.filters = t.filt
+	ctx.typedFilters = t.typed
+	ctx.writerFilters = t.writers
+	ctx.extraFilters = nil
+	ctx.funcs = t.funcs
+	ctx.escaper = t.escaper
+	ctx.missing = t.missing
+	ctx.translator = t.translator
+	ctx.fieldCache = t.fieldCache
+	ctx.fieldTag = t.fieldTag
+	ctx.strict = t.strict
+	ctx.maxDepth = t.maxDepth
+	ctx.depth = 0
+	ctx.err = nil
+	ctx.context = nil
+	ctx.done = nil
+	ctx.deadline = time.Time{}
+	if t.timeout > 0 {
+		ctx.deadline = time.Now().Add(t.timeout)
+	}
+}
+
+// escape escapes s for HTML output with the template's escaper.
+func (ctx *renderCtx) escape(s string) string {
+	if ctx.escaper != nil {
+		return ctx.escaper(s)
+	}
+	return htmlEscapeFast(s)
+}
+
+// canceled returns ErrRenderTimeout once the render has run past its
+// deadline, and the context error once the render's context is done.
+func (ctx *renderCtx) canceled() error {
+	if !ctx.deadline.IsZero() && time.Now().After(ctx.deadline) {
+		return ErrRenderTimeout
+	}
+	if ctx.done == nil {
+		return nil
+	}
+	select {
+	case <-ctx.done:
+		return ctx.context.Err()
+	default:
+		return nil
+	}
+}
+
+// eval evaluates acc and returns any error raised along its path, such as a
+// failing method call.
+func (ctx *renderCtx) eval(acc accessor) (any, bool, error) {
+	v, ok := acc.get(ctx)
+	if ctx.err != nil {
+		err := ctx.err
+		ctx.err = nil
+		return nil, false, err
+	}
+	return v, ok, nil
 }
 
 type textNode struct{ text string }
@@ -46,10 +127,52 @@ type printNode struct {
 	pipes []pipe
 }
 
+// newPrintNode builds an output node. A trailing safe (or raw) pseudo-filter
+// turns off escaping for the final result of the pipeline.
+func newPrintNode(acc accessor, pipes []pipe, raw bool) (node, error) {
+	for i, p := range pipes {
+		if p.name != "safe" && p.name != "raw" {
+			continue
+		}
+		if i != len(pipes)-1 {
+			return nil, fmt.Errorf("filter %q must be the last in a pipeline", p.name)
+		}
+		pipes, raw = pipes[:i], true
+	}
+	if len(pipes) == 0 {
+		pipes = nil
+	}
+	return printNode{acc: acc, raw: raw, pipes: pipes}, nil
+}
+
 func (n printNode) render(ctx *renderCtx, w io.Writer) error {
-	v, ok := n.acc.get(ctx)
+	v, ok, err := ctx.eval(n.acc)
+	if err != nil {
+		return err
+	}
+	if !ok && ctx.missing != nil {
+		if a, isPath := n.acc.(boundAcc); isPath {
+			var text string
+			if text, ok = ctx.missing(a.path); ok {
+				v = text
+			}
+		}
+	}
 	if !ok {
-		return nil
+		if len(n.pipes) == 0 {
+			return nil
+		}
+		// Missing values still flow through filters (e.g. default) as ""
+		v = ""
+	}
+	if n.pipes == nil && (ctx.escaper == nil || n.raw) {
+		// Numbers never need HTML escaping, so write them without a builder.
+		// A custom escaper still sees them, since it may rewrite more than HTML
+		if b, ok := appendNumber(ctx.num[:0], v); ok {
+			ctx.num = b
+			_, err = w.Write(b)
+			return err
+		}
 	}
 
 	// Use pre-allocated string builder for filtering
@@ -57,27 +180,86 @@ func (n printNode) render(ctx *renderCtx, w io.Writer) error {
 	sb.Reset()
 	defer stringBuilderPool.Put(sb)
 
-	s := toStringFast(v, sb)
+	// A writer filter at the end of the pipeline writes the output itself
+	pipes := n.pipes
+	var last pipe
+	var wf func(io.Writer, string, []string) error
+	if k := len(pipes) - 1; k >= 0 {
+		if wf = pipes[k].writer(ctx); wf != nil {
+			last, pipes = pipes[k], pipes[:k]
+		}
+	}
 
-	for _, p := range n.pipes {
-		var err error
-		s, err = p.apply(ctx, s)
+	for _, p := range pipes {
+		v, err = p.apply(ctx, v, sb)
 		if err != nil {
 			return err
 		}
 	}
 
-	if n.raw {
-		_, err := io.WriteString(w, s)
+	if wf != nil {
+		args := last.args
+		if last.argAccs != nil {
+			args = last.resolveArgs(ctx, sb)
+		}
+		in := toStringFast(v, sb)
+		if n.raw {
+			return last.wrapErr(wf(w, in, args))
+		}
+		if ctx.escaper == nil {
+			return last.wrapErr(wf(htmlEscapeWriter{w: w}, in, args))
+		}
+		// A custom escaper needs the filter's whole output at once
+		var out strings.Builder
+		if err := wf(&out, in, args); err != nil {
+			return last.wrapErr(err)
+		}
+		_, err = io.WriteString(w, ctx.escaper(out.String()))
 		return err
 	}
 
-	// Use pooled buffer for HTML escaping
-	escaped := htmlEscapeFast(s)
-	_, err := io.WriteString(w, escaped)
+	_, safe := v.(SafeString)
+	s := toStringFast(v, sb)
+
+	if n.raw || safe {
+		_, err = io.WriteString(w, s)
+		return err
+	}
+
+	_, err = io.WriteString(w, ctx.escape(s))
+	return err
+}
+
+// constNode is a print tag on a literal whose output was worked out at
+// compile time. The tag itself is kept for renders with extra filters from
+// RenderWith, which may replace the filters it was folded with.
+type constNode struct {
+	text string
+	orig printNode
+}
+
+func (n constNode) render(ctx *renderCtx, w io.Writer) error {
+	if ctx.extraFilters != nil && len(n.orig.pipes) > 0 {
+		return n.orig.render(ctx, w)
+	}
+	_, err := io.WriteString(w, n.text)
 	return err
 }
 
+// appendNumber appends v formatted as toStringFast would when v is an int,
+// int64 or float64.
+func appendNumber(b []byte, v any) ([]byte, bool) {
+	switch x := v.(type) {
+	case int:
+		return strconv.AppendInt(b, int64(x), 10), true
+	case int64:
+		return strconv.AppendInt(b, x, 10), true
+	case float64:
+		return strconv.AppendFloat(b, x, 'g', -1, 64), true
+	}
+	return b, false
+}
+
 var stringBuilderPool = sync.Pool{
 	New: func() any { return &strings.Builder{} },
 }
@@ -89,7 +271,10 @@ type ifNode struct {
 }
 
 func (n ifNode) render(ctx *renderCtx, w io.Writer) error {
-	v, _ := n.cond.get(ctx)
+	v, _, err := ctx.eval(n.cond)
+	if err != nil {
+		return err
+	}
 	if truthyFast(v) {
 		return n.then.render(ctx, w)
 	}
@@ -99,139 +284,379 @@ func (n ifNode) render(ctx *renderCtx, w io.Writer) error {
 	return nil
 }
 
+// switchNode renders the body of the first case with a value equal to the
+// switch value, or the default when none matches.
+type switchNode struct {
+	value accessor
+	cases []switchCase
+	def   node
+}
+
+type switchCase struct {
+	values []any
+	body   node
+}
+
+func (n switchNode) render(ctx *renderCtx, w io.Writer) error {
+	v, _, err := ctx.eval(n.value)
+	if err != nil {
+		return err
+	}
+	for _, c := range n.cases {
+		for _, cv := range c.values {
+			if equalValues(v, cv) {
+				return c.body.render(ctx, w)
+			}
+		}
+	}
+	if n.def != nil {
+		return n.def.render(ctx, w)
+	}
+	return nil
+}
+
 type rangeNode struct {
 	iter accessor
 	item string
 	body node
+	els  node // rendered once when there is nothing to iterate
+}
+
+// Loop helper locals bound alongside the item variable in a range body.
+const (
+	localIndex = "index"
+	localFirst = "first"
+	localLast  = "last"
+)
+
+// savedLocal remembers a local shadowed by a range so it can be restored.
+type savedLocal struct {
+	val any
+	ok  bool
+}
+
+func (n rangeNode) saveLocals(ctx *renderCtx) [4]savedLocal {
+	var saved [4]savedLocal
+	for i, name := range [4]string{n.item, localIndex, localFirst, localLast} {
+		saved[i].val, saved[i].ok = ctx.locals[name]
+	}
+	return saved
+}
+
+func (n rangeNode) restoreLocals(ctx *renderCtx, saved [4]savedLocal) {
+	for i, name := range [4]string{n.item, localIndex, localFirst, localLast} {
+		if saved[i].ok {
+			ctx.locals[name] = saved[i].val
+		} else {
+			delete(ctx.locals, name)
+		}
+	}
+}
+
+// iteration binds the item and loop helper locals and renders the body once.
+func (n rangeNode) iteration(ctx *renderCtx, w io.Writer, item any, i, total int) error {
+	if err := ctx.canceled(); err != nil {
+		return err
+	}
+	ctx.locals[localIndex] = i
+	ctx.locals[localFirst] = i == 0
+	ctx.locals[localLast] = i == total-1
+	ctx.locals[n.item] = item
+	return n.body.render(ctx, w)
 }
 
 func (n rangeNode) render(ctx *renderCtx, w io.Writer) error {
-	v, _ := n.iter.get(ctx)
-	rv := reflect.ValueOf(v)
-
-	// Store original value for restoration
-	originalVal, hadOriginal := ctx.locals[n.item]
-
-	switch rv.Kind() {
-	case reflect.Slice, reflect.Array:
-		// Fast path for []any
-		if rv.Type().Elem() == reflect.TypeOf((*any)(nil)).Elem() {
-			slice := rv.Interface().([]any)
-			for i := 0; i < len(slice); i++ {
-				ctx.locals[n.item] = slice[i]
-				if err := n.body.render(ctx, w); err != nil {
-					// Restore original value
-					if hadOriginal {
-						ctx.locals[n.item] = originalVal
-					} else {
-						delete(ctx.locals, n.item)
-					}
-					return err
-				}
+	v, _, err := ctx.eval(n.iter)
+	if err != nil {
+		return err
+	}
+	// An integer n loops n times over 0..n-1
+	span, isSpan := v.(intSpan)
+	if !isSpan {
+		if count, ok := intValue(v); ok {
+			span, isSpan = intSpan{from: 0, to: count - 1}, true
+		}
+	}
+	// Loop over what a pointer refers to; a nil one loops zero times
+	rv, _ := indirect(reflect.ValueOf(v))
+
+	// Store original values for restoration
+	saved := n.saveLocals(ctx)
+
+	total := 0
+	switch kind := rv.Kind(); {
+	case isSpan:
+		if span.to >= span.from {
+			total = int(span.to - span.from + 1)
+		}
+		for i := 0; i < total && err == nil; i++ {
+			err = n.iteration(ctx, w, int(span.from)+i, i, total)
+		}
+	case kind == reflect.Slice || kind == reflect.Array:
+		total = rv.Len()
+		// Fast paths for []any and []map[string]any; named slice types,
+		// such as type S []any, and arrays take the generic loop
+		switch slice := rv.Interface().(type) {
+		case []any:
+			for i := 0; i < len(slice) && err == nil; i++ {
+				err = n.iteration(ctx, w, slice[i], i, len(slice))
 			}
-		} else if rv.Type().Elem() == reflect.TypeOf((*map[string]any)(nil)).Elem() {
-			slice := rv.Interface().([]map[string]any)
-			for i := 0; i < len(slice); i++ {
-				ctx.locals[n.item] = slice[i]
-				if err := n.body.render(ctx, w); err != nil {
-					// Restore original value
-					if hadOriginal {
-						ctx.locals[n.item] = originalVal
-					} else {
-						delete(ctx.locals, n.item)
-					}
-					return err
-				}
+		case []map[string]any:
+			for i := 0; i < len(slice) && err == nil; i++ {
+				err = n.iteration(ctx, w, slice[i], i, len(slice))
 			}
-		} else {
-			for i := 0; i < rv.Len(); i++ {
-				ctx.locals[n.item] = rv.Index(i).Interface()
-				if err := n.body.render(ctx, w); err != nil {
-					// Restore original value
-					if hadOriginal {
-						ctx.locals[n.item] = originalVal
-					} else {
-						delete(ctx.locals, n.item)
-					}
-					return err
-				}
+		default:
+			for i := 0; i < total && err == nil; i++ {
+				err = n.iteration(ctx, w, rv.Index(i).Interface(), i, total)
 			}
 		}
-	case reflect.Map:
+	case kind == reflect.Map:
 		// Fast path for map[string]any
-		if rv.Type().Key().Kind() == reflect.String && rv.Type().Elem() == reflect.TypeOf((*any)(nil)).Elem() {
-			m := rv.Interface().(map[string]any)
+		total = rv.Len()
+		i := 0
+		// Named map types, such as type M map[string]any, take the slow path
+		if m, ok := rv.Interface().(map[string]any); ok {
 			for _, v := range m {
-				ctx.locals[n.item] = v
-				if err := n.body.render(ctx, w); err != nil {
-					// Restore original value
-					if hadOriginal {
-						ctx.locals[n.item] = originalVal
-					} else {
-						delete(ctx.locals, n.item)
-					}
-					return err
+				if err = n.iteration(ctx, w, v, i, total); err != nil {
+					break
 				}
+				i++
 			}
 		} else {
-			for _, key := range rv.MapKeys() {
-				ctx.locals[n.item] = rv.MapIndex(key).Interface()
-				if err := n.body.render(ctx, w); err != nil {
-					// Restore original value
-					if hadOriginal {
-						ctx.locals[n.item] = originalVal
-					} else {
-						delete(ctx.locals, n.item)
-					}
-					return err
+			for iter := rv.MapRange(); iter.Next(); i++ {
+				if err = n.iteration(ctx, w, iter.Value().Interface(), i, total); err != nil {
+					break
 				}
 			}
 		}
 	}
 
-	// Restore original value
-	if hadOriginal {
-		ctx.locals[n.item] = originalVal
-	} else {
-		delete(ctx.locals, n.item)
+	// Restore original values
+	n.restoreLocals(ctx, saved)
+	if err == nil && total == 0 && n.els != nil {
+		return n.els.render(ctx, w)
 	}
-	return nil
+	return err
 }
 
 type letNode struct {
 	name string
 	acc  accessor
+	pos  *srcPos // position of the tag, for Lint
 }
 
 func (n letNode) render(ctx *renderCtx, _ io.Writer) error {
-	v, _ := n.acc.get(ctx)
+	v, _, err := ctx.eval(n.acc)
+	if err != nil {
+		return err
+	}
 	ctx.locals[n.name] = v
 	return nil
 }
 
 func (n withNode) render(ctx *renderCtx, w io.Writer) error {
-	v, ok := n.acc.get(ctx)
+	v, ok, err := ctx.eval(n.acc)
+	if err != nil {
+		return err
+	}
 	if !ok {
+		if n.els != nil {
+			return n.els.render(ctx, w)
+		}
 		return nil
 	}
+	if n.name != "" {
+		// with x as name binds a local and leaves the data as it is
+		saved, had := ctx.locals[n.name]
+		ctx.locals[n.name] = v
+		err = n.body.render(ctx, w)
+		if had {
+			ctx.locals[n.name] = saved
+		} else {
+			delete(ctx.locals, n.name)
+		}
+		return err
+	}
 	originalData := ctx.data
 	ctx.data = v
 	defer func() { ctx.data = originalData }()
 	return n.body.render(ctx, w)
 }
 
+// blockNode is a named section of a template. It renders in place like its
+// body, and RenderBlock can render it on its own.
+type blockNode struct {
+	name string
+	body node
+}
+
+func (n blockNode) render(ctx *renderCtx, w io.Writer) error {
+	return n.body.render(ctx, w)
+}
+
 type withNode struct {
 	acc  accessor
+	name string // local bound by with x as name; empty to make x the data
 	body node
+	els  node // rendered against the unchanged data when the path is missing
 }
 
-type includeNode struct{ name string }
+type includeNode struct {
+	name    string
+	nameAcc accessor       // evaluated to the partial name when not a quoted literal
+	data    accessor       // optional data root for the partial (include "x" with path)
+	params  []includeParam // named locals for the partial (include "x" key=value)
+}
+
+type includeParam struct {
+	name string
+	acc  accessor
+}
 
 func (n includeNode) render(ctx *renderCtx, w io.Writer) error {
-	p := ctx.parts[n.name]
+	name := n.name
+	if n.nameAcc != nil {
+		v, ok, err := ctx.eval(n.nameAcc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("include: partial name %s did not resolve", n.name)
+		}
+		var sb strings.Builder
+		name = toStringFast(v, &sb)
+	}
+	p := ctx.parts[name]
 	if p == nil {
-		return fmt.Errorf("include: partial %q not found", n.name)
+		if n.nameAcc != nil {
+			return fmt.Errorf("include: partial %q (from %s) not found%s", name, n.name, partialHint(name, ctx.parts))
+		}
+		return fmt.Errorf("include: partial %q not found%s", name, partialHint(name, ctx.parts))
+	}
+	if ctx.depth >= ctx.maxDepth {
+		return fmt.Errorf("include: recursion limit exceeded (%d) including %q", ctx.maxDepth, name)
 	}
+	ctx.depth++
+	defer func() { ctx.depth-- }()
+	if n.data == nil && len(n.params) == 0 {
+		return p.root.render(ctx, w)
+	}
+
+	// Evaluate everything against the caller's scope before binding
+	data := ctx.data
+	if n.data != nil {
+		v, _, err := ctx.eval(n.data)
+		if err != nil {
+			return err
+		}
+		data = v
+	}
+	saved := make([]savedLocal, len(n.params))
+	values := make([]savedLocal, len(n.params))
+	for i, param := range n.params {
+		v, ok, err := ctx.eval(param.acc)
+		if err != nil {
+			return err
+		}
+		values[i] = savedLocal{val: v, ok: ok}
+		saved[i].val, saved[i].ok = ctx.locals[param.name]
+	}
+
+	originalData := ctx.data
+	ctx.data = data
+	for i, param := range n.params {
+		// A missing value leaves the local unset rather than nil
+		if values[i].ok {
+			ctx.locals[param.name] = values[i].val
+		} else {
+			delete(ctx.locals, param.name)
+		}
+	}
+	err := p.root.render(ctx, w)
+	ctx.data = originalData
+	for i := len(n.params) - 1; i >= 0; i-- {
+		if saved[i].ok {
+			ctx.locals[n.params[i].name] = saved[i].val
+		} else {
+			delete(ctx.locals, n.params[i].name)
+		}
+	}
+	return err
+}
+
+// partialHint describes the registered partials for a "not found" error,
+// suggesting the one closest to name when it looks like a misspelling.
+func partialHint(name string, parts map[string]*Template) string {
+	if len(parts) == 0 {
+		return " (no partials are registered)"
+	}
+	names := slices.Sorted(maps.Keys(parts))
+	best, bestDist := "", max(2, len(name)/3)+1
+	for _, candidate := range names {
+		if d := editDistance(name, candidate); d < bestDist {
+			best, bestDist = candidate, d
+		}
+	}
+	if best != "" {
+		return fmt.Sprintf(" (did you mean %q? available: %s)", best, strings.Join(names, ", "))
+	}
+	return " (available: " + strings.Join(names, ", ") + ")"
+}
+
+// transNode prints the message a Translator has for a key, or the key itself
+// when there is no translator or no message, HTML-escaped.
+type transNode struct {
+	key    accessor
+	args   []accessor
+	params []includeParam // named placeholders, as in t "hello" name=user.name
+}
+
+func (n transNode) render(ctx *renderCtx, w io.Writer) error {
+	v, _, err := ctx.eval(n.key)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	key := toStringFast(v, &sb)
+	msg, ok := key, false
+	if ctx.translator != nil {
+		args := make([]any, len(n.args))
+		for i, arg := range n.args {
+			if args[i], _, err = ctx.eval(arg); err != nil {
+				return err
+			}
+		}
+		var params map[string]any
+		if len(n.params) > 0 {
+			params = make(map[string]any, len(n.params))
+			for _, param := range n.params {
+				if params[param.name], _, err = ctx.eval(param.acc); err != nil {
+					return err
+				}
+			}
+		}
+		if msg, ok = ctx.translator.Translate(key, args, params); !ok {
+			msg = key
+		}
+	}
+	_, err = io.WriteString(w, ctx.escape(msg))
+	return err
+}
+
+// yieldNode renders the page a layout wraps, or nothing when the template is
+// rendered on its own.
+type yieldNode struct{}
+
+func (yieldNode) render(ctx *renderCtx, w io.Writer) error {
+	p := ctx.parts[contentPartial]
+	if p == nil {
+		return nil
+	}
+	if ctx.depth >= ctx.maxDepth {
+		return fmt.Errorf("include: recursion limit exceeded (%d) including %q", ctx.maxDepth, contentPartial)
+	}
+	ctx.depth++
+	defer func() { ctx.depth-- }()
 	return p.root.render(ctx, w)
 }
 
@@ -239,6 +664,9 @@ type seqNode []node
 
 func (s seqNode) render(ctx *renderCtx, w io.Writer) error {
 	for _, n := range s {
+		if err := ctx.canceled(); err != nil {
+			return err
+		}
 		if err := n.render(ctx, w); err != nil {
 			return err
 		}
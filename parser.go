@@ -3,7 +3,9 @@ package fasttpl
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"unicode/utf8"
 )
 
 // ----------------------------- Parser ---------------------------------------
@@ -13,44 +15,432 @@ type parser struct {
 	i          int
 	leftDelim  string
 	rightDelim string
+	trimNext   bool // previous tag ended with a -}} trim marker
+	tagStart   int  // offset of the left delimiter of the last tag scanned
+	open       []openBlock
+	layout     *string         // from a {{ layout "name" }} or {{ layout none }} tag
+	blocks     map[string]node // bodies of {{ block "name" }} tags
+	// knownFilter reports whether a filter is registered; nil skips the
+	// check, leaving unknown filters to fail at render time
+	knownFilter func(name string) bool
 }
 
+// openBlock is an if, range, with or switch tag still waiting for its end.
+type openBlock struct {
+	name   string
+	offset int
+}
+
+// ParseError reports a syntax error along with where it occurred. Line and
+// Column are 1-based; Column counts characters from the start of the line.
+type ParseError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("template:%d:%d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// errorAt attaches the position of offset to err unless a nested tag has
+// already positioned it.
+func (p *parser) errorAt(offset int, err error) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return err
+	}
+	line, col := p.position(offset)
+	return &ParseError{Line: line, Column: col, Err: err}
+}
+
+// srcPos is where a tag starts in the template source. Filters and paths
+// carry the position of their tag so render errors can point at it.
+type srcPos struct{ line, col int }
+
+// at formats the position for appending to an error message, or returns ""
+// when it is unknown.
+func (pos *srcPos) at() string {
+	if pos == nil || pos.line == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" at template:%d:%d", pos.line, pos.col)
+}
+
+func (p *parser) position(offset int) (line, col int) {
+	before := p.src[:offset]
+	line = strings.Count(before, "\n") + 1
+	col = utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return line, col
+}
+
+// openBlockTag records that the tag just scanned opened a block. The returned
+// func closes it again.
+func (p *parser) openBlockTag(name string) func() {
+	p.open = append(p.open, openBlock{name: name, offset: p.tagStart})
+	return func() { p.open = p.open[:len(p.open)-1] }
+}
+
+// unclosed reports reaching the end of the source inside a block.
+func (p *parser) unclosed() error {
+	b := p.open[len(p.open)-1]
+	line, col := p.position(b.offset)
+	return p.errorAt(len(p.src), fmt.Errorf("unclosed %q opened at template:%d:%d", b.name, line, col))
+}
+
+// blockKeywords are the tags that continue or close an open block rather
+// than start something of their own, mapped to whether they take arguments.
+// The only argument else takes is an if condition, as an alias for elif.
+var blockKeywords = map[string]bool{
+	"end":     false,
+	"else":    true,
+	"elif":    true,
+	"case":    true,
+	"default": false,
+}
+
+// blockKeyword splits a block continuation tag like tagKeyword, reporting
+// else if cond as elif cond.
+func blockKeyword(tag string) (keyword, rest string, err error) {
+	keyword, rest = tagKeyword(tag)
+	if keyword != "else" || rest == "" {
+		return keyword, rest, nil
+	}
+	if next, cond := tagKeyword(rest); next == "if" {
+		return "elif", cond, nil
+	}
+	return "", "", errors.New(`else takes no arguments other than "if cond"`)
+}
+
+// tagKeyword splits a tag into its first word and the trimmed rest.
+func tagKeyword(tag string) (keyword, rest string) {
+	i := strings.IndexAny(tag, trimSpace)
+	if i < 0 {
+		return tag, ""
+	}
+	return tag[:i], fastTrim(tag[i:])
+}
+
+// isBlockContinuation reports whether tag is only valid inside an open block.
+// Keywords without arguments followed by something else, like "end x", are
+// ordinary tags.
+func isBlockContinuation(tag string) bool {
+	keyword, rest := tagKeyword(tag)
+	takesArgs, ok := blockKeywords[keyword]
+	return ok && (rest == "" || takesArgs)
+}
+
+// trimSpace is the whitespace removed by the {{- and -}} trim markers.
+const trimSpace = " \t\r\n"
+
+func isTrimSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\r' || c == '\n' }
+
 func (p *parser) eof() bool { return p.i >= len(p.src) }
 
+// nextTag scans past the next tag and returns the text preceding it along
+// with the trimmed tag body. found is false when the source holds no more
+// tags, in which case text is the remainder of the source. Comments
+// ({{# ... #}}) are consumed here and reported as an empty tag. Trim
+// markers ({{- and -}}) strip the whitespace around the tag from text.
+func (p *parser) nextTag() (text, tag string, found bool, err error) {
+	trimLeading := p.trimNext
+	p.trimNext = false
+	text, start := p.scanText()
+	if start == -1 {
+		p.i = len(p.src)
+		if trimLeading {
+			text = strings.TrimLeft(text, trimSpace)
+		}
+		return text, "", false, nil
+	}
+	if trimLeading {
+		text = strings.TrimLeft(text, trimSpace)
+	}
+	p.tagStart = start
+	p.i = start + len(p.leftDelim) // skip leftDelim
+	if p.i+1 < len(p.src) && p.src[p.i] == '-' && isTrimSpace(p.src[p.i+1]) {
+		text = strings.TrimRight(text, trimSpace)
+		p.i++
+	}
+	if strings.HasPrefix(p.src[p.i:], "#") {
+		end := strings.Index(p.src[p.i+1:], "#"+p.rightDelim)
+		if end == -1 {
+			return "", "", false, p.errorAt(p.tagStart, fmt.Errorf("unterminated comment (missing #%s)", p.rightDelim))
+		}
+		p.i += 1 + end + 1 + len(p.rightDelim)
+		return text, "", true, nil
+	}
+	// find end
+	end := strings.Index(p.src[p.i:], p.rightDelim)
+	if end == -1 {
+		return "", "", false, p.errorAt(p.tagStart, errors.New("unterminated tag"))
+	}
+	body := p.src[p.i : p.i+end]
+	if n := len(body); n >= 2 && body[n-1] == '-' && isTrimSpace(body[n-2]) {
+		body = body[:n-1]
+		p.trimNext = true
+	}
+	tag = fastTrim(body)
+	p.i += end + len(p.rightDelim)
+	return text, tag, true, nil
+}
+
+// scanText returns the text from p.i up to the next tag along with the
+// offset of the tag's left delimiter, or -1 when no tag follows. A backslash
+// just before a left delimiter escapes it, so \{{ is the text {{, while a
+// doubled backslash stands for one backslash ahead of a real tag.
+func (p *parser) scanText() (string, int) {
+	var b strings.Builder
+	from, i := p.i, p.i
+	text := func(end int) string {
+		if from == p.i {
+			return p.src[from:end] // no escapes
+		}
+		b.WriteString(p.src[from:end])
+		return b.String()
+	}
+	for {
+		at := strings.Index(p.src[i:], p.leftDelim)
+		if at == -1 {
+			return text(len(p.src)), -1
+		}
+		at += i
+		if at == from || p.src[at-1] != '\\' {
+			return text(at), at
+		}
+		if at-2 >= from && p.src[at-2] == '\\' {
+			return text(at - 1), at
+		}
+		b.WriteString(p.src[from : at-1])
+		from, i = at, at+len(p.leftDelim)
+	}
+}
+
 func (p *parser) parse() ([]node, error) {
-	nodes := make([]node, 0, 16) // pre-allocate
+	nodes, _, _, err := p.parseBlock()
+	return nodes, err
+}
+
+// parseBlock parses nodes up to the first tag among terminators, such as
+// "end" or "else", and returns them along with the terminator's keyword and
+// the rest of its tag. Without terminators it parses the whole source. Any
+// other block keyword is an error, as is reaching the end of the source
+// inside an open block.
+func (p *parser) parseBlock(terminators ...string) (nodes []node, term, rest string, err error) {
+	nodes = make([]node, 0, 8)
 	for !p.eof() {
-		// find next tag
-		start := strings.Index(p.src[p.i:], p.leftDelim)
-		if start == -1 {
-			// rest is text
-			if p.i < len(p.src) {
-				nodes = append(nodes, textNode{text: p.src[p.i:]})
-			}
-			p.i = len(p.src)
+		text, tag, found, err := p.nextTag()
+		if err != nil {
+			return nil, "", "", err
+		}
+		if text != "" {
+			nodes = append(nodes, textNode{text: text})
+		}
+		if !found {
 			break
 		}
-		if start > 0 {
-			nodes = append(nodes, textNode{text: p.src[p.i : p.i+start]})
+		if isBlockContinuation(tag) {
+			keyword, rest, err := blockKeyword(tag)
+			if err != nil {
+				return nil, "", "", p.errorAt(p.tagStart, err)
+			}
+			if err := p.checkFilters(tag); err != nil {
+				return nil, "", "", err
+			}
+			if slices.Contains(terminators, keyword) {
+				return nodes, keyword, rest, nil
+			}
+			if len(p.open) == 0 {
+				return nil, "", "", p.errorAt(p.tagStart, fmt.Errorf("unexpected %q with no open block", keyword))
+			}
+			b := p.open[len(p.open)-1]
+			return nil, "", "", p.errorAt(p.tagStart, fmt.Errorf("unexpected %q in %q block", keyword, b.name))
 		}
-		p.i += start + len(p.leftDelim) // skip leftDelim
-		// find end
-		end := strings.Index(p.src[p.i:], p.rightDelim)
-		if end == -1 {
-			return nil, errors.New("unterminated tag")
+		if err := p.checkFilters(tag); err != nil {
+			return nil, "", "", err
 		}
-		tag := fastTrim(p.src[p.i : p.i+end])
-		p.i += end + len(p.rightDelim)
 		// dispatch tag
+		start := p.tagStart
 		n, err := p.parseTag(tag)
 		if err != nil {
-			return nil, err
+			return nil, "", "", p.errorAt(start, err)
 		}
 		if n != nil {
+			p.positionNode(n, start)
 			nodes = append(nodes, n)
 		}
 	}
-	return nodes, nil
+	if len(p.open) > 0 {
+		return nil, "", "", p.unclosed()
+	}
+	return nodes, "", "", nil
+}
+
+// checkFilters reports the first filter named in the tag just scanned that
+// knownFilter rejects, positioned at the filter's name. Filters are the
+// names following each | outside quoted literals.
+func (p *parser) checkFilters(tag string) error {
+	if p.knownFilter == nil {
+		return nil
+	}
+	offset := p.tagStart + strings.Index(p.src[p.tagStart:], tag)
+	inQuote := byte(0)
+	for i := 0; i < len(tag); i++ {
+		switch c := tag[i]; {
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == '|':
+			start := i + 1
+			for start < len(tag) && isSpace(tag[start]) {
+				start++
+			}
+			end := start
+			for end < len(tag) && !isSpace(tag[end]) && !strings.ContainsRune(":|,)", rune(tag[end])) {
+				end++
+			}
+			if name := tag[start:end]; name != "" && !p.knownFilter(name) {
+				return p.errorAt(offset+start, fmt.Errorf("unknown filter %q", name))
+			}
+		}
+	}
+	return nil
+}
+
+// positionNode records the position of the tag at offset on the filters and
+// paths compiled from it. Block bodies are left alone, since their nodes
+// come from tags of their own.
+func (p *parser) positionNode(n node, offset int) {
+	var pos srcPos
+	pos.line, pos.col = p.position(offset)
+	switch n := n.(type) {
+	case printNode:
+		positionAccessor(n.acc, pos)
+		positionPipes(n.pipes, pos)
+	case ifNode:
+		positionAccessor(n.cond, pos)
+	case rangeNode:
+		positionAccessor(n.iter, pos)
+	case switchNode:
+		positionAccessor(n.value, pos)
+	case letNode:
+		*n.pos = pos
+		positionAccessor(n.acc, pos)
+	case withNode:
+		positionAccessor(n.acc, pos)
+	case transNode:
+		positionAccessor(n.key, pos)
+		for _, arg := range n.args {
+			positionAccessor(arg, pos)
+		}
+		for _, param := range n.params {
+			positionAccessor(param.acc, pos)
+		}
+	case includeNode:
+		positionAccessor(n.nameAcc, pos)
+		positionAccessor(n.data, pos)
+		for _, param := range n.params {
+			positionAccessor(param.acc, pos)
+		}
+	}
+}
+
+func positionAccessor(acc accessor, pos srcPos) {
+	switch a := acc.(type) {
+	case boundAcc:
+		if a.pos != nil {
+			*a.pos = pos
+		}
+	case compareAcc:
+		positionAccessor(a.left, pos)
+		positionAccessor(a.right, pos)
+	case andAcc:
+		for _, term := range a {
+			positionAccessor(term, pos)
+		}
+	case orAcc:
+		for _, term := range a {
+			positionAccessor(term, pos)
+		}
+	case notAcc:
+		positionAccessor(a.acc, pos)
+	case pipeAcc:
+		positionAccessor(a.acc, pos)
+		positionPipes(a.pipes, pos)
+	case spanAcc:
+		positionAccessor(a.from, pos)
+		positionAccessor(a.to, pos)
+	case ternaryAcc:
+		positionAccessor(a.cond, pos)
+		positionAccessor(a.then, pos)
+		positionAccessor(a.els, pos)
+	case callAcc:
+		for _, arg := range a.args {
+			positionAccessor(arg, pos)
+		}
+	case coalesceAcc:
+		for _, op := range a {
+			positionAccessor(op, pos)
+		}
+	case indexAcc:
+		for _, op := range a {
+			positionAccessor(op, pos)
+		}
+	}
+}
+
+func positionPipes(pipes []pipe, pos srcPos) {
+	for i := range pipes {
+		pipes[i].pos = pos
+	}
+}
+
+// parseNamedBlock parses the body of a block tag up to its end and records
+// it under name.
+func (p *parser) parseNamedBlock(name string) (node, error) {
+	defer p.openBlockTag("block")()
+	bodyNodes, _, _, err := p.parseBlock("end")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.blocks[name]; ok {
+		return nil, fmt.Errorf("block %q: declared more than once", name)
+	}
+	if p.blocks == nil {
+		p.blocks = make(map[string]node)
+	}
+	body := sequence(bodyNodes)
+	p.blocks[name] = body
+	return blockNode{name: name, body: body}, nil
+}
+
+// parseBodyAndElse parses a block body up to its end along with an optional
+// else branch, which holds the nodes after {{ else }} or, for {{ elif }},
+// the ifNode chain it starts.
+func (p *parser) parseBodyAndElse() (body, els []node, err error) {
+	body, term, rest, err := p.parseBlock("end", "else", "elif")
+	if err != nil {
+		return nil, nil, err
+	}
+	switch term {
+	case "else":
+		els, _, _, err = p.parseBlock("end")
+	case "elif":
+		// elif consumes the rest of the chain, including the final end
+		start := p.tagStart
+		elif, err := p.parseIf(rest)
+		if err != nil {
+			return nil, nil, p.errorAt(start, err)
+		}
+		p.positionNode(elif, start)
+		els = []node{elif}
+	}
+	return body, els, err
 }
 
 func (p *parser) parseTag(tag string) (node, error) {
@@ -65,19 +455,26 @@ func (p *parser) parseTag(tag string) (node, error) {
 		if err != nil {
 			return nil, err
 		}
-		return printNode{acc: acc, raw: true, pipes: pipes}, nil
-	case "if":
-		condExpr := fastTrim(strings.TrimPrefix(tag, "if"))
-		cond, _, err := compileAccessor(condExpr)
-		if err != nil {
-			return nil, err
+		return newPrintNode(acc, pipes, true)
+	case "yield":
+		if len(fields) == 1 {
+			return yieldNode{}, nil
 		}
-		// parse until {{ end }} or {{ else }}
-		thenNodes, elseNodes, err := p.parseUntilElseOrEnd()
-		if err != nil {
-			return nil, err
+	case "layout":
+		if len(fields) == 2 && (fields[1] == "none" || fields[1][0] == '"' || fields[1][0] == '\'') {
+			if p.layout != nil {
+				return nil, errors.New("layout: declared more than once")
+			}
+			name := unquote(fields[1])
+			if fields[1] == "none" {
+				name = ""
+			}
+			p.layout = &name
+			return nil, nil
 		}
-		return ifNode{cond: cond, then: sequence(thenNodes), els: sequence(elseNodes)}, nil
+	case "if":
+		defer p.openBlockTag("if")()
+		return p.parseIf(fastTrim(strings.TrimPrefix(tag, "if")))
 	case "range":
 		// syntax: range item in path
 		rest := fastTrim(strings.TrimPrefix(tag, "range"))
@@ -85,17 +482,24 @@ func (p *parser) parseTag(tag string) (node, error) {
 		if inIdx == -1 {
 			return nil, fmt.Errorf("range syntax: range item in path")
 		}
+		defer p.openBlockTag("range")()
 		item := fastTrim(rest[:inIdx])
-		pathExpr := fastTrim(rest[inIdx+4:])
-		acc, _, err := compileAccessor(pathExpr)
+		// The iterable may be filtered, as in range u in users | sortby:"name",
+		// or a span of integers, as in range i in 1..pages
+		acc, err := compileIterable(fastTrim(rest[inIdx+4:]))
 		if err != nil {
 			return nil, err
 		}
-		bodyNodes, err := p.parseUntilEnd()
+		// parse until {{ end }}, with an optional {{ else }} for empty input
+		bodyNodes, elseNodes, err := p.parseBodyAndElse()
 		if err != nil {
 			return nil, err
 		}
-		return rangeNode{iter: acc, item: item, body: sequence(bodyNodes)}, nil
+		n := rangeNode{iter: acc, item: item, body: sequence(bodyNodes)}
+		if len(elseNodes) > 0 {
+			n.els = sequence(elseNodes)
+		}
+		return n, nil
 	case "let":
 		// let name = path
 		rest := fastTrim(strings.TrimPrefix(tag, "let"))
@@ -108,92 +512,198 @@ func (p *parser) parseTag(tag string) (node, error) {
 		if err != nil {
 			return nil, err
 		}
-		return letNode{name: name, acc: acc}, nil
+		return letNode{name: name, acc: acc, pos: new(srcPos)}, nil
+	case "switch":
+		defer p.openBlockTag("switch")()
+		return p.parseSwitch(fastTrim(strings.TrimPrefix(tag, "switch")))
+	case "block":
+		// block "name" renders its body in place; RenderBlock renders it alone
+		if len(fields) == 2 && (fields[1][0] == '"' || fields[1][0] == '\'') {
+			return p.parseNamedBlock(unquote(fields[1]))
+		}
 	case "with":
+		defer p.openBlockTag("with")()
+		// with path, or with path as name to bind a local instead
 		rest := fastTrim(strings.TrimPrefix(tag, "with"))
+		var name string
+		if i := strings.LastIndex(rest, " as "); i >= 0 && isIdent(fastTrim(rest[i+4:])) {
+			rest, name = fastTrim(rest[:i]), fastTrim(rest[i+4:])
+		}
 		acc, _, err := compileAccessor(rest)
 		if err != nil {
 			return nil, err
 		}
-		bodyNodes, err := p.parseUntilEnd()
+		// parse until {{ end }}, with an optional {{ else }} for a missing path
+		bodyNodes, elseNodes, err := p.parseBodyAndElse()
 		if err != nil {
 			return nil, err
 		}
-		return withNode{acc: acc, body: sequence(bodyNodes)}, nil
+		n := withNode{acc: acc, name: name, body: sequence(bodyNodes)}
+		if len(elseNodes) > 0 {
+			n.els = sequence(elseNodes)
+		}
+		return n, nil
+	case "t", "trans":
+		// t "key" [arg ...] [name=value ...]; other uses of a t variable,
+		// such as {{ t | upper }}, are ordinary expressions
+		if len(fields) >= 2 && (fields[1][0] == '"' || fields[1][0] == '\'' || isPathArg(fields[1])) {
+			return parseTrans(fields[1:])
+		}
 	case "include":
+		// include "name" [with path] [key=value ...]
 		if len(fields) < 2 {
 			return nil, fmt.Errorf("include syntax: include \"name\"")
 		}
-		name := unquote(fields[1])
-		return includeNode{name: name}, nil
-	default:
-		// treat as expression
-		acc, pipes, err := compileAccessor(tag)
-		if err != nil {
-			return nil, err
+		n := includeNode{name: unquote(fields[1])}
+		if c := fields[1][0]; c != '"' && c != '\'' {
+			// Unquoted names are evaluated at render time
+			acc, err := compileOperand(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			n.nameAcc = acc
 		}
-		return printNode{acc: acc, raw: false, pipes: pipes}, nil
+		for i := 2; i < len(fields); i++ {
+			if fields[i] == "with" {
+				if i+1 >= len(fields) || n.data != nil {
+					return nil, fmt.Errorf("include syntax: include \"name\" with path")
+				}
+				i++
+				acc, err := compileOperand(fields[i])
+				if err != nil {
+					return nil, err
+				}
+				n.data = acc
+				continue
+			}
+			key, val, ok := strings.Cut(fields[i], "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("include syntax: unexpected %q, want key=value", fields[i])
+			}
+			acc, err := compileOperand(val)
+			if err != nil {
+				return nil, err
+			}
+			n.params = append(n.params, includeParam{name: key, acc: acc})
+		}
+		return n, nil
+	}
+	// treat as expression
+	acc, pipes, err := compileAccessor(tag)
+	if err != nil {
+		return nil, err
 	}
+	return newPrintNode(acc, pipes, false)
 }
 
-func (p *parser) parseUntilEnd() ([]node, error) {
-	nodes := make([]node, 0, 8)
-	for !p.eof() {
-		start := strings.Index(p.src[p.i:], p.leftDelim)
-		if start == -1 {
-			return nil, fmt.Errorf("unterminated block (missing %s end %s)", p.leftDelim, p.rightDelim)
-		}
-		if start > 0 {
-			nodes = append(nodes, textNode{text: p.src[p.i : p.i+start]})
+// parseIf compiles the condition of an if (or elif) tag and parses its body
+// up to the matching end. An elif branch becomes a nested ifNode in els.
+func (p *parser) parseIf(condExpr string) (node, error) {
+	if condExpr == "" {
+		return nil, errors.New("if syntax: missing condition")
+	}
+	cond, err := compileCond(condExpr)
+	if err != nil {
+		return nil, err
+	}
+	// parse until {{ end }}, {{ else }} or {{ elif }}
+	thenNodes, elseNodes, err := p.parseBodyAndElse()
+	if err != nil {
+		return nil, err
+	}
+	n := ifNode{cond: cond, then: sequence(thenNodes)}
+	if len(elseNodes) > 0 {
+		n.els = sequence(elseNodes)
+	}
+	return n, nil
+}
+
+// parseSwitch compiles the value of a switch tag and parses its case and
+// default branches up to the matching end. Only whitespace and comments may
+// come before the first case.
+func (p *parser) parseSwitch(expr string) (node, error) {
+	if expr == "" {
+		return nil, errors.New("switch syntax: missing value")
+	}
+	acc, err := compileOperand(expr)
+	if err != nil {
+		return nil, err
+	}
+	n := switchNode{value: acc}
+	nodes, term, rest, err := p.parseBlock("case", "default", "end")
+	if err != nil {
+		return nil, err
+	}
+	for _, nd := range nodes {
+		if t, ok := nd.(textNode); !ok || fastTrim(t.text) != "" {
+			return nil, errors.New("switch: only case and default may follow switch")
 		}
-		p.i += start + len(p.leftDelim)
-		end := strings.Index(p.src[p.i:], p.rightDelim)
-		if end == -1 {
-			return nil, errors.New("unterminated tag")
+	}
+	for term == "case" {
+		start := p.tagStart
+		values, err := parseCaseValues(rest)
+		if err != nil {
+			return nil, p.errorAt(start, err)
 		}
-		tag := fastTrim(p.src[p.i : p.i+end])
-		p.i += end + len(p.rightDelim)
-		if tag == "end" {
-			return nodes, nil
+		if nodes, term, rest, err = p.parseBlock("case", "default", "end"); err != nil {
+			return nil, err
 		}
-		n, err := p.parseTag(tag)
-		if err != nil {
+		n.cases = append(n.cases, switchCase{values: values, body: sequence(nodes)})
+	}
+	if term == "default" {
+		// default comes last, so a later case is an error
+		if nodes, _, _, err = p.parseBlock("end"); err != nil {
 			return nil, err
 		}
-		nodes = append(nodes, n)
+		n.def = sequence(nodes)
 	}
-	return nil, fmt.Errorf("unterminated block (missing %s end %s)", p.leftDelim, p.rightDelim)
+	return n, nil
 }
 
-func (p *parser) parseUntilElseOrEnd() (thenNodes []node, elseNodes []node, err error) {
-	thenNodes = make([]node, 0, 8)
-	for !p.eof() {
-		start := strings.Index(p.src[p.i:], p.leftDelim)
-		if start == -1 {
-			return nil, nil, fmt.Errorf("unterminated if (missing %s end %s)", p.leftDelim, p.rightDelim)
+// parseCaseValues parses the comma-separated literals of a case tag.
+func parseCaseValues(expr string) ([]any, error) {
+	var values []any
+	for {
+		i := indexUnquoted(expr, ',')
+		part := expr
+		if i >= 0 {
+			part = expr[:i]
 		}
-		if start > 0 {
-			thenNodes = append(thenNodes, textNode{text: p.src[p.i : p.i+start]})
+		part = fastTrim(part)
+		v, ok := parseLiteral(part)
+		if !ok {
+			return nil, fmt.Errorf("case: %q is not a literal", part)
 		}
-		p.i += start + len(p.leftDelim)
-		end := strings.Index(p.src[p.i:], p.rightDelim)
-		if end == -1 {
-			return nil, nil, errors.New("unterminated tag")
-		}
-		tag := fastTrim(p.src[p.i : p.i+end])
-		p.i += end + len(p.rightDelim)
-		if tag == "end" {
-			return thenNodes, nil, nil
+		values = append(values, v)
+		if i < 0 {
+			return values, nil
 		}
-		if tag == "else" {
-			elseNodes, err = p.parseUntilEnd()
-			return thenNodes, elseNodes, err
+		expr = expr[i+1:]
+	}
+}
+
+// parseTrans compiles the key and arguments of a t or trans tag. Arguments
+// written name=value are named, the others positional.
+func parseTrans(fields []string) (node, error) {
+	key, err := compileOperand(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	n := transNode{key: key}
+	for _, f := range fields[1:] {
+		if name, val, ok := strings.Cut(f, "="); ok && isIdent(name) {
+			acc, err := compileOperand(val)
+			if err != nil {
+				return nil, err
+			}
+			n.params = append(n.params, includeParam{name: name, acc: acc})
+			continue
 		}
-		n, err := p.parseTag(tag)
+		acc, err := compileOperand(f)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		thenNodes = append(thenNodes, n)
+		n.args = append(n.args, acc)
 	}
-	return nil, nil, fmt.Errorf("unterminated if block (missing %s end %s)", p.leftDelim, p.rightDelim)
+	return n, nil
 }
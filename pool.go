@@ -1,6 +1,7 @@
 package fasttpl
 
 import (
+	"bufio"
 	"bytes"
 	"io"
 	"sync"
@@ -10,10 +11,33 @@ import (
 
 var bufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
 
+// AcquireBuffer returns an empty buffer from the pool shared with the
+// engine. The caller owns it until passing it to ReleaseBuffer, and can
+// render into it any number of times with RenderBuffer.
+func AcquireBuffer() *bytes.Buffer {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// ReleaseBuffer returns buf to the pool. Neither buf nor any slice obtained
+// from buf.Bytes may be used after it is released; copy out anything that
+// must outlive it first.
+func ReleaseBuffer(buf *bytes.Buffer) {
+	if buf == nil {
+		return
+	}
+	bufPool.Put(buf)
+}
+
+// bufioPool holds the writers RenderFlush buffers output in.
+var bufioPool = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}
+
 var renderCtxPool = sync.Pool{
 	New: func() any {
 		return &renderCtx{
 			locals: make(map[string]any, 16), // pre-allocate common size
+			num:    make([]byte, 0, 32),
 		}
 	},
 }
@@ -2,11 +2,14 @@ package fasttpl
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // ----------------------------- Template Reload Manager -----------------------------
@@ -14,20 +17,71 @@ import (
 // ReloadCallback is called when a template file is reloaded
 type ReloadCallback func(filename string, template *Template, err error)
 
+// ReloadEvent reports a template reload, or the error that prevented it.
+type ReloadEvent struct {
+	Filename string
+	Template *Template // nil when Err is set
+	Err      error
+	Time     time.Time
+}
+
+// reloadEventBuffer is how many events Events holds for a slow reader
+// before further events are dropped.
+const reloadEventBuffer = 64
+
 // ReloadManager manages automatic template reloading
 type ReloadManager struct {
 	mu            sync.RWMutex
 	watched       map[string]*watchInfo
 	callbacks     []ReloadCallback
+	events        chan ReloadEvent
 	stopChan      chan struct{}
 	stopped       bool
 	checkInterval time.Duration
+
+	// watcher delivers file system events. It is created by the first
+	// WatchFile before Start, and again when Start follows Stop; when nil
+	// (e.g. the platform has no notification support) the manager polls every
+	// checkInterval instead.
+	watcher     *fsnotify.Watcher
+	started     bool
+	watchedDirs map[string]*dirWatch
+	pending     map[string]*time.Timer // debounced reloads by filename
 }
 
+// dirWatch records how a watched directory was registered. Directories
+// registered only for the files in them have a nil entry.
+type dirWatch struct {
+	recursive bool     // watch new templates and subdirectories too
+	ignore    []string // filepath.Match patterns for directory names to skip
+	opts      []Option
+	patterns  []string // from WithPatterns among opts
+}
+
+// selects reports whether the file called name is a template to watch.
+func (dw *dirWatch) selects(name string) bool {
+	return selectFile(dw.patterns, name, isTemplateFile)
+}
+
+// ignored reports whether a directory called name matches an ignore pattern.
+func (dw *dirWatch) ignored(name string) bool {
+	for _, pattern := range dw.ignore {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadDebounce is how long a file must stay quiet after an event before it
+// is reloaded, so that one save producing several events reloads once.
+const reloadDebounce = 100 * time.Millisecond
+
 type watchInfo struct {
 	lastModTime time.Time
 	template    *Template
 	dependents  map[string]bool // files that depend on this template
+	opts        []Option        // used again whenever the file is recompiled
 }
 
 // NewReloadManager creates a new reload manager
@@ -38,32 +92,121 @@ func NewReloadManager(checkInterval time.Duration) *ReloadManager {
 	return &ReloadManager{
 		watched:       make(map[string]*watchInfo),
 		callbacks:     make([]ReloadCallback, 0),
+		events:        make(chan ReloadEvent, reloadEventBuffer),
 		stopChan:      make(chan struct{}),
 		checkInterval: checkInterval,
+		watchedDirs:   make(map[string]*dirWatch),
+		pending:       make(map[string]*time.Timer),
 	}
 }
 
 // WatchFile adds a file to be watched for changes
 func (rm *ReloadManager) WatchFile(filename string, template *Template) error {
+	return rm.watchFile(filename, template, nil)
+}
+
+// watchFile watches filename, recompiling it with opts when it changes.
+func (rm *ReloadManager) watchFile(filename string, template *Template, opts []Option) error {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
+	filename = filepath.Clean(filename)
 	info, err := os.Stat(filename)
 	if err != nil {
 		return fmt.Errorf("watching file %q: %w", filename, err)
 	}
 
+	// Watch the directory rather than the file so that editors which save
+	// by replacing the file keep being observed.
+	if err := rm.watchDirLocked(filepath.Dir(filename), nil); err != nil {
+		return err
+	}
+
+	// Keep the dependents recorded by templates that include this file
+	dependents := make(map[string]bool)
+	if old, ok := rm.watched[filename]; ok {
+		dependents = old.dependents
+	}
 	rm.watched[filename] = &watchInfo{
 		lastModTime: info.ModTime(),
 		template:    template,
-		dependents:  make(map[string]bool),
+		dependents:  dependents,
+		opts:        opts,
 	}
+	rm.addDependentsLocked(filename, template, opts)
 
 	return nil
 }
 
+// addDependentsLocked records filename as a dependent of the partial files
+// its template discovered, watching those files if they aren't already. Such
+// partials are recompiled with the options of the template that found them.
+func (rm *ReloadManager) addDependentsLocked(filename string, tmpl *Template, opts []Option) {
+	if tmpl == nil {
+		return
+	}
+	for _, partial := range tmpl.partialFiles {
+		partial = filepath.Clean(partial)
+		info, ok := rm.watched[partial]
+		if !ok {
+			stat, err := os.Stat(partial)
+			if err != nil || rm.watchDirLocked(filepath.Dir(partial), nil) != nil {
+				continue
+			}
+			info = &watchInfo{
+				lastModTime: stat.ModTime(),
+				dependents:  make(map[string]bool),
+				opts:        opts,
+			}
+			rm.watched[partial] = info
+		}
+		info.dependents[filename] = true
+	}
+}
+
+// watchDirLocked subscribes to events for dir, creating the watcher on first
+// use. dw replaces an existing registration only when it is non-nil.
+func (rm *ReloadManager) watchDirLocked(dir string, dw *dirWatch) error {
+	if rm.watcher == nil && !rm.started && !rm.stopped {
+		rm.watcher = newWatcher(nil)
+	}
+	if _, ok := rm.watchedDirs[dir]; !ok && rm.watcher != nil {
+		if err := rm.watcher.Add(dir); err != nil {
+			return fmt.Errorf("watching directory %q: %w", dir, err)
+		}
+	}
+	if _, ok := rm.watchedDirs[dir]; !ok || dw != nil {
+		rm.watchedDirs[dir] = dw
+	}
+	return nil
+}
+
+// newWatcher returns a watcher subscribed to dirs, or nil if the platform
+// has no notification support. Directories that can no longer be watched
+// are skipped.
+func newWatcher(dirs map[string]*dirWatch) *fsnotify.Watcher {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil
+	}
+	for dir := range dirs {
+		w.Add(dir)
+	}
+	return w
+}
+
+// isTemplateFile reports whether name has one of the template extensions
+// watched by default
+func isTemplateFile(name string) bool {
+	return strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".tpl")
+}
+
 // WatchDirectory watches a directory for template files
 func (rm *ReloadManager) WatchDirectory(dir string, opts ...Option) error {
+	patterns := newCompileOptions(opts).patterns
+	if err := checkPatterns(patterns); err != nil {
+		return err
+	}
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return fmt.Errorf("reading directory %q: %w", dir, err)
@@ -75,7 +218,7 @@ func (rm *ReloadManager) WatchDirectory(dir string, opts ...Option) error {
 		}
 
 		name := entry.Name()
-		if strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".tpl") {
+		if selectFile(patterns, name, isTemplateFile) {
 			filename := filepath.Join(dir, name)
 			tmpl, err := CompileFile(filename, opts...)
 			if err != nil {
@@ -83,7 +226,7 @@ func (rm *ReloadManager) WatchDirectory(dir string, opts ...Option) error {
 				continue
 			}
 
-			err = rm.WatchFile(filename, tmpl)
+			err = rm.watchFile(filename, tmpl, opts)
 			if err != nil {
 				return err
 			}
@@ -93,6 +236,98 @@ func (rm *ReloadManager) WatchDirectory(dir string, opts ...Option) error {
 	return nil
 }
 
+// WatchDirectoryRecursive is like WatchDirectory but also watches the
+// templates in every subdirectory. With file system notifications, templates
+// and subdirectories created later are picked up as well and reported to the
+// callbacks. Subdirectories whose name matches one of the ignore patterns
+// (filepath.Match syntax, e.g. "node_modules" or ".*") are skipped.
+func (rm *ReloadManager) WatchDirectoryRecursive(dir string, ignore []string, opts ...Option) error {
+	dw := &dirWatch{recursive: true, ignore: ignore, opts: opts, patterns: newCompileOptions(opts).patterns}
+	if err := checkPatterns(dw.patterns); err != nil {
+		return err
+	}
+	return rm.watchTree(filepath.Clean(dir), dw, nil)
+}
+
+// watchTree compiles and watches the templates under root, calling added
+// (when non-nil) for each one.
+func (rm *ReloadManager) watchTree(root string, dw *dirWatch, added func(string, *Template)) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && dw.ignored(d.Name()) {
+				return filepath.SkipDir
+			}
+			rm.mu.Lock()
+			defer rm.mu.Unlock()
+			return rm.watchDirLocked(path, dw)
+		}
+		if !dw.selects(d.Name()) {
+			return nil
+		}
+		tmpl, err := CompileFile(path, dw.opts...)
+		if err != nil {
+			// Skip files that can't be compiled
+			return nil
+		}
+		if err := rm.watchFile(path, tmpl, dw.opts); err != nil {
+			return err
+		}
+		if added != nil {
+			added(path, tmpl)
+		}
+		return nil
+	})
+}
+
+// discover starts watching a file or directory created inside a recursively
+// watched directory.
+func (rm *ReloadManager) discover(name string) {
+	rm.mu.RLock()
+	dw := rm.watchedDirs[filepath.Dir(name)]
+	_, known := rm.watched[name]
+	rm.mu.RUnlock()
+	if dw == nil || !dw.recursive || known {
+		return
+	}
+
+	stat, err := os.Stat(name)
+	if err != nil || (stat.IsDir() && dw.ignored(stat.Name())) {
+		return
+	}
+	if !stat.IsDir() && !dw.selects(stat.Name()) {
+		return
+	}
+	rm.watchTree(name, dw, func(filename string, tmpl *Template) {
+		rm.notify(filename, tmpl, nil)
+	})
+}
+
+// notify reports a loaded template, or the error loading it, to the
+// callbacks and the events channel.
+func (rm *ReloadManager) notify(filename string, tmpl *Template, err error) {
+	rm.mu.RLock()
+	callbacks := rm.callbacks
+	rm.mu.RUnlock()
+	for _, callback := range callbacks {
+		callback(filename, tmpl, err)
+	}
+	select {
+	case rm.events <- ReloadEvent{Filename: filename, Template: tmpl, Err: err, Time: time.Now()}:
+	default:
+		// Nobody is keeping up with the channel; don't stall the watcher
+	}
+}
+
+// Events returns a channel receiving an event for every reload reported to
+// the callbacks. Sends never block: events are dropped while the channel's
+// buffer is full. The channel stays open across Stop and Start.
+func (rm *ReloadManager) Events() <-chan ReloadEvent {
+	return rm.events
+}
+
 // AddCallback adds a callback to be called when templates are reloaded
 func (rm *ReloadManager) AddCallback(callback ReloadCallback) {
 	rm.mu.Lock()
@@ -100,25 +335,78 @@ func (rm *ReloadManager) AddCallback(callback ReloadCallback) {
 	rm.callbacks = append(rm.callbacks, callback)
 }
 
-// Start begins the file watching process
+// Start begins the file watching process. Starting a running manager does
+// nothing; starting a stopped one resumes watching the same files, first
+// reloading any that changed while it was stopped.
 func (rm *ReloadManager) Start() {
-	go rm.watchLoop()
+	rm.mu.Lock()
+	if rm.started && !rm.stopped {
+		rm.mu.Unlock()
+		return
+	}
+	restart := rm.stopped
+	if restart {
+		rm.stopChan = make(chan struct{})
+		rm.stopped = false
+		rm.watcher = newWatcher(rm.watchedDirs)
+	}
+	rm.started = true
+	stop, watcher := rm.stopChan, rm.watcher
+	rm.mu.Unlock()
+
+	go func() {
+		if restart {
+			rm.checkFiles()
+		}
+		if watcher != nil {
+			rm.eventLoop(watcher, stop)
+			return
+		}
+		rm.watchLoop(stop)
+	}()
 }
 
-// Stop stops the file watching process
+// Stop stops the file watching process. It is safe to call more than once.
 func (rm *ReloadManager) Stop() {
 	rm.mu.Lock()
 	if !rm.stopped {
 		rm.stopped = true
 		close(rm.stopChan)
+		for filename, timer := range rm.pending {
+			timer.Stop()
+			delete(rm.pending, filename)
+		}
+		if rm.watcher != nil {
+			rm.watcher.Close()
+			rm.watcher = nil
+		}
 	}
 	rm.mu.Unlock()
 }
 
-// GetTemplate returns the current template for a file, reloading if necessary
+// Closed reports whether the manager has been stopped and not started again.
+func (rm *ReloadManager) Closed() bool {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.stopped
+}
+
+// GetTemplate returns the current template for a file, reloading if
+// necessary. Once the manager is stopped, watched files are returned as last
+// loaded and never reloaded.
 func (rm *ReloadManager) GetTemplate(filename string, opts ...Option) (*Template, error) {
 	rm.mu.RLock()
-	info, exists := rm.watched[filename]
+	stopped := rm.stopped
+	info, exists := rm.watched[filepath.Clean(filename)]
+	var lastModTime time.Time
+	var current *Template
+	if exists {
+		lastModTime, current = info.lastModTime, info.template
+		if len(opts) == 0 {
+			// Recompile with the options the file was first compiled with
+			opts = info.opts
+		}
+	}
 	rm.mu.RUnlock()
 
 	if !exists {
@@ -129,6 +417,9 @@ func (rm *ReloadManager) GetTemplate(filename string, opts ...Option) (*Template
 		}
 		return tmpl, nil
 	}
+	if stopped {
+		return current, nil
+	}
 
 	// Check if file has been modified
 	stat, err := os.Stat(filename)
@@ -136,38 +427,85 @@ func (rm *ReloadManager) GetTemplate(filename string, opts ...Option) (*Template
 		return nil, fmt.Errorf("stat file %q: %w", filename, err)
 	}
 
-	if stat.ModTime().After(info.lastModTime) {
+	if stat.ModTime().After(lastModTime) {
 		// File has been modified, reload it
 		tmpl, err := CompileFile(filename, opts...)
 		if err != nil {
+			rm.notify(filename, nil, err)
 			return nil, fmt.Errorf("reloading template %q: %w", filename, err)
 		}
 
-		// Update the watch info
+		// Update the watch info, unless the manager was stopped meanwhile
 		rm.mu.Lock()
+		if rm.stopped {
+			rm.mu.Unlock()
+			return tmpl, nil
+		}
 		info.lastModTime = stat.ModTime()
 		info.template = tmpl
 		rm.mu.Unlock()
 
-		// Notify callbacks
-		for _, callback := range rm.callbacks {
-			callback(filename, tmpl, nil)
-		}
-
+		rm.notify(filename, tmpl, nil)
 		return tmpl, nil
 	}
 
-	return info.template, nil
+	return current, nil
+}
+
+// eventLoop reloads watched files as the watcher reports changes to them
+func (rm *ReloadManager) eventLoop(watcher *fsnotify.Watcher, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(event.Name)
+			if event.Has(fsnotify.Create) {
+				rm.discover(name)
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+				rm.schedule(name)
+			}
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Errors such as a queue overflow may hide events, so recheck everything
+			rm.checkFiles()
+		}
+	}
+}
+
+// schedule reloads a watched file once it has been quiet for reloadDebounce
+func (rm *ReloadManager) schedule(filename string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if _, ok := rm.watched[filename]; !ok || rm.stopped {
+		return
+	}
+	if timer, ok := rm.pending[filename]; ok {
+		timer.Reset(reloadDebounce)
+		return
+	}
+	rm.pending[filename] = time.AfterFunc(reloadDebounce, func() {
+		rm.mu.Lock()
+		delete(rm.pending, filename)
+		rm.mu.Unlock()
+		rm.checkFile(filename)
+	})
 }
 
-// watchLoop runs the file watching loop
-func (rm *ReloadManager) watchLoop() {
+// watchLoop polls the watched files when no event watcher is available
+func (rm *ReloadManager) watchLoop(stop <-chan struct{}) {
 	ticker := time.NewTicker(rm.checkInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-rm.stopChan:
+		case <-stop:
 			return
 		case <-ticker.C:
 			rm.checkFiles()
@@ -199,32 +537,59 @@ func (rm *ReloadManager) checkFile(filename string) {
 
 	rm.mu.RLock()
 	info, exists := rm.watched[filename]
+	exists = exists && !rm.stopped
+	var lastModTime time.Time
+	var dependents []string
+	if exists {
+		lastModTime = info.lastModTime
+		for dependent := range info.dependents {
+			dependents = append(dependents, dependent)
+		}
+	}
 	rm.mu.RUnlock()
 
-	if !exists {
+	if !exists || !stat.ModTime().After(lastModTime) {
 		return
 	}
 
-	if stat.ModTime().After(info.lastModTime) {
-		// File has been modified, reload it
-		tmpl, err := CompileFile(filename)
+	// File has been modified, reload it
+	rm.reload(filename, stat.ModTime())
+
+	// Templates that include this file as a partial embed its old version,
+	// so recompile them as well
+	for _, dependent := range dependents {
+		dstat, err := os.Stat(dependent)
 		if err != nil {
-			// Notify callbacks of the error
-			for _, callback := range rm.callbacks {
-				callback(filename, nil, err)
-			}
-			return
+			continue
 		}
+		globalFileCache.forget(dependent)
+		rm.reload(dependent, dstat.ModTime())
+	}
+}
 
-		// Update the watch info
-		rm.mu.Lock()
-		info.lastModTime = stat.ModTime()
-		info.template = tmpl
-		rm.mu.Unlock()
+// reload recompiles a watched file and notifies the callbacks
+func (rm *ReloadManager) reload(filename string, modTime time.Time) {
+	rm.mu.RLock()
+	var opts []Option
+	if info, ok := rm.watched[filename]; ok {
+		opts = info.opts
+	}
+	rm.mu.RUnlock()
 
-		// Notify callbacks
-		for _, callback := range rm.callbacks {
-			callback(filename, tmpl, nil)
-		}
+	tmpl, err := CompileFile(filename, opts...)
+	if err != nil {
+		rm.notify(filename, nil, err)
+		return
 	}
+
+	// Update the watch info
+	rm.mu.Lock()
+	if info, ok := rm.watched[filename]; ok {
+		info.lastModTime = modTime
+		info.template = tmpl
+	}
+	rm.addDependentsLocked(filename, tmpl, opts)
+	rm.mu.Unlock()
+
+	rm.notify(filename, tmpl, nil)
 }
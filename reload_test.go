@@ -0,0 +1,360 @@
+package fasttpl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(filename, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A long interval means only file system events can trigger the reload
+	rm := NewReloadManager(time.Hour)
+	defer rm.Stop()
+	if err := rm.WatchDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	if rm.watcher == nil {
+		t.Skip("file system events are not supported on this platform")
+	}
+	reloads := make(chan *Template, 10)
+	rm.AddCallback(func(_ string, tmpl *Template, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reloads <- tmpl
+	})
+	rm.Start()
+
+	// Several writes in quick succession are debounced into one reload
+	for _, content := range []string{"v2", "v3", "v4"} {
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case tmpl := <-reloads:
+		if result, _ := tmpl.RenderString(nil); result != "v4" {
+			t.Errorf("expected %q, got %q", "v4", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("template was not reloaded")
+	}
+	select {
+	case <-reloads:
+		t.Error("expected a single reload for successive writes")
+	case <-time.After(5 * reloadDebounce):
+	}
+}
+
+func TestWatchDirectoryRecursive(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":              "index",
+		"blog/post.html":          "post",
+		"node_modules/pkg/x.html": "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rm := NewReloadManager(time.Hour)
+	defer rm.Stop()
+	if err := rm.WatchDirectoryRecursive(dir, []string{"node_modules"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"index.html":              true,
+		"blog/post.html":          true,
+		"node_modules/pkg/x.html": false,
+	} {
+		rm.mu.RLock()
+		_, got := rm.watched[filepath.Join(dir, name)]
+		rm.mu.RUnlock()
+		if got != want {
+			t.Errorf("watching %s: expected %v, got %v", name, want, got)
+		}
+	}
+	if rm.watcher == nil {
+		t.Skip("file system events are not supported on this platform")
+	}
+
+	added := make(chan string, 10)
+	rm.AddCallback(func(filename string, _ *Template, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		added <- filename
+	})
+	rm.Start()
+
+	// Templates in newly created subdirectories are picked up too
+	sub := filepath.Join(dir, "docs")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(sub, "guide.html")
+	if err := os.WriteFile(filename, []byte("guide"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-added:
+		if got != filename {
+			t.Errorf("expected %q, got %q", filename, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("new template was not picked up")
+	}
+}
+
+func TestReloadDependents(t *testing.T) {
+	dir := t.TempDir()
+	index := filepath.Join(dir, "index.html")
+	header := filepath.Join(dir, "_header.html")
+	if err := os.WriteFile(index, []byte(`{{ include "header" }} body`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(header, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rm := NewReloadManager(time.Hour)
+	defer rm.Stop()
+	if err := rm.WatchDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(map[string]*Template)
+	rm.AddCallback(func(filename string, tmpl *Template, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reloaded[filename] = tmpl
+	})
+
+	// Make sure the new modification time is observably later
+	later := time.Now().Add(time.Second)
+	if err := os.WriteFile(header, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(header, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rm.checkFile(header)
+
+	tmpl := reloaded[index]
+	if tmpl == nil {
+		t.Fatal("expected the including template to be reloaded")
+	}
+	if result, _ := tmpl.RenderString(nil); result != "new body" {
+		t.Errorf("expected %q, got %q", "new body", result)
+	}
+}
+
+func TestReloadKeepsCompileOptions(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(filename, []byte(`<< name | shout >>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shout := Filters{"shout": func(s string, _ []string) (string, error) { return s + "!", nil }}
+
+	rm := NewReloadManager(time.Hour)
+	defer rm.Stop()
+	if err := rm.WatchDirectory(dir, WithFilters(shout), WithDelims("<<", ">>")); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded *Template
+	rm.AddCallback(func(_ string, tmpl *Template, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reloaded = tmpl
+	})
+
+	later := time.Now().Add(time.Second)
+	if err := os.WriteFile(filename, []byte(`[<< name | shout >>]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rm.checkFile(filename)
+
+	if reloaded == nil {
+		t.Fatal("expected the template to be reloaded")
+	}
+	result, err := reloaded.RenderString(map[string]any{"name": "ann"})
+	if err != nil || result != "[ann!]" {
+		t.Errorf("expected %q, got %q (%v)", "[ann!]", result, err)
+	}
+}
+
+func TestReloadManagerRestart(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(filename, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Modification times are pushed forward so every write counts as a change
+	write := func(content string, at time.Time) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(tmpl *Template) string {
+		result, _ := tmpl.RenderString(nil)
+		return result
+	}
+
+	rm := NewReloadManager(10 * time.Millisecond)
+	defer rm.Stop()
+	if err := rm.WatchDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan *Template, 10)
+	rm.AddCallback(func(_ string, tmpl *Template, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reloads <- tmpl
+	})
+
+	for cycle := range 3 {
+		rm.Start()
+		rm.Start()
+		if rm.Closed() {
+			t.Fatalf("cycle %d: expected a started manager not to be closed", cycle)
+		}
+		rm.Stop()
+		rm.Stop()
+		if !rm.Closed() {
+			t.Fatalf("cycle %d: expected a stopped manager to be closed", cycle)
+		}
+	}
+
+	// A stopped manager hands out the last loaded template without reloading
+	now := time.Now()
+	write("v2", now.Add(time.Second))
+	tmpl, err := rm.GetTemplate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := render(tmpl); result != "v1" {
+		t.Errorf("expected %q after stop, got %q", "v1", result)
+	}
+	select {
+	case <-reloads:
+		t.Error("expected no reload while stopped")
+	default:
+	}
+
+	// Restarting picks up the change made while stopped, then keeps watching
+	rm.Start()
+	for i, want := range []string{"v2", "v3"} {
+		if i > 0 {
+			write(want, now.Add(time.Duration(i+1)*time.Second))
+		}
+		select {
+		case tmpl := <-reloads:
+			if result := render(tmpl); result != want {
+				t.Errorf("expected %q, got %q", want, result)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("template was not reloaded to %q after restart", want)
+		}
+	}
+	if tmpl, err := rm.GetTemplate(filename); err != nil || render(tmpl) != "v3" {
+		t.Errorf("expected GetTemplate to return %q after restart (%v)", "v3", err)
+	}
+}
+
+func TestReloadEvents(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(filename, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rm := NewReloadManager(time.Hour)
+	defer rm.Stop()
+	if err := rm.WatchDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Second)
+	for i, content := range []string{"v2", "{{ if x }}"} {
+		at := later.Add(time.Duration(i) * time.Second)
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, at, at); err != nil {
+			t.Fatal(err)
+		}
+		rm.checkFile(filename)
+	}
+
+	select {
+	case ev := <-rm.Events():
+		if ev.Filename != filename || ev.Err != nil || ev.Template == nil || ev.Time.IsZero() {
+			t.Errorf("unexpected success event %+v", ev)
+		}
+	default:
+		t.Fatal("expected an event for the reload")
+	}
+	select {
+	case ev := <-rm.Events():
+		if ev.Err == nil || ev.Template != nil {
+			t.Errorf("expected a failure event, got %+v", ev)
+		}
+	default:
+		t.Fatal("expected an event for the failed reload")
+	}
+
+	// Nobody reading must not block reloads
+	for range reloadEventBuffer + 1 {
+		rm.notify(filename, nil, nil)
+	}
+	if n := len(rm.Events()); n != reloadEventBuffer {
+		t.Errorf("expected a full buffer of %d events, got %d", reloadEventBuffer, n)
+	}
+}
+
+func TestWatchDirectoryPatterns(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.gohtml": "a", "b.html": "b", "c.tpl": "c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rm := NewReloadManager(time.Hour)
+	defer rm.Stop()
+	if err := rm.WatchDirectory(dir, WithPatterns("*.gohtml", "c.*")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a.gohtml": true, "b.html": false, "c.tpl": true} {
+		if _, ok := rm.watched[filepath.Join(dir, name)]; ok != want {
+			t.Errorf("%s: expected watched to be %v", name, want)
+		}
+	}
+
+	if err := rm.WatchDirectory(dir, WithPatterns("[")); err == nil {
+		t.Error("expected a malformed pattern to be rejected")
+	}
+}
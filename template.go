@@ -1,11 +1,19 @@
 package fasttpl
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"path/filepath"
+	"io/fs"
+	"maps"
+	"net/http"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,11 +21,34 @@ import (
 
 type Template struct {
 	root       node
-	parts      map[string]*Template
+	parts      *partialSet
 	filt       Filters
+	typed      TypedFilters
+	writers    WriterFilters
+	funcs      Funcs
+	escaper    func(string) string              // nil means htmlEscapeFast
+	missing    func(path string) (string, bool) // from WithMissingHandler
+	translator Translator                       // used by t and trans tags
 	fieldCache *fieldCache
+	fieldTag   string
+	// defaultFilt and defaultTyped report that filt and typed are the
+	// default sets, whose pure filters can be folded at compile time
+	defaultFilt, defaultTyped bool
+	strict                    bool
+	maxDepth                  int
+	timeout                   time.Duration  // from WithRenderTimeout; 0 for none
+	globals                   map[string]any // consulted when a path misses the data
+
+	partialFiles []string        // files auto-discovered as partials, for reloading
+	source       string          // file the template was compiled from, if any
+	layout       *string         // set by a {{ layout "name" }} tag; "" opts out
+	blocks       map[string]node // bodies of {{ block "name" }} tags
 }
 
+// contentPartial is the partial a layout renders with {{ yield }}, holding
+// the page the Engine is rendering.
+const contentPartial = "content"
+
 // NewTemplate creates a new template engine that loads all templates from the specified directory
 func NewTemplate(dir, ext string, opts ...EngineOption) (*Engine, error) {
 	eo := EngineOptions{
@@ -32,6 +63,9 @@ func NewTemplate(dir, ext string, opts ...EngineOption) (*Engine, error) {
 		defaultLayout: eo.defaultLayout,
 		dir:           dir,
 		ext:           ext,
+		fs:            nativeFS,
+		opts:          eo.compileOpts,
+		patterns:      newCompileOptions(eo.compileOpts).patterns,
 		reloadManager: NewReloadManager(eo.reloadInterval),
 	}
 
@@ -41,22 +75,18 @@ func NewTemplate(dir, ext string, opts ...EngineOption) (*Engine, error) {
 	}
 
 	// Set up reload callback
-	engine.reloadManager.AddCallback(func(filename string, template *Template, err error) {
+	engine.reloadManager.AddCallback(func(filename string, _ *Template, err error) {
 		if err != nil {
-			// Log error but don't fail
+			// Keep serving the previous version
 			return
 		}
-		// Update the template in the engine
-		engine.mu.Lock()
-		// Extract template name from filename
-		base := filepath.Base(filename)
-		name := strings.TrimSuffix(base, ext)
-		engine.templates[name] = template
-		engine.mu.Unlock()
+		// Recompile with the engine's own options, such as filters added
+		// with AddFilter, rather than using the manager's copy
+		engine.reload(filename)
 	})
 
 	// Start watching the directory
-	if err := engine.reloadManager.WatchDirectory(dir); err != nil {
+	if err := engine.reloadManager.WatchDirectory(dir, engine.compileOptions()...); err != nil {
 		return nil, fmt.Errorf("failed to watch directory: %w", err)
 	}
 
@@ -66,6 +96,30 @@ func NewTemplate(dir, ext string, opts ...EngineOption) (*Engine, error) {
 	return engine, nil
 }
 
+// NewTemplateFS creates a template engine that loads all templates from dir
+// within fsys, such as an embed.FS. Since such filesystems are usually
+// read-only, templates are not watched for changes.
+func NewTemplateFS(fsys fs.FS, dir, ext string, opts ...EngineOption) (*Engine, error) {
+	var eo EngineOptions
+	for _, o := range opts {
+		o(&eo)
+	}
+
+	engine := &Engine{
+		templates:     make(map[string]*Template),
+		defaultLayout: eo.defaultLayout,
+		dir:           dir,
+		ext:           ext,
+		fs:            ioFS(fsys),
+		opts:          eo.compileOpts,
+		patterns:      newCompileOptions(eo.compileOpts).patterns,
+	}
+	if err := engine.Load(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
 // PrecomputeFieldAccess optimizes field access for known struct types
 func (t *Template) PrecomputeFieldAccess(dataType reflect.Type) {
 	// Walk the AST and precompute field indices for struct access
@@ -85,11 +139,42 @@ func (t *Template) precomputeNode(n node, dataType reflect.Type) {
 	case rangeNode:
 		t.precomputeAccessor(node.iter, dataType)
 		t.precomputeNode(node.body, dataType)
+		if node.els != nil {
+			t.precomputeNode(node.els, dataType)
+		}
+	case switchNode:
+		t.precomputeAccessor(node.value, dataType)
+		for _, c := range node.cases {
+			t.precomputeNode(c.body, dataType)
+		}
+		if node.def != nil {
+			t.precomputeNode(node.def, dataType)
+		}
 	case letNode:
 		t.precomputeAccessor(node.acc, dataType)
 	case withNode:
 		t.precomputeAccessor(node.acc, dataType)
 		t.precomputeNode(node.body, dataType)
+		if node.els != nil {
+			t.precomputeNode(node.els, dataType)
+		}
+	case blockNode:
+		t.precomputeNode(node.body, dataType)
+	case transNode:
+		t.precomputeAccessor(node.key, dataType)
+		for _, arg := range node.args {
+			t.precomputeAccessor(arg, dataType)
+		}
+		for _, param := range node.params {
+			t.precomputeAccessor(param.acc, dataType)
+		}
+	case includeNode:
+		if node.nameAcc != nil {
+			t.precomputeAccessor(node.nameAcc, dataType)
+		}
+		if node.data != nil {
+			t.precomputeAccessor(node.data, dataType)
+		}
 	case seqNode:
 		for _, child := range node {
 			t.precomputeNode(child, dataType)
@@ -98,36 +183,595 @@ func (t *Template) precomputeNode(n node, dataType reflect.Type) {
 }
 
 func (t *Template) precomputeAccessor(acc accessor, dataType reflect.Type) {
-	if ba, ok := acc.(boundAcc); ok {
-		currentType := dataType
-		for i, step := range ba.steps {
-			if fs, ok := step.(fieldStep); ok && currentType.Kind() == reflect.Struct {
-				// Cache field index for this struct type
-				if field, found := currentType.FieldByName(fs.name); found {
-					// Update the step with cached info
-					ba.steps[i] = fieldStep{
-						name:       fs.name,
-						structType: currentType,
-						fieldIndex: field.Index,
-					}
-					currentType = field.Type
-				}
+	switch a := acc.(type) {
+	case compareAcc:
+		t.precomputeAccessor(a.left, dataType)
+		t.precomputeAccessor(a.right, dataType)
+		return
+	case andAcc:
+		for _, term := range a {
+			t.precomputeAccessor(term, dataType)
+		}
+		return
+	case orAcc:
+		for _, term := range a {
+			t.precomputeAccessor(term, dataType)
+		}
+		return
+	case notAcc:
+		t.precomputeAccessor(a.acc, dataType)
+		return
+	case pipeAcc:
+		t.precomputeAccessor(a.acc, dataType)
+		return
+	case spanAcc:
+		t.precomputeAccessor(a.from, dataType)
+		t.precomputeAccessor(a.to, dataType)
+		return
+	case ternaryAcc:
+		t.precomputeAccessor(a.cond, dataType)
+		t.precomputeAccessor(a.then, dataType)
+		t.precomputeAccessor(a.els, dataType)
+		return
+	case callAcc:
+		for _, arg := range a.args {
+			t.precomputeAccessor(arg, dataType)
+		}
+		return
+	case coalesceAcc:
+		for _, op := range a {
+			t.precomputeAccessor(op, dataType)
+		}
+		return
+	case indexAcc:
+		for _, op := range a {
+			t.precomputeAccessor(op, dataType)
+		}
+		return
+	}
+	ba, ok := acc.(boundAcc)
+	if !ok || len(ba.steps) == 0 {
+		return
+	}
+	if _, ok := ba.steps[0].(localStep); ok {
+		// Local paths start from a loop or let variable, not the data
+		return
+	}
+	currentType := dataType
+	for _, step := range ba.steps {
+		// Pointers are followed at render time too
+		for currentType.Kind() == reflect.Pointer {
+			currentType = currentType.Elem()
+		}
+		kind := currentType.Kind()
+		fs, ok := step.(fieldStep)
+		if !ok || fs.pre == nil {
+			switch {
+			case isSliceStep(step) && kind == reflect.Array:
+				// Slicing an array yields a slice
+				currentType = reflect.SliceOf(currentType.Elem())
+			case isSliceStep(step) && kind == reflect.Slice:
+			case kind == reflect.Slice || kind == reflect.Array || kind == reflect.Map:
+				// An index or key yields an element
+				currentType = currentType.Elem()
+			default:
+				return
+			}
+			continue
+		}
+		// The steps are shared with concurrent renders, so publish new
+		// values atomically instead of writing into the slice.
+		switch kind {
+		case reflect.Struct:
+			// Cache field index for this struct type
+			if info := t.fieldCache.lookup(currentType, fs.name, t.fieldTag); info.found {
+				fs.pre.Store(&precomputed{
+					structType: currentType,
+					fieldIndex: info.index,
+				})
+				currentType = currentType.FieldByIndex(info.index).Type
+			} else if m, found := findMethod(currentType, fs.name); found && m.Type.NumOut() > 0 {
+				// Cache the method index for value receivers
+				fs.pre.Store(&precomputed{
+					methodType:  currentType,
+					methodIndex: m.Index,
+				})
+				currentType = m.Type.Out(0)
+			} else {
+				return
+			}
+		case reflect.Map:
+			// Mark the step as a key lookup in this map type
+			if currentType.Key().Kind() != reflect.String {
+				return
+			}
+			fs.pre.Store(&precomputed{mapType: currentType})
+			currentType = currentType.Elem()
+		default:
+			// The dynamic type behind an interface, such as a field of type
+			// any, is only known at render time, where the cached info is
+			// checked against it; the rest of the path goes uncached
+			return
+		}
+	}
+}
+
+func isSliceStep(s step) bool {
+	_, ok := s.(sliceStep)
+	return ok
+}
+
+// foldNode replaces print tags whose output can't change between renders,
+// such as {{ 2 }} or {{ "a" | upper }}, with their precomputed text. Only
+// literals run through built-in filters with literal arguments qualify,
+// since custom filters and escapers may depend on state outside the
+// template.
+func (t *Template) foldNode(n node) node {
+	switch node := n.(type) {
+	case printNode:
+		if text, ok := t.fold(node); ok {
+			return constNode{text: text, orig: node}
+		}
+	case ifNode:
+		node.then = t.foldNode(node.then)
+		if node.els != nil {
+			node.els = t.foldNode(node.els)
+		}
+		return node
+	case rangeNode:
+		node.body = t.foldNode(node.body)
+		if node.els != nil {
+			node.els = t.foldNode(node.els)
+		}
+		return node
+	case switchNode:
+		for i := range node.cases {
+			node.cases[i].body = t.foldNode(node.cases[i].body)
+		}
+		if node.def != nil {
+			node.def = t.foldNode(node.def)
+		}
+		return node
+	case withNode:
+		node.body = t.foldNode(node.body)
+		if node.els != nil {
+			node.els = t.foldNode(node.els)
+		}
+		return node
+	case blockNode:
+		node.body = t.foldNode(node.body)
+		t.blocks[node.name] = node.body
+		return node
+	case seqNode:
+		for i, child := range node {
+			node[i] = t.foldNode(child)
+		}
+	}
+	return n
+}
+
+// fold renders n ahead of time when its output is constant.
+func (t *Template) fold(n printNode) (string, bool) {
+	if _, ok := n.acc.(literalAcc); !ok {
+		return "", false
+	}
+	if t.escaper != nil && !n.raw {
+		// A custom escaper may depend on the request, as for a CSP nonce
+		return "", false
+	}
+	for _, p := range n.pipes {
+		if p.argAccs != nil || !t.builtinFilter(p.name) {
+			return "", false
+		}
+	}
+	rc := renderCtxPool.Get().(*renderCtx)
+	rc.reset(nil, t)
+	defer renderCtxPool.Put(rc)
+	var sb strings.Builder
+	if err := n.render(rc, &sb); err != nil {
+		// Leave the error to be reported when the tag renders
+		return "", false
+	}
+	return sb.String(), true
+}
+
+// pureFilters names the default filters whose output depends on nothing but
+// their input and arguments. The markdown filter is left out, since without
+// WithMarkdown it only fails.
+var pureFilters = map[string]bool{
+	"upper": true, "lower": true, "trim": true, "capitalize": true, "title": true,
+	"truncate": true, "replace": true, "urlescape": true, "jsescape": true,
+	"cssescape": true, "default": true, "round": true, "json": true, "number": true,
+	"abs": true, "min": true, "max": true, "clamp": true, "join": true,
+	"length": true, "len": true, "sortby": true, "where": true, "contains": true,
+	"hasPrefix": true, "hasSuffix": true, "matches": true, "date": true,
+}
+
+// builtinFilter reports whether the filter name runs, as the template would
+// resolve it, is a pure default: one from pureFilters in a filter set the
+// options left at its defaults.
+func (t *Template) builtinFilter(name string) bool {
+	switch {
+	case t.typed[name] != nil:
+		return t.defaultTyped && pureFilters[name]
+	case t.writers[name] != nil:
+		return false
+	case t.filt[name] != nil:
+		return t.defaultFilt && pureFilters[name]
+	}
+	return false
+}
+
+// Vars returns the sorted top-level data keys the template reads, such as
+// "user" for {{ user.name }}. Loop and let variables are left out, as are
+// paths inside a with block without "as", which are relative to its value,
+// and the template's partials. So are filter arguments such as $rate, which
+// read the data only when no local of that name is bound.
+func (t *Template) Vars() []string {
+	seen := make(map[string]bool)
+	varsNode(t.root, seen)
+	return slices.Sorted(maps.Keys(seen))
+}
+
+func varsNode(n node, seen map[string]bool) {
+	switch node := n.(type) {
+	case printNode:
+		varsAccessor(node.acc, seen)
+	case ifNode:
+		varsAccessor(node.cond, seen)
+		varsNode(node.then, seen)
+		if node.els != nil {
+			varsNode(node.els, seen)
+		}
+	case rangeNode:
+		varsAccessor(node.iter, seen)
+		varsNode(node.body, seen)
+		if node.els != nil {
+			varsNode(node.els, seen)
+		}
+	case switchNode:
+		varsAccessor(node.value, seen)
+		for _, c := range node.cases {
+			varsNode(c.body, seen)
+		}
+		if node.def != nil {
+			varsNode(node.def, seen)
+		}
+	case letNode:
+		varsAccessor(node.acc, seen)
+	case withNode:
+		varsAccessor(node.acc, seen)
+		if node.name != "" {
+			// The body of with x as name reads the data, not x
+			varsNode(node.body, seen)
+		}
+		if node.els != nil {
+			varsNode(node.els, seen)
+		}
+	case blockNode:
+		varsNode(node.body, seen)
+	case transNode:
+		varsAccessor(node.key, seen)
+		for _, arg := range node.args {
+			varsAccessor(arg, seen)
+		}
+		for _, param := range node.params {
+			varsAccessor(param.acc, seen)
+		}
+	case includeNode:
+		if node.nameAcc != nil {
+			varsAccessor(node.nameAcc, seen)
+		}
+		if node.data != nil {
+			varsAccessor(node.data, seen)
+		}
+		for _, param := range node.params {
+			varsAccessor(param.acc, seen)
+		}
+	case seqNode:
+		for _, child := range node {
+			varsNode(child, seen)
+		}
+	}
+}
+
+func varsAccessor(acc accessor, seen map[string]bool) {
+	switch a := acc.(type) {
+	case boundAcc:
+		if len(a.steps) > 0 {
+			if fs, ok := a.steps[0].(fieldStep); ok {
+				seen[fs.name] = true
 			}
 		}
+	case compareAcc:
+		varsAccessor(a.left, seen)
+		varsAccessor(a.right, seen)
+	case andAcc:
+		for _, term := range a {
+			varsAccessor(term, seen)
+		}
+	case orAcc:
+		for _, term := range a {
+			varsAccessor(term, seen)
+		}
+	case notAcc:
+		varsAccessor(a.acc, seen)
+	case pipeAcc:
+		varsAccessor(a.acc, seen)
+	case spanAcc:
+		varsAccessor(a.from, seen)
+		varsAccessor(a.to, seen)
+	case ternaryAcc:
+		varsAccessor(a.cond, seen)
+		varsAccessor(a.then, seen)
+		varsAccessor(a.els, seen)
+	case callAcc:
+		for _, arg := range a.args {
+			varsAccessor(arg, seen)
+		}
+	case coalesceAcc:
+		for _, op := range a {
+			varsAccessor(op, seen)
+		}
+	case indexAcc:
+		for _, op := range a {
+			varsAccessor(op, seen)
+		}
+	}
+}
+
+// partialSet holds a template's partials. Registering a partial copies the
+// map and swaps the copy in, so renders read a fixed snapshot without
+// locking while other goroutines register.
+type partialSet struct {
+	mu sync.Mutex // serializes registrations
+	m  atomic.Pointer[map[string]*Template]
+}
+
+func newPartialSet(m map[string]*Template) *partialSet {
+	ps := &partialSet{}
+	ps.m.Store(&m)
+	return ps
+}
+
+// load returns the current partials, which must not be modified.
+func (ps *partialSet) load() map[string]*Template {
+	return *ps.m.Load()
+}
+
+func (ps *partialSet) store(name string, partial *Template) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	m := maps.Clone(ps.load())
+	if m == nil {
+		m = make(map[string]*Template, 1)
 	}
+	m[name] = partial
+	ps.m.Store(&m)
 }
 
-// RegisterPartial stores a named partial template for {{ include "name" }}
+// RegisterPartial stores a named partial template for {{ include "name" }}.
+// It is safe to call while t is being rendered from other goroutines; a
+// render in progress keeps the partials it started with. To give each
+// request its own partials, such as the page a layout wraps, register them
+// on a Clone instead.
 func (t *Template) RegisterPartial(name string, partial *Template) {
-	t.parts[name] = partial
+	t.parts.store(name, partial)
+}
+
+// Partials returns the sorted names of the partials registered on t.
+func (t *Template) Partials() []string {
+	return slices.Sorted(maps.Keys(t.parts.load()))
+}
+
+// HasPartial reports whether a partial called name is registered on t.
+func (t *Template) HasPartial(name string) bool {
+	_, ok := t.parts.load()[name]
+	return ok
+}
+
+// PartialSource returns the file the partial called name was compiled from,
+// such as "templates/_footer.html", to tell which of several files with the
+// same partial name auto-discovery picked. It reports false when there is no
+// such partial or it wasn't compiled from a file.
+func (t *Template) PartialSource(name string) (string, bool) {
+	p := t.parts.load()[name]
+	if p == nil || p.source == "" {
+		return "", false
+	}
+	return p.source, true
+}
+
+// Clone returns a copy of t with its own set of partials, so partials can be
+// registered on the copy without affecting t. The compiled template itself is
+// immutable and shared.
+func (t *Template) Clone() *Template {
+	c := *t
+	c.parts = newPartialSet(maps.Clone(t.parts.load()))
+	c.partialFiles = slices.Clone(t.partialFiles)
+	return &c
+}
+
+// WithTranslator returns a copy of t whose t and trans tags look messages up
+// with tr, such as a catalog for the current request's language.
+func (t *Template) WithTranslator(tr Translator) *Template {
+	c := t.Clone()
+	c.translator = tr
+	return c
+}
+
+// WithGlobals returns a copy of t that resolves paths missing from the data
+// against globals, such as a site name or the current year shared by every
+// page. Data takes precedence over globals, and both are consulted from
+// included partials too.
+func (t *Template) WithGlobals(globals map[string]any) *Template {
+	c := t.Clone()
+	c.globals = maps.Clone(globals)
+	return c
 }
 
 // Render executes the template with the given data into w. Data may be a struct, map or any value.
+// Output is written as it is produced, so w may have received part of the
+// page when an error is returned; RenderBuffered avoids that.
 func (t *Template) Render(w io.Writer, data any) error {
-	ctx := renderCtxPool.Get().(*renderCtx)
-	ctx.reset(data, t.parts, t.filt, t.fieldCache)
-	defer renderCtxPool.Put(ctx)
-	return t.root.render(ctx, w)
+	return t.RenderContext(context.Background(), w, data)
+}
+
+// RenderContext is like Render but stops with the context's error once ctx is
+// canceled or its deadline passes, checking before each loop iteration and
+// each node of a sequence. A timeout set with WithRenderTimeout is checked
+// at the same points.
+func (t *Template) RenderContext(ctx context.Context, w io.Writer, data any) error {
+	rc := renderCtxPool.Get().(*renderCtx)
+	rc.reset(data, t)
+	defer renderCtxPool.Put(rc)
+	rc.context = ctx
+	rc.done = ctx.Done()
+	if err := rc.canceled(); err != nil {
+		return err
+	}
+	return t.root.render(rc, w)
+}
+
+// RenderBlock renders only the body of the {{ block "name" }} tag with the
+// given name, such as the content of a page for an HTMX partial update. The
+// block sees data as its root, like the whole template would. It returns an
+// error when the template has no such block.
+func (t *Template) RenderBlock(w io.Writer, name string, data any) error {
+	body, ok := t.blocks[name]
+	if !ok {
+		return fmt.Errorf("block %q not found", name)
+	}
+	rc := renderCtxPool.Get().(*renderCtx)
+	rc.reset(data, t)
+	defer renderCtxPool.Put(rc)
+	return body.render(rc, w)
+}
+
+// RenderMulti is like Render with data spread over several sources, such as
+// request data and app-wide data. A path is resolved against the first
+// source, and against each later one in turn only when it misses in all
+// before it; globals from WithGlobals come last. Sources can be any mix of
+// maps and structs.
+func (t *Template) RenderMulti(w io.Writer, sources ...any) error {
+	var data any
+	if len(sources) > 0 {
+		data = sources[0]
+	}
+	rc := renderCtxPool.Get().(*renderCtx)
+	rc.reset(data, t)
+	defer renderCtxPool.Put(rc)
+	if len(sources) > 1 {
+		rc.fallbacks = slices.Insert(rc.fallbacks, 0, sources[1:]...)
+	}
+	return t.root.render(rc, w)
+}
+
+// RenderWith is like Render with extra filters for this render only, such as
+// a currency formatter bound to the request's locale. They take precedence
+// over the template's filters of the same name, typed and writer filters
+// included, and are seen by included partials too.
+func (t *Template) RenderWith(w io.Writer, data any, extra Filters) error {
+	rc := renderCtxPool.Get().(*renderCtx)
+	rc.reset(data, t)
+	defer renderCtxPool.Put(rc)
+	rc.extraFilters = extra
+	return t.root.render(rc, w)
+}
+
+// RenderStream is like Render but, when w implements http.Flusher, flushes
+// after each top-level node that wrote output, so clients start receiving
+// large pages before they are fully rendered.
+func (t *Template) RenderStream(w io.Writer, data any) error {
+	return t.RenderStreamContext(context.Background(), w, data)
+}
+
+// RenderStreamContext is like RenderStream but stops with the context's
+// error as RenderContext does, writing nothing when ctx is already done.
+func (t *Template) RenderStreamContext(ctx context.Context, w io.Writer, data any) error {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return t.RenderContext(ctx, w, data)
+	}
+	rc := renderCtxPool.Get().(*renderCtx)
+	rc.reset(data, t)
+	defer renderCtxPool.Put(rc)
+	rc.context = ctx
+	rc.done = ctx.Done()
+
+	seq, ok := t.root.(seqNode)
+	if !ok {
+		seq = seqNode{t.root}
+	}
+	cw := &countingWriter{w: w}
+	for _, n := range seq {
+		// Checked here as seqNode.render would, starting before the first node
+		if err := rc.canceled(); err != nil {
+			return err
+		}
+		if err := n.render(rc, cw); err != nil {
+			return err
+		}
+		if cw.n > 0 {
+			f.Flush()
+			cw.n = 0
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it since n was last reset.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// RenderBuffered is like Render but all or nothing: the output goes to a
+// pooled buffer and is copied to w in a single Write only once rendering
+// succeeds. On error w receives nothing.
+func (t *Template) RenderBuffered(w io.Writer, data any) error {
+	return renderBuffered(w, func(buf io.Writer) error {
+		return t.Render(buf, data)
+	})
+}
+
+func renderBuffered(w io.Writer, render func(io.Writer) error) error {
+	buf := AcquireBuffer()
+	defer ReleaseBuffer(buf)
+	if err := render(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// RenderFlush is like Render but buffers the output in a pooled bufio.Writer
+// and flushes it to w at the end, so rendering straight to a file or socket
+// takes a few large writes rather than many small ones. A w that already is
+// a *bufio.Writer is used as is and flushed. Output rendered before an error
+// is flushed too, as Render would have written it; the render error takes
+// precedence over a flush error.
+func (t *Template) RenderFlush(w io.Writer, data any) error {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufioPool.Get().(*bufio.Writer)
+		bw.Reset(w)
+		defer func() {
+			bw.Reset(nil)
+			bufioPool.Put(bw)
+		}()
+	}
+	err := t.Render(bw, data)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
 }
 
 // RenderString renders into a pooled buffer and returns a string.
@@ -141,6 +785,14 @@ func (t *Template) RenderString(data any) (string, error) {
 	return sb.String(), nil
 }
 
+// RenderBuffer renders the template, appending its output to buf, so a batch
+// of renders can share one buffer from AcquireBuffer without the copy made by
+// RenderToBytes. On error, buf keeps whatever was written before it;
+// truncate it to its previous length to discard that.
+func (t *Template) RenderBuffer(buf *bytes.Buffer, data any) error {
+	return t.Render(buf, data)
+}
+
 // RenderToDiscard renders template to io.Discard for benchmarking
 func (t *Template) RenderToDiscard(data any) error {
 	return t.Render(io.Discard, data)
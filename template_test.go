@@ -0,0 +1,2055 @@
+package fasttpl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func renderTest(t *testing.T, src string, data any, opts ...Option) string {
+	t.Helper()
+	tpl, err := Compile(src, opts...)
+	if err != nil {
+		t.Fatalf("compile %q: %v", src, err)
+	}
+	result, err := tpl.RenderString(data)
+	if err != nil {
+		t.Fatalf("render %q: %v", src, err)
+	}
+	return result
+}
+
+func renderTestErr(src string, data any, opts ...Option) (string, error) {
+	tpl, err := Compile(src, opts...)
+	if err != nil {
+		return "", err
+	}
+	return tpl.RenderString(data)
+}
+
+func TestElif(t *testing.T) {
+	src := `{{ if a }}A{{ elif b }}B{{ elif c }}C{{ else }}D{{ end }}`
+	cases := []struct {
+		data     map[string]any
+		expected string
+	}{
+		{map[string]any{"a": true, "b": true}, "A"},
+		{map[string]any{"b": true, "c": true}, "B"},
+		{map[string]any{"c": true}, "C"},
+		{map[string]any{}, "D"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, src, c.data); result != c.expected {
+			t.Errorf("data %v: expected %q, got %q", c.data, c.expected, result)
+		}
+	}
+
+	if result := renderTest(t, `{{ if a }}A{{ elif b }}B{{ end }}`, map[string]any{}); result != "" {
+		t.Errorf("expected empty output, got %q", result)
+	}
+
+	if _, err := Compile(`{{ if a }}A{{ elif }}B{{ end }}`); err == nil {
+		t.Error("expected error for elif without condition")
+	}
+}
+
+// else if is an alias for elif, in if, range and with blocks alike.
+func TestElseIf(t *testing.T) {
+	data := map[string]any{
+		"b":     true,
+		"none":  []int{},
+		"items": []int{1, 2},
+		"user":  map[string]any{"name": "Ann"},
+		"name":  "outer",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ if a }}A{{ else if b }}B{{ end }}`, "B"},
+		{`{{ if a }}A{{ else if c }}C{{ else }}D{{ end }}`, "D"},
+		{`{{ if a }}A{{ else if c }}C{{ else if b }}B{{ else }}D{{ end }}`, "B"},
+		{`{{ range i in none }}{{ $i }}{{ else if b }}empty{{ end }}`, "empty"},
+		{`{{ range i in items }}{{ $i }}{{ else if b }}empty{{ end }}`, "12"},
+		{`{{ range i in none }}{{ $i }}{{ elif a }}A{{ else }}none{{ end }}`, "none"},
+		{`{{ with user }}{{ name }}{{ else }}anonymous{{ end }}`, "Ann"},
+		{`{{ with guest }}{{ name }}{{ else }}anonymous {{ name }}{{ end }}`, "anonymous outer"},
+		{`{{ with guest as g }}{{ $g }}{{ else if b }}B{{ else }}D{{ end }}`, "B"},
+		{`{{ with guest }}x{{ elif a }}A{{ end }}`, ""},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	errs := map[string]string{
+		`{{ if a }}A{{ else b }}B{{ end }}`:           `template:1:12: else takes no arguments other than "if cond"`,
+		`{{ if a }}A{{ else if }}B{{ end }}`:          "template:1:12: if syntax: missing condition",
+		`{{ else if a }}`:                             `template:1:1: unexpected "elif" with no open block`,
+		`{{ with a }}A{{ else }}B{{ else }}{{ end }}`: `template:1:25: unexpected "else" in "with" block`,
+	}
+	for src, expected := range errs {
+		if _, err := Compile(src); err == nil || err.Error() != expected {
+			t.Errorf("%s: expected %q, got %v", src, expected, err)
+		}
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	src := `{{ switch status }}
+  {{- case "open" }}Open{{ case "closed", "archived" }}Closed{{ case 3 }}Three{{ case true }}Yes{{ default }}Other{{ end }}`
+	cases := []struct {
+		status   any
+		expected string
+	}{
+		{"open", "Open"},
+		{"closed", "Closed"},
+		{"archived", "Closed"},
+		{3, "Three"},
+		{3.0, "Three"},
+		{"3", "Three"},
+		{int64(3), "Three"},
+		{true, "Yes"},
+		{"other", "Other"},
+		{nil, "Other"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, src, map[string]any{"status": c.status}); result != c.expected {
+			t.Errorf("status %#v: expected %q, got %q", c.status, c.expected, result)
+		}
+	}
+
+	if result := renderTest(t, `{{ switch s | lower }}{{ case "a" }}A{{ end }}|{{ switch s }}{{ end }}`, map[string]any{"s": "A"}); result != "A|" {
+		t.Errorf("expected %q, got %q", "A|", result)
+	}
+	if vars := MustCompile(`{{ switch a }}{{ case 1 }}{{ b }}{{ default }}{{ c }}{{ end }}`).Vars(); !reflect.DeepEqual(vars, []string{"a", "b", "c"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+}
+
+func TestCompareConditions(t *testing.T) {
+	data := map[string]any{
+		"age":   21,
+		"score": 9.5,
+		"name":  "bob",
+		"count": "3",
+		"admin": true,
+		"user":  struct{ Age int64 }{Age: 17},
+	}
+	cases := []struct {
+		cond     string
+		expected bool
+	}{
+		{`age >= 18`, true},
+		{`age < 18`, false},
+		{`user.Age >= 18`, false},
+		{`age == 21`, true},
+		{`age != 21`, false},
+		{`age > score`, true},
+		{`score <= 9.5`, true},
+		{`score > 10`, false},
+		{`name == "bob"`, true},
+		{`name < "carl"`, true},
+		{`name > 'carl'`, false},
+		{`count == 3`, true},
+		{`count < 10`, true},
+		{`admin == true`, true},
+		{`admin != false`, true},
+		{`name == 3`, false},
+		{`missing == "x"`, false},
+	}
+	for _, c := range cases {
+		result := renderTest(t, "{{ if "+c.cond+" }}yes{{ else }}no{{ end }}", data)
+		if (result == "yes") != c.expected {
+			t.Errorf("%s: expected %v, got %q", c.cond, c.expected, result)
+		}
+	}
+}
+
+func TestBooleanConditions(t *testing.T) {
+	data := map[string]any{
+		"user": map[string]any{"admin": true, "suspended": false, "age": 30},
+		"a":    true,
+		"b":    false,
+		"c":    true,
+	}
+	cases := []struct {
+		cond     string
+		expected bool
+	}{
+		{`user.admin and not user.suspended`, true},
+		{`user.admin and user.suspended`, false},
+		{`a or b`, true},
+		{`b or b`, false},
+		{`not a`, false},
+		{`not not a`, true},
+		{`!b`, true},
+		{`!!a`, true},
+		{`a or b and b`, true},
+		{`(a or b) and c`, true},
+		{`(a or b) and b`, false},
+		{`not (a and b)`, true},
+		{`user.age >= 18 and user.admin`, true},
+		{`user.age < 18 or user.suspended`, false},
+		{`b and missing.field`, false},
+	}
+	for _, c := range cases {
+		result := renderTest(t, "{{ if "+c.cond+" }}yes{{ else }}no{{ end }}", data)
+		if (result == "yes") != c.expected {
+			t.Errorf("%s: expected %v, got %q", c.cond, c.expected, result)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2}, "ok": true}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`a{{# note #}}b`, "ab"},
+		{"a{{#\nmulti\nline {{ not a tag }}\n#}}b", "ab"},
+		{`{{ range i in items }}{{# each #}}{{ $i }}{{ end }}`, "12"},
+		{`{{ if ok }}{{# yes #}}y{{ else }}{{# no #}}n{{ end }}`, "y"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := Compile(`a{{# never closed }}b`); err == nil {
+		t.Error("expected error for unterminated comment")
+	}
+}
+
+func TestTrimMarkers(t *testing.T) {
+	data := map[string]any{"items": []any{"a", "b"}, "name": "x", "ok": true}
+	cases := []struct {
+		src      string
+		expected string
+		opts     []Option
+	}{
+		{"[ {{- name }} ]", "[x ]", nil},
+		{"[ {{ name -}} ]", "[ x]", nil},
+		{"[ {{- name -}} ]", "[x]", nil},
+		{"<ul>\n  {{- range i in items -}}\n  <li>{{ $i }}</li>\n  {{- end -}}\n</ul>", "<ul><li>a</li><li>b</li></ul>", nil},
+		{"{{ if ok -}}\n  yes\n{{- else -}}\n  no\n{{- end }}", "yes", nil},
+		{"[ <<- name ->> ]", "[x]", []Option{WithDelims("<<", ">>")}},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, c.opts...); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+}
+
+func TestEscapedDelims(t *testing.T) {
+	data := map[string]any{"name": "x"}
+	cases := []struct {
+		src      string
+		expected string
+		opts     []Option
+	}{
+		{`\{{ name }}`, "{{ name }}", nil},
+		{`use \{{ name }} for {{ name }}`, "use {{ name }} for x", nil},
+		{`\{{\{{ name }}`, "{{{{ name }}", nil},
+		{`\\{{ name }}`, `\x`, nil},
+		{`a\b {{ name }}\`, `a\b x\`, nil},
+		{`{{ "{{" }} name }}`, "{{ name }}", nil},
+		{"\\{{ name }}\n{{- name }}", "{{ name }}x", nil},
+		{`\<< name >> << name >>`, "<< name >> x", []Option{WithDelims("<<", ">>")}},
+		{`\{{ name }} << name >>`, `\{{ name }} x`, []Option{WithDelims("<<", ">>")}},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, c.opts...); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	// Positions still count the source as written
+	_, err := Compile(`\{{ x }} {{ if }}`)
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Column != 10 {
+		t.Errorf("expected an error at column 10, got %v", err)
+	}
+}
+
+func TestRangeLoopLocals(t *testing.T) {
+	data := map[string]any{
+		"items":  []string{"a", "b", "c"},
+		"nested": []any{[]any{1, 2}, []any{3}},
+		"m":      map[string]int{"x": 1},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ range i in items }}{{ $index }}:{{ $i }}{{ if not $last }}, {{ end }}{{ end }}`, "0:a, 1:b, 2:c"},
+		{`{{ range i in items }}{{ if $first }}[{{ end }}{{ $i }}{{ if $last }}]{{ end }}{{ end }}`, "[abc]"},
+		{`{{ range row in nested }}{{ range c in $row }}{{ $index }}{{ end }}/{{ $index }} {{ end }}`, "01/0 0/1 "},
+		{`{{ range v in m }}{{ $index }}{{ $first }}{{ $last }}{{ end }}`, "0truetrue"},
+		{`{{ range i in items }}{{ end }}[{{ $index }}]`, "[]"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+}
+
+func TestRangeElse(t *testing.T) {
+	src := `{{ range x in items }}{{ $x }}{{ else }}none{{ end }}`
+	cases := []struct {
+		items    any
+		expected string
+	}{
+		{[]int{1, 2}, "12"},
+		{[]int{}, "none"},
+		{[]string(nil), "none"},
+		{[0]int{}, "none"},
+		{map[string]int{}, "none"},
+		{map[string]any(nil), "none"},
+		{nil, "none"},
+		{"abc", "none"},
+		{0, "none"},
+		{-2, "none"},
+		{map[string]int{"a": 1}, "1"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, src, map[string]any{"items": c.items}); result != c.expected {
+			t.Errorf("items %#v: expected %q, got %q", c.items, c.expected, result)
+		}
+	}
+	if result := renderTest(t, src, map[string]any{}); result != "none" {
+		t.Errorf("missing items: expected %q, got %q", "none", result)
+	}
+}
+
+func TestRangePointers(t *testing.T) {
+	rows := []map[string]any{{"name": "a"}, {"name": "b"}}
+	arr := [2]string{"c", "d"}
+	m := map[string]string{"x": "e"}
+	var nilRows *[]map[string]any
+	var iface any = &rows
+	type list []any
+	type table []map[string]any
+	named := list{"f", "g"}
+	namedRows := table{{"name": "h"}}
+	cases := []struct {
+		src      string
+		items    any
+		expected string
+	}{
+		{`{{ range x in items }}{{ $x.name }};{{ else }}none{{ end }}`, &rows, "a;b;"},
+		{`{{ range x in items }}{{ $x.name }};{{ else }}none{{ end }}`, &iface, "a;b;"},
+		{`{{ range x in items }}{{ $x.name }};{{ else }}none{{ end }}`, nilRows, "none"},
+		{`{{ range x in items }}{{ $x }};{{ else }}none{{ end }}`, &arr, "c;d;"},
+		{`{{ range x in items }}{{ $x }};{{ else }}none{{ end }}`, &m, "e;"},
+		{`{{ range x in items }}{{ $x }};{{ else }}none{{ end }}`, (*map[string]string)(nil), "none"},
+		{`{{ range x in items }}{{ $x }};{{ else }}none{{ end }}`, &named, "f;g;"},
+		{`{{ range x in items }}{{ $x.name }};{{ else }}none{{ end }}`, &namedRows, "h;"},
+		{`{{ range x in items }}{{ $x }};{{ else }}none{{ end }}`, named, "f;g;"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, map[string]any{"items": c.items}); result != c.expected {
+			t.Errorf("items %T: expected %q, got %q", c.items, c.expected, result)
+		}
+	}
+}
+
+func TestRangeIntegers(t *testing.T) {
+	data := map[string]any{"count": 3, "pages": 4.0, "start": int64(2), "none": 0, "half": 1.5}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ range i in count }}{{ $i }}{{ end }}`, "012"},
+		{`{{ range i in 2 }}{{ $i }}{{ $last }} {{ end }}`, "0false 1true "},
+		{`{{ range p in 1..pages }}{{ $p }}{{ end }}`, "1234"},
+		{`{{ range p in start..5 }}{{ $index }}:{{ $p }} {{ end }}`, "0:2 1:3 2:4 3:5 "},
+		{`{{ range p in -1..1 }}{{ $p }} {{ end }}`, "-1 0 1 "},
+		{`{{ range p in 3..1 }}{{ $p }}{{ else }}empty{{ end }}`, "empty"},
+		{`{{ range i in none }}{{ $i }}{{ else }}empty{{ end }}`, "empty"},
+		{`{{ range i in half }}{{ $i }}{{ else }}empty{{ end }}`, "empty"},
+		{`{{ range s in "a..b" }}{{ $s }}{{ else }}empty{{ end }}`, "empty"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := renderTestErr(`{{ range p in 1..half }}{{ end }}`, data); err == nil || !strings.Contains(err.Error(), "bound 1.5 of a..b is not an integer") {
+		t.Errorf("expected non-integer bound error, got %v", err)
+	}
+}
+
+func TestPrintNumbers(t *testing.T) {
+	data := map[string]any{"i": -42, "big": int64(1) << 40, "f": 0.5, "e": 1e21, "u": uint8(7)}
+	src := `{{ i }} {{ big }} {{ f }} {{ e }} {{ u }} {{ i | safe }} {{ f | round:0 }}`
+	if result := renderTest(t, src, data); result != "-42 1099511627776 0.5 1e+21 7 -42 1" {
+		t.Errorf("got %q", result)
+	}
+}
+
+func TestTernary(t *testing.T) {
+	data := map[string]any{
+		"user":  map[string]any{"admin": true, "name": "ann"},
+		"guest": map[string]any{"admin": false},
+		"count": 3,
+		"label": "a:b?",
+		"title": "Hello World",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ user.admin ? "Admin" : "User" }}`, "Admin"},
+		{`{{ guest.admin ? "Admin" : "User" }}`, "User"},
+		{`{{ missing ? "yes" : "no" }}`, "no"},
+		{`{{ user.admin ? user.name : "nobody" }}`, "ann"},
+		{`{{ count > 1 ? "items" : "item" }}`, "items"},
+		{`{{ count == 1 or guest.admin ? "one" : "many" }}`, "many"},
+		{`{{ user.admin ? user.name | upper : "x" }}`, "ANN"},
+		{`{{ guest.admin ? "x" : title | truncate:5 }}`, "Hello"},
+		{`{{ user.admin ? title | truncate:5 : "x" }}`, "Hello"},
+		{`{{ (guest.admin ? "a" : "b") | upper }}`, "B"},
+		{`{{ user.admin ? "<b>" : "" }}`, "&lt;b&gt;"},
+		{`{{ guest.admin ? "a" : count > 2 ? "big" : "small" }}`, "big"},
+		{`{{ user.admin ? guest.admin ? "both" : "first" : "none" }}`, "first"},
+		{`{{ user.admin ? (guest.admin ? "both" : "first") : "none" }}`, "first"},
+		{`{{ user.admin ? label : "?" }}`, "a:b?"},
+		{`{{ label | replace:"?":"!" }}`, "a:b!"},
+		{`<a class="{{ user.admin ? "on" : "off" }}">`, `<a class="on">`},
+		{`{{ if (user.admin ? count : 0) > 2 }}big{{ end }}`, "big"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if vars := MustCompile(`{{ a ? b : c.d }}`).Vars(); !reflect.DeepEqual(vars, []string{"a", "b", "c"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	funcs := Funcs{
+		"asset": func(args ...any) (any, error) { return "/static/" + fmt.Sprint(args[0]) + "?v=1", nil },
+		"t": func(args ...any) (any, error) {
+			if len(args) < 2 {
+				return nil, errors.New("want a key and a name")
+			}
+			return fmt.Sprintf("%v, %v!", args[0], args[1]), nil
+		},
+		"add": func(args ...any) (any, error) {
+			sum := 0
+			for _, a := range args {
+				n, _ := a.(int)
+				sum += n
+			}
+			return sum, nil
+		},
+		"now":   func(...any) (any, error) { return "noon", nil },
+		"count": func(args ...any) (any, error) { return len(args), nil },
+		"isNil": func(args ...any) (any, error) { return args[0] == nil, nil },
+	}
+	data := map[string]any{"user": map[string]any{"name": "ann"}, "n": 2}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ asset("css/main.css") }}`, "/static/css/main.css?v=1"},
+		{`{{ t("Hello", user.name) }}`, "Hello, ann!"},
+		{`{{ t("Hi, there", user.name | upper) }}`, "Hi, there, ANN!"},
+		{`{{ add(1, n, add(3, 4)) }}`, "10"},
+		{`{{ now() }} {{ count() }} {{ count( ) }}`, "noon 0 0"},
+		{`{{ now() | upper }}`, "NOON"},
+		{`{{ isNil(missing) }}`, "true"},
+		{`{{ if add(n, 1) > 2 }}big{{ end }}`, "big"},
+		{`{{ n > 1 ? asset("a.png") : "none" }}`, "/static/a.png?v=1"},
+		{`{{ t("<b>", "x") }}`, "&lt;b&gt;, x!"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data, WithFuncs(funcs)); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := renderTestErr(`{{ nope(1) }}`, data, WithFuncs(funcs)); err == nil || err.Error() != `unknown function "nope"` {
+		t.Errorf("expected unknown function error, got %v", err)
+	}
+	if _, err := renderTestErr(`{{ t("x") }}`, data, WithFuncs(funcs)); err == nil || err.Error() != "t: want a key and a name" {
+		t.Errorf("expected the function's error, got %v", err)
+	}
+	if _, err := renderTestErr(`{{ count(missing) }}`, data, WithFuncs(funcs), WithStrictVars(true)); err == nil || err.Error() != `missing variable "missing" at template:1:1` {
+		t.Errorf("expected strict missing variable error, got %v", err)
+	}
+	if vars := MustCompile(`{{ t("k", user.name, add(n)) }}`).Vars(); !reflect.DeepEqual(vars, []string{"n", "user"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	data := map[string]any{
+		"profile": map[string]any{"displayName": "", "username": "ann", "age": 0},
+		"n":       2,
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ coalesce(profile.displayName, profile.username, "Guest") }}`, "ann"},
+		{`{{ coalesce(profile.missing, profile.displayName, "Guest") }}`, "Guest"},
+		{`[{{ coalesce(profile.displayName, profile.age, "") }}]`, "[]"},
+		{`[{{ coalesce(profile.displayName, profile.missing) }}]`, "[]"},
+		{`[{{ coalesce() }}]`, "[]"},
+		{`{{ coalesce(profile.nick, profile.username | upper) }}`, "ANN"},
+		{`{{ if coalesce(profile.displayName, profile.age) }}T{{ else }}F{{ end }}`, "F"},
+		{`{{ coalesce(profile.username, boom()) }}`, "ann"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if result := renderTest(t, `{{ coalesce(profile.nick, "Guest") }}`, data, WithStrictVars(true)); result != "Guest" {
+		t.Errorf("strict: got %q", result)
+	}
+	if vars := MustCompile(`{{ coalesce(a.b, c, "x") }}`).Vars(); !reflect.DeepEqual(vars, []string{"a", "c"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+}
+
+func TestIndexFunc(t *testing.T) {
+	data := map[string]any{
+		"items":  []string{"a", "b", "c"},
+		"grid":   [][]int{{1, 2}, {3, 4}},
+		"ages":   map[string]int{"ann": 30},
+		"scores": map[int]string{42: "top"},
+		"flags":  map[bool]string{true: "on"},
+		"ptr":    &[]string{"p"},
+		"i":      1,
+		"row":    int8(1),
+		"name":   "ann",
+		"key":    "42",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ index(items, i) }}`, "b"},
+		{`{{ index(items, -1) }}`, "c"},
+		{`{{ index(grid, row, 0) }}`, "3"},
+		{`{{ index(ages, name) }}`, "30"},
+		{`{{ index(scores, 42) }}|{{ index(scores, key) }}`, "top|top"},
+		{`{{ index(flags, true) }}`, "on"},
+		{`{{ index(ptr, 0) }}`, "p"},
+		{`{{ range n in items }}{{ index(items, $index) }}{{ end }}`, "abc"},
+		{`{{ index(items, i) | upper }}`, "B"},
+		{`[{{ index(items, 3) }}{{ index(grid, 5, 0) }}{{ index(ages, "bob") }}{{ index(missing, 0) }}{{ index(items, nope) }}]`, "[]"},
+		{`{{ if index(items, 9) }}T{{ else }}F{{ end }}`, "F"},
+		{`{{ coalesce(index(items, 9), "none") }}`, "none"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := Compile(`{{ index(items) }}`); err == nil {
+		t.Error("expected an error for index without a key")
+	}
+	if vars := MustCompile(`{{ index(a.b, c) }}`).Vars(); !reflect.DeepEqual(vars, []string{"a", "c"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+
+	// Keys computed while rendering must not pile up in the value cache
+	tmpl := MustCompile(`{{ index(ages, name) }}{{ index(ages, i) }}`)
+	for i := range 3 {
+		name := fmt.Sprintf("dynamic-key-%d", i)
+		if _, err := tmpl.RenderString(map[string]any{"ages": data["ages"], "name": name, "i": 1000 + i}); err != nil {
+			t.Fatal(err)
+		}
+		globalValueCache.mu.RLock()
+		_, cachedName := globalValueCache.cache[name]
+		_, cachedIndex := globalValueCache.cache[strconv.Itoa(1000+i)]
+		globalValueCache.mu.RUnlock()
+		if cachedName || cachedIndex {
+			t.Fatalf("dynamic keys %q and %d were cached", name, 1000+i)
+		}
+	}
+}
+
+func TestLiterals(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ "hello" | upper }}`, "HELLO"},
+		{`{{ 'a|b' }}`, "a|b"},
+		{`{{ "<b>" }}`, "&lt;b&gt;"},
+		{`{{ 42 }}`, "42"},
+		{`{{ -7 }}`, "-7"},
+		{`{{ 3.14 }}`, "3.14"},
+		{`{{ true }}`, "true"},
+		{`{{ "  padded  " | trim }}`, "padded"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, nil); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	if _, err := Compile(`{{ 12abc }}`); err == nil {
+		t.Error("expected error for malformed literal")
+	}
+}
+
+type methodUser struct {
+	First string
+	Last  string
+}
+
+func (u methodUser) FullName() string { return u.First + " " + u.Last }
+
+func (u *methodUser) Initials() string { return u.First[:1] + u.Last[:1] }
+
+func (u methodUser) Lookup() (string, error) {
+	if u.Last == "" {
+		return "", errors.New("no last name")
+	}
+	return u.Last, nil
+}
+
+func (u methodUser) Address() methodAddress { return methodAddress{City: "Oslo"} }
+
+type methodAddress struct{ City string }
+
+func TestMethodAccess(t *testing.T) {
+	u := methodUser{First: "Ada", Last: "Lovelace"}
+	cases := []struct {
+		src      string
+		data     any
+		expected string
+	}{
+		{`{{ user.FullName }}`, map[string]any{"user": u}, "Ada Lovelace"},
+		{`{{ user.fullName }}`, map[string]any{"user": &u}, "Ada Lovelace"},
+		{`{{ user.Initials }}`, map[string]any{"user": &u}, "AL"},
+		{`{{ user.Initials }}`, map[string]any{"user": u}, "AL"},
+		{`{{ user.Lookup }}`, map[string]any{"user": u}, "Lovelace"},
+		{`{{ user.Address.City }}`, map[string]any{"user": u}, "Oslo"},
+		{`{{ if user.FullName == "Ada Lovelace" }}yes{{ end }}`, map[string]any{"user": u}, "yes"},
+		{`[{{ user.Missing }}]`, map[string]any{"user": u}, "[]"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, c.data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	tpl, err := Compile(`{{ FullName }} {{ Address.City }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl.PrecomputeFieldAccess(reflect.TypeOf(u))
+	if result, err := tpl.RenderString(u); err != nil || result != "Ada Lovelace Oslo" {
+		t.Errorf("precomputed: expected %q, got %q (%v)", "Ada Lovelace Oslo", result, err)
+	}
+
+	tpl, err = Compile(`{{ user.Lookup }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.RenderString(map[string]any{"user": methodUser{First: "Ada"}}); err == nil || !strings.Contains(err.Error(), "no last name") {
+		t.Errorf("expected method error to propagate, got %v", err)
+	}
+}
+
+func TestMapAccess(t *testing.T) {
+	var cache sync.Map
+	cache.Store("user", map[string]any{"name": "Ann"})
+	cache.Store(7, "seven")
+	type code uint16
+	type record map[string]any
+	data := map[string]any{
+		"cache":  &cache,
+		"codes":  map[int]string{404: "Not Found"},
+		"status": map[code]string{200: "OK"},
+		"any":    map[any]string{"a": "letter", 2: "number"},
+		"named":  record{"name": "Ann", "tags": record{"x": "y"}},
+		"labels": map[fmt.Stringer]int{time.Second: 1},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ cache.user.name }}`, "Ann"},
+		{`{{ cache["user"].name }}`, "Ann"},
+		{`{{ cache[7] }}`, "seven"},
+		{`[{{ cache.missing }}]`, "[]"},
+		{`{{ codes[404] }}`, "Not Found"},
+		{`{{ codes.404 }}`, "Not Found"},
+		{`{{ codes["404"] }}`, "Not Found"},
+		{`[{{ codes[500] }}{{ codes.nope }}]`, "[]"},
+		{`{{ status[200] }}`, "OK"},
+		{`{{ any.a }} {{ any[2] }}`, "letter number"},
+		{`{{ if codes[404] }}found{{ end }}`, "found"},
+		{`{{ named.name }} {{ named.tags.x }}`, "Ann y"},
+		{`{{ range v in named.tags }}{{ $v }}{{ end }}`, "y"},
+		// Keys that can't be a map's interface key type simply miss
+		{`[{{ labels.x }}{{ labels[1] }}{{ index(labels, "x") }}]`, "[]"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	// A named map type as the data itself
+	named := record{"name": "Bob", "tags": record{"x": "z"}}
+	if result := renderTest(t, `{{ name }}{{ range v in tags }}{{ $v }}{{ end }}`, named); result != "Bobz" {
+		t.Errorf("named map data: expected %q, got %q", "Bobz", result)
+	}
+}
+
+func TestIntMapKeys(t *testing.T) {
+	type board struct{ Scores map[int]int }
+	scores := map[int]int{42: 7, -1: 3, 0: 1}
+	data := map[string]any{
+		"scores": scores,
+		"ptr":    &scores,
+		"small":  map[int8]string{5: "five"},
+		"nested": map[int]map[int]string{1: {2: "deep"}},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ scores[42] }}`, "7"},
+		{`{{ scores[0] }}`, "1"},
+		// On a map a negative index is a key, not a count from the end
+		{`{{ scores[-1] }}`, "3"},
+		{`[{{ scores[43] }}]`, "[]"},
+		{`{{ ptr[42] }}`, "7"},
+		{`{{ small[5] }}[{{ small[300] }}]`, "five[]"},
+		{`{{ nested[1][2] }}`, "deep"},
+		{`{{ scores[42] | min:5 }}`, "5"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	tpl := MustCompile(`{{ scores[42] }}|{{ scores[-1] }}`)
+	tpl.PrecomputeFieldAccess(reflect.TypeOf(board{}))
+	if result, err := tpl.RenderString(board{Scores: scores}); err != nil || result != "7|3" {
+		t.Errorf("precomputed: expected %q, got %q (%v)", "7|3", result, err)
+	}
+}
+
+func TestIndexing(t *testing.T) {
+	data := map[string]any{
+		"items": []string{"a", "b", "c", "d"},
+		"users": []map[string]any{{"name": "Ann"}, {"name": "Bob"}},
+		"grid":  [3]int{1, 2, 3},
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ items[0] }}{{ items.1 }}`, "ab"},
+		{`{{ items[-1] }}{{ items[-4] }}`, "da"},
+		{`{{ users[-1].name }} {{ users.0.name }}`, "Bob Ann"},
+		{`[{{ items[4] }}{{ items[-5] }}]`, "[]"},
+		{`{{ items[1:3] | join:"," }}`, "b,c"},
+		{`{{ items[:2] | join:"," }}`, "a,b"},
+		{`{{ items[2:] | join:"," }}`, "c,d"},
+		{`{{ items[-2:] | join:"," }}`, "c,d"},
+		{`{{ items[:] | length }}`, "4"},
+		{`{{ items[1:-1] | join:"," }}`, "b,c"},
+		{`[{{ items[3:9] }}{{ items[3:1] }}]`, "[]"},
+		{`{{ range x in items[1:3] }}<{{ $x }}>{{ end }}`, "<b><c>"},
+		{`{{ grid[-1] }} {{ grid[:2] | join:"+" }}`, "3 1+2"},
+		{`{{ items[1:3][-1] }}`, "c"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+}
+
+func TestNilPaths(t *testing.T) {
+	type user struct {
+		Name  string
+		Boss  *user
+		Tags  []string
+		Extra map[string]any
+		Any   any
+	}
+	items := []string{"a", "b"}
+	var noSync *sync.Map
+	data := map[string]any{
+		"nilMap":   map[string]any(nil),
+		"nilSlice": []string(nil),
+		"nilUser":  (*user)(nil),
+		"nilIface": nil,
+		"nilSync":  noSync,
+		"user":     &user{Name: "Ann"},
+		"items":    &items,
+		"nilItems": (*[]string)(nil),
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`[{{ nilMap.a }}{{ nilMap["a"] }}{{ nilMap[0] }}]`, "[]"},
+		{`[{{ nilSlice[0] }}{{ nilSlice.0 }}{{ nilSlice[:1] }}]`, "[]"},
+		{`[{{ nilUser.Name }}{{ nilUser.Boss.Name }}{{ nilUser["Name"] }}]`, "[]"},
+		{`[{{ nilIface.a }}{{ nilIface[0] }}{{ nilIface["a"] }}]`, "[]"},
+		{`[{{ nilSync.a }}{{ nilSync[0] }}{{ nilSync["a"] }}]`, "[]"},
+		{`[{{ user.Boss.Name }}{{ user.Tags[0] }}{{ user.Extra.a }}{{ user.Any.a }}]`, "[]"},
+		{`{{ items[1] }}{{ items.0 }}{{ items[:1] | join:"," }}`, "baa"},
+		{`[{{ nilItems[0] }}{{ nilItems[:1] }}]`, "[]"},
+		{`{{ if nilUser }}T{{ else }}F{{ end }}{{ if user.Boss }}T{{ else }}F{{ end }}`, "FF"},
+		{`{{ if nilMap }}T{{ else }}F{{ end }}{{ if nilSlice }}T{{ else }}F{{ end }}`, "FF"},
+		{`{{ if nilIface }}T{{ else }}F{{ end }}{{ if user.Any }}T{{ else }}F{{ end }}`, "FF"},
+		{`{{ if nilSync }}T{{ else }}F{{ end }}{{ if user }}T{{ else }}F{{ end }}`, "FT"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+	if result := renderTest(t, `[{{ a.b }}{{ a[0] }}{{ a["b"] }}]`, nil); result != "[]" {
+		t.Errorf("nil data: got %q", result)
+	}
+}
+
+func TestFieldTags(t *testing.T) {
+	type post struct {
+		PostTitle string `json:"title,omitempty" fasttpl:"heading"`
+		Body      string `json:"body"`
+		Hidden    string `json:"-"`
+	}
+	data := map[string]any{"post": post{PostTitle: "Hello", Body: "World", Hidden: "h"}}
+
+	if result := renderTest(t, `{{ post.title }}/{{ post.body }}/{{ post.PostTitle }}`, data, WithFieldTag("json")); result != "Hello/World/Hello" {
+		t.Errorf("json tag: got %q", result)
+	}
+	if result := renderTest(t, `{{ post.heading }}`, data, WithFieldTag("fasttpl")); result != "Hello" {
+		t.Errorf("fasttpl tag: got %q", result)
+	}
+	if result := renderTest(t, `[{{ post.title }}]{{ post.body }}`, data); result != "[]World" {
+		t.Errorf("without tag option: got %q", result)
+	}
+
+	tpl, err := Compile(`{{ title }}`, WithFieldTag("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl.PrecomputeFieldAccess(reflect.TypeOf(post{}))
+	if result, err := tpl.RenderString(post{PostTitle: "Pre"}); err != nil || result != "Pre" {
+		t.Errorf("precomputed: got %q (%v)", result, err)
+	}
+
+	// sortby and where find fields the way paths do
+	posts := map[string]any{"posts": []post{{PostTitle: "b", Body: "x"}, {PostTitle: "a", Body: "y"}}}
+	src := `{{ range p in posts | sortby:"title" }}{{ $p.title }}{{ end }}|{{ range p in posts | where:"body":"x" }}{{ $p.title }}{{ end }}`
+	if result := renderTest(t, src, posts, WithFieldTag("json")); result != "ab|b" {
+		t.Errorf("sortby and where: got %q", result)
+	}
+	// Filter sets replacing the defaults get the tag from TaggedTypedFilters
+	sortby := TaggedTypedFilters("json")["sortby"]
+	renamed := TypedFilters{"order": func(v any, args []string) (any, error) { return sortby(v, args) }}
+	if result := renderTest(t, `{{ range p in posts | order:"title" }}{{ $p.title }}{{ end }}`, posts, WithFieldTag("json"), WithTypedFilters(renamed)); result != "ab" {
+		t.Errorf("renamed sortby: got %q", result)
+	}
+}
+
+func TestPrecomputeDuringRender(t *testing.T) {
+	type inner struct{ City string }
+	type user struct {
+		Name    string
+		Address inner
+	}
+	tpl, err := Compile(`{{ Name }} {{ Address.City }}{{ if Name == "x" }}!{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := user{Name: "x", Address: inner{City: "Oslo"}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if result, err := tpl.RenderString(data); err != nil || result != "x Oslo!" {
+					t.Errorf("got %q (%v)", result, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		tpl.PrecomputeFieldAccess(reflect.TypeOf(data))
+	}
+	wg.Wait()
+}
+
+type labels map[string]string
+
+func (l labels) Count() int { return len(l) }
+
+func TestPrecomputeMaps(t *testing.T) {
+	type user struct{ Name string }
+	tpl, err := Compile(`{{ title }} {{ users.bob.Name }} {{ tags.a }}{{ tags.Count }} {{ range u in users }}{{ $u.Name }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{
+		"title": "T",
+		"users": map[string]user{"bob": {"Bob"}},
+		"tags":  labels{"a": "x"},
+	}
+	tpl.PrecomputeFieldAccess(reflect.TypeOf(data))
+	if result, err := tpl.RenderString(data); err != nil || result != "T Bob x1 Bob" {
+		t.Errorf("got %q (%v)", result, err)
+	}
+
+	// Data of another type still renders after precomputing for maps
+	other := struct {
+		Title string `json:"title"`
+	}{"S"}
+	tpl = MustCompile(`{{ title }}`, WithFieldTag("json"))
+	tpl.PrecomputeFieldAccess(reflect.TypeOf(map[string]any{}))
+	if result, err := tpl.RenderString(other); err != nil || result != "S" {
+		t.Errorf("struct after map precompute: got %q (%v)", result, err)
+	}
+	if result, err := tpl.RenderString(map[string]string{"title": "M"}); err != nil || result != "M" {
+		t.Errorf("other map type after precompute: got %q (%v)", result, err)
+	}
+}
+
+type ifaceProfile struct {
+	Field string
+	Next  any
+}
+
+type ifaceOther struct{ Field int }
+
+func TestEmbeddedFields(t *testing.T) {
+	type Base struct {
+		ID   int
+		Name string
+	}
+	type audit struct{ Author string }
+	type entity struct {
+		Base
+		*audit
+		Label string
+	}
+	type page struct {
+		entity
+		Name string // shadows Base.Name
+	}
+	src := `{{ id }}|{{ label }}|{{ author }}|{{ name }}|{{ base.name }}`
+	data := []struct {
+		data     page
+		expected string
+	}{
+		{page{entity{Base{7, "inner"}, &audit{"ann"}, "l"}, "outer"}, "7|l|ann|outer|inner"},
+		{page{entity: entity{Base: Base{ID: 1}}}, "1||||"},
+	}
+	reflective := MustCompile(src)
+	precomputed := MustCompile(src)
+	precomputed.PrecomputeFieldAccess(reflect.TypeOf(page{}))
+	for _, tpl := range []*Template{reflective, precomputed} {
+		for _, c := range data {
+			if result, err := tpl.RenderString(c.data); err != nil || result != c.expected {
+				t.Errorf("expected %q, got %q (%v)", c.expected, result, err)
+			}
+			if result, err := tpl.RenderString(&c.data); err != nil || result != c.expected {
+				t.Errorf("pointer: expected %q, got %q (%v)", c.expected, result, err)
+			}
+		}
+	}
+
+	// The cached index is the full path through the embedded structs
+	st := precomputed.root.(seqNode)[4].(printNode).acc.(boundAcc).steps
+	if pc := st[0].(fieldStep).cached(); pc == nil || !slices.Equal(pc.fieldIndex, []int{0, 1, 0}) {
+		t.Errorf("author: expected index [0 1 0], got %+v", pc)
+	}
+}
+
+func TestPrecomputeInterfaces(t *testing.T) {
+	type item struct{ Name string }
+	type holder struct {
+		Data  any
+		Items [2]item
+		Ptr   *ifaceProfile
+	}
+	src := `{{ data.field }}|{{ data.next.field }}|{{ items[1].name }}|{{ items[:1][0].name }}|{{ ptr.field }}`
+	tpl := MustCompile(src)
+	tpl.PrecomputeFieldAccess(reflect.TypeOf(holder{}))
+
+	// Steps after the interface resolve against whatever it holds
+	cases := []struct {
+		data     holder
+		expected string
+	}{
+		{holder{Data: ifaceProfile{Field: "a", Next: &ifaceProfile{Field: "b"}}}, "a|b|||"},
+		{holder{Data: ifaceOther{Field: 1}, Items: [2]item{{"x"}, {"y"}}}, "1||y|x|"},
+		{holder{Data: map[string]any{"field": "m", "next": ifaceOther{2}}, Ptr: &ifaceProfile{Field: "p"}}, "m|2|||p"},
+		{holder{Data: &ifaceProfile{Field: "ptr"}}, "ptr||||"},
+	}
+	for _, c := range cases {
+		if result, err := tpl.RenderString(c.data); err != nil || result != c.expected {
+			t.Errorf("data %+v: expected %q, got %q (%v)", c.data.Data, c.expected, result, err)
+		}
+	}
+
+	// Index, slice and pointer steps carry the type on to the next field
+	steps := func(i int) []step { return tpl.root.(seqNode)[2*i].(printNode).acc.(boundAcc).steps }
+	for i, typ := range map[int]reflect.Type{2: reflect.TypeOf(item{}), 3: reflect.TypeOf(item{}), 4: reflect.TypeOf(ifaceProfile{})} {
+		st := steps(i)
+		if pc := st[len(st)-1].(fieldStep).cached(); pc == nil || pc.structType != typ {
+			t.Errorf("path %d: expected the last step cached for %v, got %+v", i, typ, pc)
+		}
+	}
+	if pc := steps(0)[1].(fieldStep).cached(); pc != nil {
+		t.Errorf("expected no cache past an interface, got %+v", pc)
+	}
+}
+
+func TestVars(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected []string
+	}{
+		{`{{ user.name }} {{ items }} {{ user.email | upper }}`, []string{"items", "user"}},
+		{`{{ range i in items | sortby:"name" }}{{ $i.name }}{{ $index }}{{ title }}{{ end }}`, []string{"items", "title"}},
+		{`{{ let n = count }}{{ $n }}{{ if a and not b or c > d.e }}{{ end }}`, []string{"a", "b", "c", "count", "d"}},
+		{`{{ with user }}{{ name }}{{ end }}{{ range p in 1..pages }}{{ end }}`, []string{"pages", "user"}},
+		{`{{ include $kind with post label=site.title }}{{ include "x" }}`, []string{"post", "site"}},
+		{`{{ price | number:places }}{{ "lit" }}{{ 3 }}`, []string{"price"}},
+		{`plain text`, nil},
+	}
+	for _, c := range cases {
+		tpl := MustCompile(c.src)
+		if vars := tpl.Vars(); !reflect.DeepEqual(vars, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, vars)
+		}
+	}
+}
+
+func TestPartials(t *testing.T) {
+	tpl := MustCompile(`{{ include "b" }}`)
+	if names := tpl.Partials(); len(names) != 0 {
+		t.Errorf("expected no partials, got %q", names)
+	}
+	tpl.RegisterPartial("b", MustCompile("B"))
+	tpl.RegisterPartial("a", MustCompile("A"))
+	if names := tpl.Partials(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("expected [a b], got %q", names)
+	}
+	if !tpl.HasPartial("a") || tpl.HasPartial("c") {
+		t.Errorf("HasPartial: got a=%v c=%v", tpl.HasPartial("a"), tpl.HasPartial("c"))
+	}
+	clone := tpl.Clone()
+	clone.RegisterPartial("c", MustCompile("C"))
+	if tpl.HasPartial("c") || !clone.HasPartial("c") {
+		t.Error("partials registered on a clone should not leak into the original")
+	}
+}
+
+func TestWithAs(t *testing.T) {
+	data := map[string]any{
+		"order": map[string]any{"id": 7, "customer": map[string]any{"name": "Ann"}},
+		"c":     "outer",
+	}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ with order.customer as c }}{{ $c.name }} placed {{ order.id }}{{ end }}`, "Ann placed 7"},
+		{`{{ with order.customer as c }}{{ c }}{{ end }}`, "outer"},
+		{`{{ with order.missing as c }}never{{ end }}`, ""},
+		{`{{ with order.customer.name as n }}{{ $n }}{{ end }}[{{ $n }}]`, "Ann[]"},
+		{`{{ range c in order.customer }}{{ with order.id as c }}{{ $c }}{{ end }}-{{ $c }}{{ end }}`, "7-Ann"},
+		{`{{ with order.customer }}{{ name }}{{ end }}`, "Ann"},
+		{`{{ with "a as b" }}ok{{ end }}`, "ok"},
+	}
+	for _, c := range cases {
+		if result := renderTest(t, c.src, data); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+	if vars := MustCompile(`{{ with order as o }}{{ $o.id }}{{ title }}{{ end }}{{ with user }}{{ name }}{{ end }}`).Vars(); !reflect.DeepEqual(vars, []string{"order", "title", "user"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+}
+
+func TestWithGlobals(t *testing.T) {
+	base := MustCompile(`{{ title }} | {{ site.name }} {{ year }}{{ include "footer" }}{{ with user }} {{ name }}/{{ year }}{{ end }}`)
+	base.RegisterPartial("footer", MustCompile(` ©{{ year }}`))
+	tpl := base.WithGlobals(map[string]any{"site": map[string]any{"name": "Acme"}, "year": 2026, "title": "Default"})
+
+	data := map[string]any{"title": "Home", "user": map[string]any{"name": "ann"}}
+	result, err := tpl.RenderString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Home | Acme 2026 ©2026 ann/2026"; result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+
+	// The original template is unchanged
+	if result, _ := base.RenderString(data); result != "Home |   © ann/" {
+		t.Errorf("expected the original template without globals, got %q", result)
+	}
+
+	// Strict mode only fails once the globals miss too
+	strict := MustCompile(`{{ year }}{{ nope }}`, WithStrictVars(true)).WithGlobals(map[string]any{"year": 1})
+	if _, err := strict.RenderString(nil); err == nil || err.Error() != `missing variable "nope" at template:1:11` {
+		t.Errorf("expected missing variable error, got %v", err)
+	}
+}
+
+func TestRenderMulti(t *testing.T) {
+	type request struct {
+		Title string
+		User  map[string]any
+	}
+	type app struct {
+		Name  string
+		Title string
+	}
+	tpl := MustCompile(`{{ Title }}|{{ Name }}|{{ User.name }}|{{ year }}|{{ missing }}`).WithGlobals(map[string]any{"year": 2026, "Name": "global"})
+	req := request{Title: "Page", User: map[string]any{"name": "ann"}}
+	cases := []struct {
+		sources  []any
+		expected string
+	}{
+		{[]any{req, app{Name: "App", Title: "App title"}}, "Page|App|ann|2026|"},
+		{[]any{app{Name: "App", Title: "App title"}, req}, "App title|App|ann|2026|"},
+		{[]any{map[string]any{"Title": "Map"}, req, app{Name: "App"}}, "Map|App|ann|2026|"},
+		{[]any{req}, "Page|global|ann|2026|"},
+		{nil, "|global||2026|"},
+	}
+	for _, c := range cases {
+		var sb strings.Builder
+		if err := tpl.RenderMulti(&sb, c.sources...); err != nil {
+			t.Fatal(err)
+		}
+		if sb.String() != c.expected {
+			t.Errorf("sources %v: expected %q, got %q", c.sources, c.expected, sb.String())
+		}
+	}
+
+	// A reused render context doesn't keep the previous call's sources
+	if result, _ := tpl.RenderString(req); result != "Page|global|ann|2026|" {
+		t.Errorf("expected no leftover sources, got %q", result)
+	}
+}
+
+func TestRenderBlock(t *testing.T) {
+	tpl := MustCompile(`<h1>{{ title }}</h1>{{ block "content" }}<ul>{{ range i in items }}{{ block "item" }}<li>{{ $i }}</li>{{ end }}{{ end }}</ul>{{ end }}{{ if admin }}{{ block "tools" }}[{{ title | upper }}]{{ end }}{{ end }}`)
+	data := map[string]any{"title": "Todo", "items": []string{"a", "b"}, "admin": false}
+	if result, err := tpl.RenderString(data); err != nil || result != "<h1>Todo</h1><ul><li>a</li><li>b</li></ul>" {
+		t.Errorf("whole template: got %q (%v)", result, err)
+	}
+	cases := []struct {
+		block    string
+		expected string
+	}{
+		{"content", "<ul><li>a</li><li>b</li></ul>"},
+		{"tools", "[TODO]"},
+		{"item", "<li></li>"},
+	}
+	for _, c := range cases {
+		var sb strings.Builder
+		if err := tpl.RenderBlock(&sb, c.block, data); err != nil || sb.String() != c.expected {
+			t.Errorf("block %q: expected %q, got %q (%v)", c.block, c.expected, sb.String(), err)
+		}
+	}
+	if err := tpl.RenderBlock(io.Discard, "missing", data); err == nil || err.Error() != `block "missing" not found` {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+	if vars := tpl.Vars(); !reflect.DeepEqual(vars, []string{"admin", "items", "title"}) {
+		t.Errorf("Vars: got %q", vars)
+	}
+
+	// A block without a quoted name is an ordinary variable
+	if result := renderTest(t, `{{ block }} {{ block.x }}`, map[string]any{"block": map[string]any{"x": 1}}); result != "map[x:1] 1" {
+		t.Errorf("block variable: got %q", result)
+	}
+	errCases := map[string]string{
+		`{{ block "a" }}x{{ end }}{{ block "a" }}y{{ end }}`: `template:1:26: block "a": declared more than once`,
+		"{{ block \"a\" }}\nx":                               `template:2:2: unclosed "block" opened at template:1:1`,
+	}
+	for src, expected := range errCases {
+		if _, err := Compile(src); err == nil || err.Error() != expected {
+			t.Errorf("%q: expected %q, got %v", src, expected, err)
+		}
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	cases := []struct {
+		src      string
+		custom   bool // compile with filters replacing the defaults
+		folded   bool
+		expected string
+	}{
+		{`{{ 2 }}`, false, true, "2"},
+		{`{{ "<a>" | upper }}`, false, true, "&lt;A&gt;"},
+		{`{{ raw "<a>" }}`, false, true, "<a>"},
+		{`{{ "hello world" | truncate:5:"…" | title }}`, false, true, "Hell…"},
+		{`{{ 1234.5 | number:2 }}`, false, true, "1,234.50"},
+		{`{{ "a" | truncate:$n }}`, false, false, "a"},
+		{`{{ name | upper }}`, false, false, "ANN"},
+		{`{{ "x" | wrap }}`, false, false, "[x]"},
+		{`{{ "x" | shout }}`, true, false, "x!"},
+		// Filters replacing the defaults may not be pure, whatever their names
+		{`{{ "x" | upper }}`, true, false, "X1"},
+		{`{{ 2 }}`, true, true, "2"},
+	}
+	calls := 0
+	filters := DefaultFilters()
+	filters["shout"] = func(s string, _ []string) (string, error) { return s + "!", nil }
+	filters["upper"] = func(s string, _ []string) (string, error) {
+		calls++
+		return strings.ToUpper(s) + strconv.Itoa(calls), nil
+	}
+	wrap := WriterFilters{"wrap": func(w io.Writer, in string, _ []string) error {
+		_, err := io.WriteString(w, "["+in+"]")
+		return err
+	}}
+	data := map[string]any{"name": "ann", "n": 3}
+	for _, c := range cases {
+		opts := []Option{WithWriterFilters(wrap)}
+		if c.custom {
+			opts = append(opts, WithFilters(filters))
+		}
+		calls = 0
+		tpl := MustCompile(c.src, opts...)
+		if _, folded := tpl.root.(constNode); folded != c.folded {
+			t.Errorf("%s: expected folded=%v, got root %T", c.src, c.folded, tpl.root)
+		}
+		if result, err := tpl.RenderString(data); err != nil || result != c.expected {
+			t.Errorf("%s: expected %q, got %q (%v)", c.src, c.expected, result, err)
+		}
+	}
+
+	// Folding reaches into blocks, and leaves errors to the render
+	tpl := MustCompile(`{{ if x }}{{ block "b" }}{{ "b" | upper }}{{ end }}{{ end }}{{ "x" | round:"y" }}`)
+	if _, folded := tpl.blocks["b"].(constNode); !folded {
+		t.Errorf("block body not folded: %T", tpl.blocks["b"])
+	}
+	if _, err := tpl.RenderString(nil); err == nil {
+		t.Error("expected the filter error at render time")
+	}
+
+	// An overridden builtin, extra filters or a custom escaper prevent it
+	filters = DefaultFilters()
+	filters["upper"] = func(s string, _ []string) (string, error) { return "U", nil }
+	for _, tpl := range []*Template{
+		MustCompile(`{{ "a" | upper }}`, WithFilters(filters)),
+		MustCompile(`{{ "u" }}`, WithEscaper(strings.ToUpper)),
+	} {
+		if _, folded := tpl.root.(constNode); folded {
+			t.Errorf("unexpectedly folded to %q", tpl.root.(constNode).text)
+		}
+		if result, err := tpl.RenderString(nil); err != nil || result != "U" {
+			t.Errorf("expected %q, got %q (%v)", "U", result, err)
+		}
+	}
+	var sb strings.Builder
+	extra := Filters{"upper": func(s string, _ []string) (string, error) { return "extra", nil }}
+	if err := MustCompile(`{{ "a" | upper }}`).RenderWith(&sb, nil, extra); err != nil || sb.String() != "extra" {
+		t.Errorf("RenderWith over folded tag: got %q (%v)", sb.String(), err)
+	}
+}
+
+func TestRenderWith(t *testing.T) {
+	wrap := WriterFilters{"wrap": func(w io.Writer, in string, _ []string) error {
+		_, err := io.WriteString(w, "["+in+"]")
+		return err
+	}}
+	tpl := MustCompile(`{{ price | money }} {{ name | upper }} {{ items | length }} {{ name | wrap }} {{ include "p" }}`, WithWriterFilters(wrap))
+	tpl.RegisterPartial("p", MustCompile(`{{ price | money:"!" }}`))
+	data := map[string]any{"price": 4.5, "name": "ann", "items": []int{1, 2}}
+	extra := Filters{
+		"money":  func(s string, args []string) (string, error) { return "€" + s + strings.Join(args, ""), nil },
+		"upper":  func(s string, _ []string) (string, error) { return strings.ToUpper(s[:1]) + s[1:], nil },
+		"length": func(s string, _ []string) (string, error) { return "len", nil },
+		"wrap":   func(s string, _ []string) (string, error) { return "<" + s + ">", nil },
+	}
+	var sb strings.Builder
+	if err := tpl.RenderWith(&sb, data, extra); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "€4.5 Ann len &lt;ann&gt; €4.5!"; sb.String() != expected {
+		t.Errorf("expected %q, got %q", expected, sb.String())
+	}
+
+	// The extra filters don't outlive the render
+	if _, err := tpl.RenderString(data); err == nil || err.Error() != `unknown filter "money" at template:1:1` {
+		t.Errorf("expected unknown filter error after RenderWith, got %v", err)
+	}
+	sb.Reset()
+	if err := MustCompile(`{{ name | upper }}`).RenderWith(&sb, data, nil); err != nil || sb.String() != "ANN" {
+		t.Errorf("nil extra: got %q (%v)", sb.String(), err)
+	}
+}
+
+func TestMissingHandler(t *testing.T) {
+	var asked []string
+	handler := func(path string) (string, bool) {
+		asked = append(asked, path)
+		switch path {
+		case "user.avatar":
+			return "/img/default.png", true
+		case "tagline":
+			return "<none>", true
+		}
+		return "", false
+	}
+	data := map[string]any{"user": map[string]any{"name": "Ann"}, "items": []string{"a"}}
+	cases := []struct {
+		src      string
+		expected string
+		asked    string
+	}{
+		{`{{ user.avatar }}`, "/img/default.png", "user.avatar"},
+		{`{{ user.name }}`, "Ann", ""},
+		{`[{{ user.email }}]`, "[]", "user.email"},
+		{`{{ tagline }}|{{ raw tagline }}`, "&lt;none&gt;|<none>", "tagline tagline"},
+		{`{{ user.avatar | upper }}`, "/IMG/DEFAULT.PNG", "user.avatar"},
+		{`{{ user.email | default:"n/a" }}`, "n/a", "user.email"},
+		{`{{ range i in items }}{{ $i.x }}{{ end }}`, "", "$i.x"},
+		{`[{{ coalesce(user.avatar) }}{{ if user.avatar == nil }}nil{{ end }}]`, "[nil]", ""},
+		{`{{ if user.avatar }}y{{ else }}n{{ end }}`, "n", ""},
+	}
+	for _, c := range cases {
+		asked = nil
+		if result := renderTest(t, c.src, data, WithMissingHandler(handler)); result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+		if got := strings.Join(asked, " "); got != c.asked {
+			t.Errorf("%s: expected the handler asked for %q, got %q", c.src, c.asked, got)
+		}
+	}
+
+	// Strict mode reports the missing path before the handler is asked
+	if _, err := renderTestErr(`{{ user.avatar }}`, data, WithMissingHandler(handler), WithStrictVars(true)); err == nil {
+		t.Error("strict: expected an error")
+	}
+
+	cc := NewCompileCache(10)
+	a, _ := cc.Compile(`{{ x }}`, WithMissingHandler(handler))
+	b, _ := cc.Compile(`{{ x }}`)
+	if a == b {
+		t.Error("templates with and without a missing handler share a cache entry")
+	}
+}
+
+func TestStrictVars(t *testing.T) {
+	data := map[string]any{"user": map[string]any{"name": "bob"}, "items": []int{1}}
+	cases := []struct {
+		src  string
+		path string
+	}{
+		{`{{ user.email }}`, "user.email"},
+		{`{{ if user.admin }}x{{ end }}`, "user.admin"},
+		{`{{ range i in user.posts }}x{{ end }}`, "user.posts"},
+		{`{{ with account }}x{{ end }}`, "account"},
+		{`{{ range i in items }}{{ $i.name }}{{ end }}`, "$i.name"},
+	}
+	for _, c := range cases {
+		tpl, err := Compile(c.src, WithStrictVars(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tpl.RenderString(data)
+		if err == nil || !strings.Contains(err.Error(), `"`+c.path+`"`) {
+			t.Errorf("%q: expected missing variable error naming %q, got %v", c.src, c.path, err)
+		}
+		if _, err := renderTestErr(c.src, data); err != nil {
+			t.Errorf("%q: lenient mode should not fail, got %v", c.src, err)
+		}
+	}
+
+	if result := renderTest(t, `{{ user.name }}`, data, WithStrictVars(true)); result != "bob" {
+		t.Errorf("expected %q, got %q", "bob", result)
+	}
+}
+
+func TestIncludeWithContext(t *testing.T) {
+	tpl, err := Compile(`{{ range item in items }}{{ include "card" with $item }}{{ end }}|{{ include "badge" label="Hi" count=3 }}|{{ include "badge" label=user.name count=$count }}|{{ include "plain" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, _ := Compile(`[{{ name }}{{ include "badge" label=name count=1 }}]`)
+	badge, _ := Compile(`<{{ $label }}:{{ $count }}>`)
+	plain, _ := Compile(`{{ user.name }}`)
+	tpl.RegisterPartial("card", card)
+	tpl.RegisterPartial("badge", badge)
+	tpl.RegisterPartial("plain", plain)
+	card.RegisterPartial("badge", badge)
+
+	result, err := tpl.RenderString(map[string]any{
+		"items": []map[string]any{{"name": "a"}, {"name": "b"}},
+		"user":  map[string]any{"name": "bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[a<a:1>][b<b:1>]|<Hi:3>|<bob:>|bob"
+	if result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+
+	if _, err := Compile(`{{ include "card" oops }}`); err == nil {
+		t.Error("expected error for malformed include argument")
+	}
+}
+
+func TestDynamicInclude(t *testing.T) {
+	tpl, err := Compile(`{{ range w in widgets }}{{ include $w.type with $w }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart, _ := Compile(`<chart {{ title }}>`)
+	table, _ := Compile(`<table {{ title }}>`)
+	tpl.RegisterPartial("chart", chart)
+	tpl.RegisterPartial("table", table)
+
+	widgets := []map[string]any{{"type": "chart", "title": "a"}, {"type": "table", "title": "b"}}
+	result, err := tpl.RenderString(map[string]any{"widgets": widgets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<chart a><table b>" {
+		t.Errorf("expected %q, got %q", "<chart a><table b>", result)
+	}
+
+	_, err = tpl.RenderString(map[string]any{"widgets": []map[string]any{{"type": "map"}}})
+	if err == nil || !strings.Contains(err.Error(), `"map"`) {
+		t.Errorf("expected not found error naming the resolved partial, got %v", err)
+	}
+}
+
+func TestIncludeNotFoundHint(t *testing.T) {
+	tpl := MustCompile(`{{ include "hedaer" }}`)
+	if _, err := tpl.RenderString(nil); err == nil || err.Error() != `include: partial "hedaer" not found (no partials are registered)` {
+		t.Errorf("expected error without partials, got %v", err)
+	}
+	tpl.RegisterPartial("header", MustCompile("H"))
+	tpl.RegisterPartial("footer", MustCompile("F"))
+	if _, err := tpl.RenderString(nil); err == nil || err.Error() != `include: partial "hedaer" not found (did you mean "header"? available: footer, header)` {
+		t.Errorf("expected a suggestion, got %v", err)
+	}
+
+	tpl = MustCompile(`{{ include "sidebar" }}`)
+	tpl.RegisterPartial("header", MustCompile("H"))
+	if _, err := tpl.RenderString(nil); err == nil || err.Error() != `include: partial "sidebar" not found (available: header)` {
+		t.Errorf("expected the available partials without a suggestion, got %v", err)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"header", "header", 0},
+		{"hedaer", "header", 2},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+	}
+	for _, c := range cases {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRecursiveInclude(t *testing.T) {
+	tpl, err := Compile(`{{ include "comment" with root }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment, _ := Compile(`({{ text }}{{ range r in replies }}{{ include "comment" with $r }}{{ end }})`)
+	tpl.RegisterPartial("comment", comment)
+
+	tree := map[string]any{"root": map[string]any{
+		"text": "a",
+		"replies": []any{
+			map[string]any{"text": "b", "replies": []any{map[string]any{"text": "c"}}},
+			map[string]any{"text": "d"},
+		},
+	}}
+	result, err := tpl.RenderString(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "(a(b(c))(d))" {
+		t.Errorf("expected %q, got %q", "(a(b(c))(d))", result)
+	}
+
+	loop, _ := Compile(`{{ include "loop" }}`, WithMaxIncludeDepth(10))
+	loop.RegisterPartial("loop", loop)
+	if _, err := loop.RenderString(nil); err == nil || !strings.Contains(err.Error(), "recursion limit exceeded") {
+		t.Errorf("expected recursion limit error, got %v", err)
+	}
+}
+
+func TestRenderContext(t *testing.T) {
+	tpl, err := Compile(`{{ range i in items }}{{ $i }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"items": []int{1, 2, 3}}
+
+	var sb strings.Builder
+	if err := tpl.RenderContext(context.Background(), &sb, data); err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != "123" {
+		t.Errorf("expected %q, got %q", "123", sb.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sb.Reset()
+	if err := tpl.RenderContext(ctx, &sb, data); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if sb.Len() != 0 {
+		t.Errorf("expected no output after cancel, got %q", sb.String())
+	}
+
+	// Canceling mid-loop stops before the next iteration
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stop := TypedFilters{"stop": func(v any, _ []string) (any, error) {
+		cancel()
+		return v, nil
+	}}
+	tpl, err = Compile(`{{ range i in items }}{{ $i | stop }}{{ end }}`, WithTypedFilters(stop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.Reset()
+	if err := tpl.RenderContext(ctx, &sb, data); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if sb.String() != "1" {
+		t.Errorf("expected %q, got %q", "1", sb.String())
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	var slow bool
+	nap := TypedFilters{"nap": func(v any, _ []string) (any, error) {
+		if slow {
+			time.Sleep(40 * time.Millisecond)
+		}
+		return v, nil
+	}}
+	tpl, err := Compile(`{{ range i in items }}{{ $i | nap }}{{ end }}`,
+		WithTypedFilters(nap), WithRenderTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"items": []int{1, 2, 3}}
+
+	// The deadline is checked before the next iteration
+	slow = true
+	var sb strings.Builder
+	if err := tpl.Render(&sb, data); !errors.Is(err, ErrRenderTimeout) {
+		t.Errorf("expected ErrRenderTimeout, got %v", err)
+	}
+	if sb.String() != "1" {
+		t.Errorf("expected %q, got %q", "1", sb.String())
+	}
+
+	// Each render gets its own deadline
+	slow = false
+	if result, err := tpl.RenderString(data); err != nil || result != "123" {
+		t.Errorf("expected %q, got %q (%v)", "123", result, err)
+	}
+
+	cc := NewCompileCache(10)
+	a, _ := cc.Compile(`{{ x }}`, WithRenderTimeout(time.Second))
+	b, _ := cc.Compile(`{{ x }}`)
+	if a == b {
+		t.Error("templates with different timeouts share a cache entry")
+	}
+}
+
+// flushRecorder records what had been written each time it is flushed.
+type flushRecorder struct {
+	strings.Builder
+	flushes []string
+}
+
+func (r *flushRecorder) Flush() { r.flushes = append(r.flushes, r.String()) }
+
+func TestRenderStream(t *testing.T) {
+	tpl, err := Compile(`<h1>{{ title }}</h1>{{ missing }}{{ range i in items }}{{ $i }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{"title": "Hi", "items": []int{1, 2}}
+
+	var rec flushRecorder
+	if err := tpl.RenderStream(&rec, data); err != nil {
+		t.Fatal(err)
+	}
+	if rec.String() != "<h1>Hi</h1>12" {
+		t.Errorf("expected %q, got %q", "<h1>Hi</h1>12", rec.String())
+	}
+	// Nodes that wrote nothing don't flush
+	expected := []string{"<h1>", "<h1>Hi", "<h1>Hi</h1>", "<h1>Hi</h1>12"}
+	if !reflect.DeepEqual(rec.flushes, expected) {
+		t.Errorf("expected flushes %q, got %q", expected, rec.flushes)
+	}
+
+	// Writers that can't flush render as with Render
+	var sb strings.Builder
+	if err := tpl.RenderStream(&sb, data); err != nil || sb.String() != "<h1>Hi</h1>12" {
+		t.Errorf("expected %q, got %q (%v)", "<h1>Hi</h1>12", sb.String(), err)
+	}
+
+	single := MustCompile(`{{ title }}`)
+	rec = flushRecorder{}
+	if err := single.RenderStream(&rec, data); err != nil || len(rec.flushes) != 1 || rec.flushes[0] != "Hi" {
+		t.Errorf("expected one flush of %q, got %q (%v)", "Hi", rec.flushes, err)
+	}
+
+	// A canceled context stops the render before any output, flushing or not
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = flushRecorder{}
+	if err := tpl.RenderStreamContext(ctx, &rec, data); !errors.Is(err, context.Canceled) || rec.String() != "" || len(rec.flushes) != 0 {
+		t.Errorf("canceled: expected no output and context.Canceled, got %q (%v)", rec.String(), err)
+	}
+	sb.Reset()
+	if err := single.RenderStreamContext(ctx, &sb, data); !errors.Is(err, context.Canceled) || sb.String() != "" {
+		t.Errorf("canceled without flusher: expected no output, got %q (%v)", sb.String(), err)
+	}
+}
+
+func TestConcurrentEscaping(t *testing.T) {
+	tpl, err := Compile(`{{ a }}|{{ b | upper }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a := strings.Repeat(fmt.Sprintf("<%d>", i), 50)
+			expected := htmlEscapeFast(a) + "|&amp;" + fmt.Sprint(i)
+			for j := 0; j < 200; j++ {
+				if got := htmlEscapeFast(a); got != strings.Repeat(fmt.Sprintf("&lt;%d&gt;", i), 50) {
+					t.Errorf("escape corrupted: %q", got)
+					return
+				}
+				result, err := tpl.RenderString(map[string]any{"a": a, "b": "&" + fmt.Sprint(i)})
+				if err != nil || result != expected {
+					t.Errorf("expected %q, got %q (%v)", expected, result, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClone(t *testing.T) {
+	base, err := Compile(`<main>{{ include "content" }}</main>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.RegisterPartial("content", MustCompile("base"))
+
+	a, b := base.Clone(), base.Clone()
+	a.RegisterPartial("content", MustCompile("a"))
+	b.RegisterPartial("content", MustCompile("b"))
+
+	for tpl, expected := range map[*Template]string{base: "<main>base</main>", a: "<main>a</main>", b: "<main>b</main>"} {
+		if result, err := tpl.RenderString(nil); err != nil || result != expected {
+			t.Errorf("expected %q, got %q (%v)", expected, result, err)
+		}
+	}
+}
+
+func TestConcurrentRegisterPartial(t *testing.T) {
+	// Like a server sharing one layout between requests: some handlers
+	// register partials on it while others render it or a clone of it
+	layout := MustCompile(`<main>{{ include "content" }}</main>{{ if has_nav }}{{ include "nav" }}{{ end }}`)
+	layout.RegisterPartial("content", MustCompile("home"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			page := MustCompile(fmt.Sprintf("page %d", i))
+			for j := 0; j < 100; j++ {
+				layout.RegisterPartial("nav", MustCompile(fmt.Sprintf("nav %d", i)))
+				if _, err := layout.RenderString(map[string]any{"has_nav": true}); err != nil {
+					t.Error(err)
+					return
+				}
+				req := layout.Clone()
+				req.RegisterPartial("content", page)
+				expected := fmt.Sprintf("<main>page %d</main>", i)
+				if result, err := req.RenderString(nil); err != nil || result != expected {
+					t.Errorf("expected %q, got %q (%v)", expected, result, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := layout.Partials(); !reflect.DeepEqual(got, []string{"content", "nav"}) {
+		t.Errorf("expected content and nav partials, got %q", got)
+	}
+}
+
+func TestRenderBuffer(t *testing.T) {
+	row := MustCompile(`<li>{{ name }}</li>`)
+	failing := MustCompile(`<li>{{ missing }}</li>`, WithStrictVars(true))
+
+	buf := AcquireBuffer()
+	defer ReleaseBuffer(buf)
+	if buf.Len() != 0 {
+		t.Fatalf("expected an empty buffer, got %q", buf.String())
+	}
+	for _, item := range []string{"a", "<b>"} {
+		if err := row.RenderBuffer(buf, map[string]any{"name": item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := buf.Len()
+	if err := failing.RenderBuffer(buf, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	buf.Truncate(n)
+	if expected := "<li>a</li><li>&lt;b&gt;</li>"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	ReleaseBuffer(nil)
+}
+
+func TestRenderBuffered(t *testing.T) {
+	tpl := MustCompile(`<p>{{ name }}</p>{{ missing }}`, WithStrictVars(true))
+
+	var sb strings.Builder
+	if err := tpl.RenderBuffered(&sb, map[string]any{"name": "Ann"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if sb.Len() != 0 {
+		t.Errorf("expected no output on error, got %q", sb.String())
+	}
+	// Render itself still streams
+	if err := tpl.Render(&sb, map[string]any{"name": "Ann"}); err == nil || sb.String() != "<p>Ann</p>" {
+		t.Errorf("expected the partial page and an error, got %q (%v)", sb.String(), err)
+	}
+
+	w := &countingWriter{w: io.Discard}
+	if err := tpl.RenderBuffered(w, map[string]any{"name": "Ann", "missing": "!"}); err != nil || w.n != 11 {
+		t.Errorf("expected 11 bytes, got %d (%v)", w.n, err)
+	}
+}
+
+// writeCounter counts the Write calls made on it, failing them with err.
+type writeCounter struct {
+	strings.Builder
+	calls int
+	err   error
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.calls++
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.Builder.Write(p)
+}
+
+func TestRenderFlush(t *testing.T) {
+	tpl := MustCompile(`{{ range i in 100 }}<li>{{ $i }}</li>{{ end }}`)
+	expected := renderTest(t, `{{ range i in 100 }}<li>{{ $i }}</li>{{ end }}`, nil)
+
+	w := &writeCounter{}
+	if err := tpl.RenderFlush(w, nil); err != nil || w.String() != expected || w.calls != 1 {
+		t.Errorf("expected one write of the page, got %d (%v)", w.calls, err)
+	}
+
+	// A *bufio.Writer is used as is, and flushed
+	w = &writeCounter{}
+	bw := bufio.NewWriterSize(w, 16)
+	if err := tpl.RenderFlush(bw, nil); err != nil || w.String() != expected || bw.Buffered() != 0 {
+		t.Errorf("expected a flushed page, got %d bytes (%v)", w.Len(), err)
+	}
+
+	// Output before an error is flushed, and the render error wins
+	strict := MustCompile(`<p>{{ name }}</p>{{ missing }}`, WithStrictVars(true))
+	w = &writeCounter{}
+	if err := strict.RenderFlush(w, map[string]any{"name": "Ann"}); err == nil || w.String() != "<p>Ann</p>" {
+		t.Errorf("expected the partial page and an error, got %q (%v)", w.String(), err)
+	}
+	errWrite := errors.New("disk full")
+	if err := tpl.RenderFlush(&writeCounter{err: errWrite}, nil); !errors.Is(err, errWrite) {
+		t.Errorf("expected the flush error, got %v", err)
+	}
+}
+
+func TestRenderToBytesNested(t *testing.T) {
+	// A function rendering a fragment with RenderToBytes while the page is
+	// itself being rendered with RenderToBytes must not share its buffer
+	badge := MustCompile(`<b>{{ label }}</b>`)
+	funcs := Funcs{
+		"badge": func(args ...any) (any, error) {
+			out, err := badge.RenderToBytes(map[string]any{"label": args[0]})
+			return SafeString(out), err
+		},
+	}
+	page := MustCompile(`[{{ badge(a) }}{{ title }}{{ badge(b) }}]`, WithFuncs(funcs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := map[string]any{"a": fmt.Sprint("a", i), "b": fmt.Sprint("b", i), "title": strings.Repeat("x", 100*i)}
+			expected := fmt.Sprintf("[<b>a%d</b>%s<b>b%d</b>]", i, data["title"], i)
+			for j := 0; j < 100; j++ {
+				out, err := page.RenderToBytes(data)
+				if err != nil || string(out) != expected {
+					t.Errorf("expected %q, got %q (%v)", expected, out, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMustCompile(t *testing.T) {
+	if result, _ := MustCompile(`Hi {{ name }}`).RenderString(map[string]any{"name": "Ann"}); result != "Hi Ann" {
+		t.Errorf("expected %q, got %q", "Hi Ann", result)
+	}
+
+	for name, compile := range map[string]func(){
+		"MustCompile":     func() { MustCompile(`{{ if x }}`) },
+		"MustCompileFile": func() { MustCompileFile("testdata/missing.html") },
+	} {
+		func() {
+			defer func() {
+				msg, _ := recover().(string)
+				if !strings.HasPrefix(msg, "fasttpl: "+name) {
+					t.Errorf("%s: expected a panic with the compile error, got %q", name, msg)
+				}
+				if name == "MustCompile" && !strings.Contains(msg, `unclosed "if"`) {
+					t.Errorf("%s: expected the underlying error in %q", name, msg)
+				}
+			}()
+			compile()
+		}()
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+		line     int
+		column   int
+	}{
+		{"hello\n  {{ name", "template:2:3: unterminated tag", 2, 3},
+		{"a\nb {{# note", "template:2:3: unterminated comment (missing #}})", 2, 3},
+		{"{{ if x }}\n\n  {{ range r }}{{ end }}\n{{ end }}", "template:3:3: range syntax: range item in path", 3, 3},
+		{"{{ if x }}\n{{ elif }}\n{{ end }}", "template:2:1: if syntax: missing condition", 2, 1},
+		{"héllo {{ let x }}", "template:1:7: let syntax: let name = path", 1, 7},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.src)
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%q: expected a *ParseError, got %v", c.src, err)
+			continue
+		}
+		if err.Error() != c.expected || pe.Line != c.line || pe.Column != c.column {
+			t.Errorf("%q: expected %q, got %q (line %d, column %d)", c.src, c.expected, err, pe.Line, pe.Column)
+		}
+	}
+}
+
+// Operators the parser doesn't support must fail to compile, not spin.
+func TestMalformedExpressions(t *testing.T) {
+	cases := map[string]string{
+		`{{ a ? b }}`:             `template:1:1: unexpected "?" in a ? b`,
+		`{{ a + b }}`:             `template:1:1: unexpected "+" in a + b`,
+		`{{ f( }}`:                `template:1:1: unexpected "(" in f(`,
+		`{{ a == "" }}`:           `template:1:1: unexpected "=" in a == ""`,
+		`{{ a ?? b }}`:            `template:1:1: unexpected "?" in a ?? b`,
+		`{{{ x }}}`:               `template:1:1: unexpected "{" in { x`,
+		`{{ index(xs, 0).X }}`:    `template:1:1: unexpected "(" in index(xs, 0).X`,
+		`{{ let x = a + b }}`:     `template:1:1: unexpected "+" in a + b`,
+		`{{ if a ? b }}{{ end }}`: `template:1:1: unexpected "?" in a ? b`,
+	}
+	for src, expected := range cases {
+		done := make(chan error, 1)
+		go func() {
+			_, err := Compile(src)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || err.Error() != expected {
+				t.Errorf("%s: expected %q, got %v", src, expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: compile did not finish", src)
+		}
+	}
+}
+
+func TestRenderErrorPosition(t *testing.T) {
+	errBad := errors.New("bad input")
+	typed := DefaultTypedFilters()
+	typed["check"] = func(v any, _ []string) (any, error) { return nil, errBad }
+	data := map[string]any{"x": 1, "items": []int{1}}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"a\n  {{ x | check }}", `filter "check" at template:2:3: bad input`},
+		{"{{ if x | check }}y{{ end }}", `filter "check" at template:1:1: bad input`},
+		{"{{ if nope }}\n{{ elif x | upper | check == 1 }}{{ end }}", `filter "check" at template:2:1: bad input`},
+		{"{{ range i in items }}\n\t{{ $i | check }}{{ end }}", `filter "check" at template:2:2: bad input`},
+		{"{{ range i in items | check }}{{ end }}", `filter "check" at template:1:1: bad input`},
+		{"{{ with x }}\n{{ let y = 2 }} {{ x | nope }}{{ end }}", `unknown filter "nope" at template:2:17`},
+		{"{{ coalesce(x | check) }}", `filter "check" at template:1:1: bad input`},
+	}
+	for _, c := range cases {
+		_, err := renderTestErr(c.src, data, WithTypedFilters(typed))
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("%q: expected %q, got %v", c.src, c.expected, err)
+		}
+	}
+	if _, err := renderTestErr("{{ x | check }}", data, WithTypedFilters(typed)); !errors.Is(err, errBad) {
+		t.Errorf("expected the filter's error to be wrapped, got %v", err)
+	}
+
+	strict := []struct {
+		src      string
+		expected string
+	}{
+		{"{{ if x }}\n  {{ user.email }}{{ end }}", `missing variable "user.email" at template:2:3`},
+		{"{{ if x > 0 and user.admin }}y{{ end }}", `missing variable "user.admin" at template:1:1`},
+		{"{{ switch x }}{{ case 1 }}\n{{ include \"p\" with page }}{{ end }}", `missing variable "page" at template:2:1`},
+	}
+	for _, c := range strict {
+		tpl := MustCompile(c.src, WithStrictVars(true))
+		tpl.RegisterPartial("p", MustCompile(""))
+		if _, err := tpl.RenderString(data); err == nil || err.Error() != c.expected {
+			t.Errorf("%q: expected %q, got %v", c.src, c.expected, err)
+		}
+	}
+}
+
+func TestStrictFilters(t *testing.T) {
+	wrap := WriterFilters{"wrap": func(w io.Writer, in string, _ []string) error {
+		_, err := io.WriteString(w, in)
+		return err
+	}}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ name | upper | trim }}`, ""},
+		{`{{ items | length }} {{ name | wrap }} {{ "a|b" | upper }}`, ""},
+		{"a\n  {{ name | uper }}", `template:2:13: unknown filter "uper"`},
+		{`{{ name | upper | truncate:10 | nope:"x" }}`, `template:1:33: unknown filter "nope"`},
+		{"{{ if x }}\n{{ elif name | lenght > 2 }}{{ end }}", `template:2:16: unknown filter "lenght"`},
+		{`{{ range u in users | sortby:"name" |bogus }}{{ end }}`, `template:1:38: unknown filter "bogus"`},
+		{`{{ t("k", name |nope) }}`, `template:1:17: unknown filter "nope"`},
+		{`{{ (a ? b : c) | zz }}`, `template:1:18: unknown filter "zz"`},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.src, WithStrictFilters(true), WithWriterFilters(wrap))
+		if c.expected == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", c.src, err)
+			}
+			continue
+		}
+		var pe *ParseError
+		if !errors.As(err, &pe) || err.Error() != c.expected {
+			t.Errorf("%q: expected %q, got %v", c.src, c.expected, err)
+		}
+	}
+
+	// Without the option unknown filters only fail when rendered
+	if _, err := Compile(`{{ if x }}{{ name | uper }}{{ end }}`); err != nil {
+		t.Errorf("non-strict compile: %v", err)
+	}
+}
+
+func TestBlockBalance(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"{{ if a }}\n{{ range x in xs }}\n  {{ with y }}{{ end }}\n{{ end }}",
+			`template:4:10: unclosed "if" opened at template:1:1`},
+		{"{{ if a }}\n{{ range x in xs }}\n   {{ with y }}\n{{ end }}{{ end }}",
+			`template:4:19: unclosed "if" opened at template:1:1`},
+		{"a\n   {{ with y }}b", `template:2:17: unclosed "with" opened at template:2:4`},
+		{"{{ range x in xs }}{{ else }}", `template:1:30: unclosed "range" opened at template:1:1`},
+		{"a {{ end }}", `template:1:3: unexpected "end" with no open block`},
+		{"{{ if a }}{{ end }}\n{{ else }}", `template:2:1: unexpected "else" with no open block`},
+		{"{{ elif b }}", `template:1:1: unexpected "elif" with no open block`},
+		{"{{ with a }}{{ default }}{{ end }}", `template:1:13: unexpected "default" in "with" block`},
+		{"{{ if a }}{{ else }}{{ else }}{{ end }}", `template:1:21: unexpected "else" in "if" block`},
+		{"{{ switch a }}{{ case 1 }}", `template:1:27: unclosed "switch" opened at template:1:1`},
+		{"{{ switch a }}x{{ case 1 }}{{ end }}", `template:1:1: switch: only case and default may follow switch`},
+		{"{{ switch a }}{{ default }}{{ case 1 }}{{ end }}", `template:1:28: unexpected "case" in "switch" block`},
+		{"{{ switch a }}{{ case b }}{{ end }}", `template:1:15: case: "b" is not a literal`},
+		{"{{ switch }}{{ end }}", `template:1:1: switch syntax: missing value`},
+		{"{{ if a }}{{ case 1 }}{{ end }}", `template:1:11: unexpected "case" in "if" block`},
+	}
+	for _, c := range cases {
+		if _, err := Compile(c.src); err == nil || err.Error() != c.expected {
+			t.Errorf("%q: expected %q, got %v", c.src, c.expected, err)
+		}
+	}
+}
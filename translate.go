@@ -0,0 +1,64 @@
+package fasttpl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ----------------------------- Translation ----------------------------------
+
+// Translator looks up the messages printed by {{ t "key" }} and
+// {{ trans "key" }} tags. args holds the tag's positional arguments and
+// params its name=value ones, nil when there are none; a translator can
+// use either for placeholders and, for example, a count param to choose a
+// plural form. ok is false when there is no message for key, in which case
+// the tag prints the key itself.
+type Translator interface {
+	Translate(key string, args []any, params map[string]any) (msg string, ok bool)
+}
+
+// Catalog is a Translator backed by a map from keys to messages. Messages
+// may hold positional placeholders such as {0} and named ones such as
+// {name}; placeholders without a matching argument are left as written.
+type Catalog map[string]string
+
+// Translate implements Translator.
+func (c Catalog) Translate(key string, args []any, params map[string]any) (string, bool) {
+	msg, ok := c[key]
+	if !ok {
+		return "", false
+	}
+	if (len(args) == 0 && len(params) == 0) || !strings.Contains(msg, "{") {
+		return msg, true
+	}
+
+	var sb, scratch strings.Builder
+	for {
+		open := strings.IndexByte(msg, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(msg[open:], '}')
+		if end < 0 {
+			break
+		}
+		name := msg[open+1 : open+end]
+		v, found := params[name]
+		if i, err := strconv.Atoi(name); err == nil && !found {
+			found = i >= 0 && i < len(args)
+			if found {
+				v = args[i]
+			}
+		}
+		sb.WriteString(msg[:open])
+		if found {
+			scratch.Reset()
+			sb.WriteString(toStringFast(v, &scratch))
+		} else {
+			sb.WriteString(msg[open : open+end+1])
+		}
+		msg = msg[open+end+1:]
+	}
+	sb.WriteString(msg)
+	return sb.String(), true
+}
@@ -0,0 +1,64 @@
+package fasttpl
+
+import (
+	"fmt"
+	"testing"
+)
+
+// pluralTranslator picks a message by the count param, like a translator
+// with plural rules would.
+type pluralTranslator struct{}
+
+func (pluralTranslator) Translate(key string, _ []any, params map[string]any) (string, bool) {
+	if key != "items" {
+		return "", false
+	}
+	if params["count"] == 1 {
+		return "one item", true
+	}
+	return fmt.Sprintf("%v items", params["count"]), true
+}
+
+func TestTranslate(t *testing.T) {
+	catalog := Catalog{
+		"welcome":     "Welcome!",
+		"greeting":    "Hello, {name}! You have {0} new {1}.",
+		"html":        "<b>{0}</b>",
+		"partial":     "{0} and {1} and {other}",
+		"status.open": "Open",
+	}
+	data := map[string]any{"user": map[string]any{"name": "Zoë"}, "n": 3, "key": "status.open", "t": "tee"}
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{`{{ t "welcome" }}`, "Welcome!"},
+		{`{{ trans 'welcome' }}`, "Welcome!"},
+		{`{{ t "greeting" n "messages" name=user.name }}`, "Hello, Zoë! You have 3 new messages."},
+		{`{{ t "html" "x&y" }}`, "&lt;b&gt;x&amp;y&lt;/b&gt;"},
+		{`{{ t "partial" "a" }}`, "a and {1} and {other}"},
+		{`{{ t key }}`, "Open"},
+		{`{{ t "missing.key" }}`, "missing.key"},
+		{`{{ t }} {{ t | upper }}`, "tee TEE"},
+	}
+	for _, c := range cases {
+		tpl := MustCompile(c.src).WithTranslator(catalog)
+		result, err := tpl.RenderString(data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.src, err)
+		}
+		if result != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.src, c.expected, result)
+		}
+	}
+
+	// Without a translator the key is printed
+	if result := renderTest(t, `{{ t "welcome" name=user.name }}`, data); result != "welcome" {
+		t.Errorf("expected the key without a translator, got %q", result)
+	}
+
+	plural := MustCompile(`{{ t "items" count=1 }}, {{ t "items" count=n }}`).WithTranslator(pluralTranslator{})
+	if result, err := plural.RenderString(data); err != nil || result != "one item, 3 items" {
+		t.Errorf("expected plural forms, got %q (%v)", result, err)
+	}
+}
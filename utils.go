@@ -2,6 +2,7 @@ package fasttpl
 
 import (
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
@@ -47,6 +48,61 @@ func stringToReflectValue(s string) reflect.Value {
 	return globalValueCache.get(s)
 }
 
+// jsEscape escapes s for use inside a quoted JavaScript string, including in
+// an inline <script> or an event handler attribute. Quotes, backslashes,
+// HTML-significant characters, control characters and line separators are
+// written as \uXXXX escapes.
+func jsEscape(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		switch r {
+		case '\\', '\'', '"', '`', '<', '>', '&', '=', '\u2028', '\u2029':
+		default:
+			if r >= ' ' {
+				if sb.Cap() > 0 {
+					sb.WriteRune(r)
+				}
+				continue
+			}
+		}
+		if sb.Cap() == 0 {
+			sb.Grow(len(s) + 16)
+			sb.WriteString(s[:i])
+		}
+		fmt.Fprintf(&sb, "\\u%04X", r)
+	}
+	if sb.Cap() == 0 {
+		return s
+	}
+	return sb.String()
+}
+
+// cssEscape escapes s for use as a CSS value or inside a quoted CSS string.
+// Characters that could end the value, string, declaration or style element
+// are written as hex escapes followed by a space.
+func cssEscape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case 0, '\t', '\n', '\f', '\r', '"', '&', '\'', '(', ')', '+', '/', ':', ';', '<', '>', '\\', '{', '}':
+			if sb.Cap() == 0 {
+				sb.Grow(len(s) + 16)
+				sb.WriteString(s[:i])
+			}
+			fmt.Fprintf(&sb, "\\%x ", c)
+		default:
+			if sb.Cap() > 0 {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	if sb.Cap() == 0 {
+		return s
+	}
+	return sb.String()
+}
+
 // htmlEscapeFast is an optimized HTML escaper that minimizes allocations
 func htmlEscapeFast(s string) string {
 	// Quick scan for characters that need escaping
@@ -63,10 +119,9 @@ func htmlEscapeFast(s string) string {
 		return s
 	}
 
-	// Use pooled string builder for escaping
-	sb := stringBuilderPool.Get().(*strings.Builder)
-	sb.Reset()
-	defer stringBuilderPool.Put(sb)
+	// The result outlives this call, so build it in a fresh builder rather
+	// than one shared through a pool
+	var sb strings.Builder
 
 	// Pre-allocate capacity to avoid reallocation
 	sb.Grow(len(s) + len(s)/4)
@@ -89,9 +144,43 @@ func htmlEscapeFast(s string) string {
 		}
 	}
 
-	// To avoid allocation, use unsafe to get the string without copy
-	result := sb.String()
-	return result
+	return sb.String()
+}
+
+// htmlEscapeWriter HTML-escapes what is written through it the same way as
+// htmlEscapeFast.
+type htmlEscapeWriter struct{ w io.Writer }
+
+func (e htmlEscapeWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, c := range p {
+		var esc string
+		switch c {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		case '"':
+			esc = "&quot;"
+		case '\'':
+			esc = "&#39;"
+		default:
+			continue
+		}
+		if _, err := e.w.Write(p[start:i]); err != nil {
+			return start, err
+		}
+		if _, err := io.WriteString(e.w, esc); err != nil {
+			return i, err
+		}
+		start = i + 1
+	}
+	if _, err := e.w.Write(p[start:]); err != nil {
+		return start, err
+	}
+	return len(p), nil
 }
 
 // ----------------------------- Accessor compiler -----------------------------
@@ -101,17 +190,21 @@ func compileAccessor(expr string) (accessor, []pipe, error) {
 	if expr == "" {
 		return boundAcc{}, nil, nil
 	}
+	if cond, then, els, ok := splitTernary(expr); ok {
+		acc, err := compileTernary(cond, then, els)
+		return acc, nil, err
+	}
 
-	// Find first pipe
-	pipeIdx := strings.Index(expr, "|")
+	// Find first pipe outside of a quoted literal or parentheses
+	pipeIdx := indexTopLevel(expr, '|')
 	if pipeIdx == -1 {
 		// No pipes
-		acc, err := compilePath(expr)
+		acc, err := compileTerm(expr)
 		return acc, nil, err
 	}
 
 	path := fastTrim(expr[:pipeIdx])
-	acc, err := compilePath(path)
+	acc, err := compileTerm(path)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -126,7 +219,7 @@ func compileAccessor(expr string) (accessor, []pipe, error) {
 		if pipesStr == "" {
 			break
 		}
-		nextPipe := strings.Index(pipesStr, "|")
+		nextPipe := indexUnquoted(pipesStr, '|')
 		var pipeStr string
 		if nextPipe == -1 {
 			pipeStr = pipesStr
@@ -140,19 +233,20 @@ func compileAccessor(expr string) (accessor, []pipe, error) {
 			continue
 		}
 
-		colonIdx := strings.Index(pipeStr, ":")
+		colonIdx := indexUnquoted(pipeStr, ':')
 		var name string
 		var args []string
+		var argAccs, argData []accessor
 		if colonIdx == -1 {
 			name = pipeStr
 		} else {
 			name = fastTrim(pipeStr[:colonIdx])
 			argsStr := fastTrim(pipeStr[colonIdx+1:])
 			if argsStr != "" {
-				args = splitArgs(argsStr)
+				args, argAccs, argData = splitArgs(argsStr)
 			}
 		}
-		tempPipes = append(tempPipes, pipe{name: name, args: args})
+		tempPipes = append(tempPipes, pipe{name: name, args: args, argAccs: argAccs, argData: argData})
 	}
 
 	// Copy pipes to avoid holding pool reference
@@ -163,12 +257,33 @@ func compileAccessor(expr string) (accessor, []pipe, error) {
 	return acc, pipes, nil
 }
 
+// compileTerm compiles a path, a function call such as asset("app.css"), or
+// a parenthesized expression such as (a ? b : c) whose result feeds the
+// filters that follow.
+func compileTerm(expr string) (accessor, error) {
+	if inner, ok := unwrapParens(expr); ok {
+		return compileOperand(inner)
+	}
+	if name, args, ok := splitCall(expr); ok {
+		return compileCall(name, args)
+	}
+	return compilePath(expr)
+}
+
 func compilePath(path string) (accessor, error) {
 	path = fastTrim(path)
 	if path == "" {
 		return boundAcc{}, nil
 	}
 
+	// Literals: quoted strings, numbers, true/false
+	if v, ok := parseLiteral(path); ok {
+		return literalAcc{val: v}, nil
+	}
+	if c := path[0]; c == '"' || c == '\'' || isDigit(c) || c == '-' {
+		return nil, fmt.Errorf("invalid literal %s", path)
+	}
+
 	steps := stepsPool.Get().([]step)
 	steps = steps[:0]
 
@@ -183,13 +298,20 @@ func compilePath(path string) (accessor, error) {
 		steps = append(steps, idxSteps...)
 	} else {
 		name, rest, idxSteps = scanDotted(path)
-		steps = append(steps, fieldStep{name: name})
+		steps = append(steps, newFieldStep(name))
 		steps = append(steps, idxSteps...)
 	}
 
 	for rest != "" {
+		prev := rest
 		name, rest, idxSteps = scanDotted(rest)
-		steps = append(steps, fieldStep{name: name})
+		if name == "" && len(idxSteps) == 0 {
+			// Nothing scanned: rest starts with an operator or other character
+			// no path can hold, and scanning it again would loop forever
+			stepsPool.Put(steps[:0])
+			return nil, fmt.Errorf("unexpected %q in %s", prev[:1], path)
+		}
+		steps = append(steps, newFieldStep(name))
 		steps = append(steps, idxSteps...)
 	}
 
@@ -198,7 +320,7 @@ func compilePath(path string) (accessor, error) {
 	copy(finalSteps, steps)
 	stepsPool.Put(steps[:0])
 
-	return boundAcc{steps: finalSteps}, nil
+	return boundAcc{steps: finalSteps, path: path, pos: new(srcPos)}, nil
 }
 
 func scanDotted(s string) (ident string, rest string, idxSteps []step) {
@@ -231,14 +353,15 @@ func scanDotted(s string) (ident string, rest string, idxSteps []step) {
 				j = k
 				continue
 			}
-			// number index
-			start := k
-			for k < len(s) && isDigit(s[k]) {
-				k++
-			}
-			if k > start {
-				idx, _ := strconv.Atoi(s[start:k])
-				idxSteps = append(idxSteps, indexStep{idx: idx})
+			// number index, negative counting from the end, or a lo:hi slice
+			lo, end, hasLo := scanIndex(s, k)
+			k = end
+			if k < len(s) && s[k] == ':' {
+				hi, end, hasHi := scanIndex(s, k+1)
+				k = end
+				idxSteps = append(idxSteps, sliceStep{lo: lo, hi: hi, hasLo: hasLo, hasHi: hasHi})
+			} else if hasLo {
+				idxSteps = append(idxSteps, indexStep{idx: lo})
 			}
 			if k < len(s) && s[k] == ']' {
 				k++
@@ -256,6 +379,65 @@ func scanDotted(s string) (ident string, rest string, idxSteps []step) {
 	return
 }
 
+// scanIndex parses an optionally negative integer at s[k:], returning it
+// with the offset just past it. ok is false if there is none.
+func scanIndex(s string, k int) (n, end int, ok bool) {
+	start := k
+	if k < len(s) && s[k] == '-' {
+		k++
+	}
+	digits := k
+	for k < len(s) && isDigit(s[k]) {
+		k++
+	}
+	if k == digits {
+		return 0, start, false
+	}
+	n, err := strconv.Atoi(s[start:k])
+	return n, k, err == nil
+}
+
+// indexUnquoted returns the index of the first c in s that is not inside a
+// single- or double-quoted literal, or -1.
+func indexUnquoted(s string, c byte) int {
+	inQuote := byte(0)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuote != 0:
+			if s[i] == inQuote {
+				inQuote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			inQuote = s[i]
+		case s[i] == c:
+			return i
+		}
+	}
+	return -1
+}
+
+// editDistance returns the Levenshtein distance between a and b in runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
 func isAlphaNum(b byte) bool {
 	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
 }
@@ -301,12 +483,58 @@ func returnFields(fields []string) {
 	fieldsPool.Put(fields[:0])
 }
 
-func splitArgs(s string) []string {
-	parts := strings.Split(s, ":")
-	for i := range parts {
-		parts[i] = fastTrim(unquote(parts[i]))
+// splitArgs splits filter arguments on colons that are outside quoted
+// literals, so "15:04:05" or "http://..." stay intact, then unquotes them.
+// Arguments naming a variable, such as $taxRate or $item.price, also get an
+// accessor reading them as a local in locals and one reading them from the
+// data in data, both nil when there are none. Other arguments are literal.
+func splitArgs(s string) (args []string, locals, data []accessor) {
+	parts := make([]string, 0, 2)
+	for {
+		idx := indexUnquoted(s, ':')
+		if idx == -1 {
+			break
+		}
+		parts = append(parts, fastTrim(s[:idx]))
+		s = s[idx+1:]
+	}
+	parts = append(parts, fastTrim(s))
+
+	args = make([]string, len(parts))
+	for i, part := range parts {
+		args[i] = unquote(part)
+		if len(part) < 2 || part[0] != '$' || !isPathArg(part) {
+			continue
+		}
+		local, err := compilePath(part)
+		if err != nil {
+			continue
+		}
+		fromData, err := compilePath(part[1:])
+		if err != nil {
+			continue
+		}
+		if locals == nil {
+			locals, data = make([]accessor, len(parts)), make([]accessor, len(parts))
+		}
+		locals[i], data[i] = local, fromData
+	}
+	return args, locals, data
+}
+
+// isPathArg reports whether an unquoted filter argument could name a
+// variable: an identifier or $local, optionally followed by fields and
+// indices.
+func isPathArg(s string) bool {
+	if s == "" || !(s[0] == '$' || s[0] == '_' || (s[0] >= 'a' && s[0] <= 'z') || (s[0] >= 'A' && s[0] <= 'Z')) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if c := s[i]; !isAlphaNum(c) && c != '_' && c != '.' && c != '[' && c != ']' {
+			return false
+		}
 	}
-	return parts
+	return true
 }
 
 func unquote(s string) string {
@@ -324,6 +552,8 @@ func toStringFast(v any, sb *strings.Builder) string {
 	switch x := v.(type) {
 	case string:
 		return x
+	case SafeString:
+		return string(x)
 	case []byte:
 		return *(*string)(unsafe.Pointer(&x)) // zero-copy conversion
 	case int: